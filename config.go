@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -9,16 +10,192 @@ import (
 const envPrefix = "DRONE"
 
 type Config struct {
-	Secret            string   `split_words:"true" required:"true"`
-	ServerHost        string   `split_words:"true" required:"true" default:"0.0.0.0"`
-	ServerPort        uint16   `split_words:"true" required:"true" default:"3000"`
-	EmailSMTPHost     string   `split_words:"true" required:"true" default:"localhost"`
-	EmailSMTPPort     uint16   `split_words:"true" required:"true" default:"25"`
-	EmailSMTPUsername string   `split_words:"true" required:"false"`
-	EmailSMTPPassword string   `split_words:"true" required:"false"`
-	EmailFrom         string   `split_words:"true" required:"true" default:"drone@localhost"`
-	EmailCC           []string `split_words:"true" required:"false"`
-	EmailBCC          []string `split_words:"true" required:"false"`
+	Secret                      string            `split_words:"true" required:"true"`
+	PreviousSecrets             []string          `split_words:"true" required:"false"`
+	SignatureMaxSkew            time.Duration     `split_words:"true" required:"true" default:"5m"`
+	ServerHost                  string            `split_words:"true" required:"true" default:"0.0.0.0"`
+	ServerPort                  uint16            `split_words:"true" required:"true" default:"3000"`
+	DataDir                     string            `split_words:"true" required:"true" default:"/data"`
+	EmailTransport              TransportProvider `split_words:"true" required:"true" default:"smtp"`
+	EmailSMTPHost               string            `split_words:"true" required:"true" default:"localhost"`
+	EmailSMTPPort               uint16            `split_words:"true" required:"true" default:"25"`
+	EmailSMTPUsername           string            `split_words:"true" required:"false"`
+	EmailSMTPPassword           string            `split_words:"true" required:"false"`
+	EmailSMTPTLS                SMTPTLSMode       `envconfig:"EMAIL_SMTP_TLS" required:"true" default:"starttls-optional"`
+	EmailSMTPCAFile             string            `envconfig:"EMAIL_SMTP_CA_FILE" required:"false"`
+	EmailSMTPClientCertFile     string            `split_words:"true" required:"false"`
+	EmailSMTPClientKeyFile      string            `split_words:"true" required:"false"`
+	EmailSMTPServerName         string            `split_words:"true" required:"false"`
+	EmailSMTPInsecureSkipVerify bool              `split_words:"true" required:"false" default:"false"`
+	EmailSMTPAuth               SMTPAuthMechanism `envconfig:"EMAIL_SMTP_AUTH" required:"true" default:"auto"`
+	EmailSMTPOAuthTokenURL      string            `envconfig:"EMAIL_SMTP_OAUTH_TOKEN_URL" required:"false"`
+	EmailSMTPOAuthClientID      string            `envconfig:"EMAIL_SMTP_OAUTH_CLIENT_ID" required:"false"`
+	EmailSMTPOAuthClientSecret  string            `envconfig:"EMAIL_SMTP_OAUTH_CLIENT_SECRET" required:"false"`
+	EmailSMTPOAuthRefreshToken  string            `envconfig:"EMAIL_SMTP_OAUTH_REFRESH_TOKEN" required:"false"`
+	EmailSMTPOAuthScopes        []string          `envconfig:"EMAIL_SMTP_OAUTH_SCOPES" required:"false"`
+	EmailSMTPMaxConnections     uint16            `split_words:"true" required:"true" default:"4"`
+	EmailSMTPIdleTimeout        time.Duration     `split_words:"true" required:"true" default:"30s"`
+	EmailSMTPMaxMessages        uint16            `split_words:"true" required:"true" default:"100"`
+	EmailSMTPRelaysFile         string            `split_words:"true" required:"false"`
+	EmailSMTPBreakerThreshold   uint16            `split_words:"true" required:"true" default:"3"`
+	EmailSMTPBreakerCooldown    time.Duration     `split_words:"true" required:"true" default:"1m"`
+	EmailAPIKey                 string            `split_words:"true" required:"false"`
+	EmailAPIURL                 string            `envconfig:"EMAIL_API_URL" required:"false"`
+	EmailMailgunDomain          string            `split_words:"true" required:"false"`
+	EmailSESRegion              string            `split_words:"true" required:"false"`
+	EmailSESAccessKeyID         string            `split_words:"true" required:"false"`
+	EmailSESSecretAccessKey     string            `split_words:"true" required:"false"`
+	EmailSESSessionToken        string            `split_words:"true" required:"false"`
+	EmailSendmailPath           string            `split_words:"true" required:"true" default:"/usr/sbin/sendmail"`
+	EmailSendmailArgs           []string          `split_words:"true" required:"false" default:"-i"`
+	EmailMaildir                string            `split_words:"true" required:"false"`
+	EmailDKIMDomain             string            `split_words:"true" required:"false"`
+	EmailDKIMSelector           string            `split_words:"true" required:"false"`
+	EmailDKIMKeyFile            string            `split_words:"true" required:"false"`
+	EmailDKIMHeaders            []string          `split_words:"true" required:"true" default:"From,Reply-To,Subject,Date,To,Cc,Message-Id,In-Reply-To,References,Mime-Version,Content-Type"`
+	EmailFrom                   string            `split_words:"true" required:"true" default:"drone@localhost"`
+	EmailCC                     []string          `split_words:"true" required:"false"`
+	EmailBCC                    []string          `split_words:"true" required:"false"`
+	EmailRulesFile              string            `split_words:"true" required:"false"`
+	EmailDirectoryFile          string            `split_words:"true" required:"false"`
+	EmailTemplateDir            string            `split_words:"true" required:"false"`
+	EmailHeaders                map[string]string `split_words:"true" required:"false"`
+	EmailInlineAvatars          bool              `split_words:"true" required:"false" default:"false"`
+	EmailTrailers               []string          `split_words:"true" required:"false" default:"Co-authored-by"`
+	EmailMaxAttempts            uint16            `split_words:"true" required:"true" default:"10"`
+	EmailWorkers                uint16            `split_words:"true" required:"true" default:"4"`
+	EmailQueueSize              uint16            `split_words:"true" required:"true" default:"1000"`
+	EmailQueueOverflow          OverflowPolicy    `split_words:"true" required:"true" default:"reject"`
+	EmailLogLines               uint16            `split_words:"true" required:"true" default:"50"`
+	EmailLogMaxBytes            uint32            `split_words:"true" required:"true" default:"8192"`
+	EmailLogAttachment          bool              `split_words:"true" required:"false" default:"false"`
+	DedupWindow                 time.Duration     `split_words:"true" required:"true" default:"1h"`
+	DedupBackend                DedupBackend      `split_words:"true" required:"true" default:"memory"`
+	DedupRedisURL               string            `envconfig:"DEDUP_REDIS_URL" required:"false"`
+	APIServer                   string            `split_words:"true" required:"false"`
+	APIToken                    string            `split_words:"true" required:"false"`
+	LDAPURL                     string            `envconfig:"LDAP_URL" required:"false"`
+	LDAPBindDN                  string            `split_words:"true" required:"false"`
+	LDAPBindPassword            string            `split_words:"true" required:"false"`
+	LDAPBaseDN                  string            `split_words:"true" required:"false"`
+	LDAPFilter                  string            `split_words:"true" required:"true" default:"(|(mail={email})(uid={login})(cn={name}))"`
+	LDAPMailAttribute           string            `split_words:"true" required:"true" default:"mail"`
+	LDAPCCAttributes            []string          `envconfig:"LDAP_CC_ATTRIBUTES" required:"false"`
+	LDAPCacheTTL                time.Duration     `split_words:"true" required:"true" default:"1h"`
+}
+
+// OverflowPolicy defines what happens to a new message when the buffer in
+// front of the email workers is full.
+type OverflowPolicy string
+
+const (
+	OverflowBlock      OverflowPolicy = "block"
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	OverflowReject     OverflowPolicy = "reject"
+)
+
+func (p *OverflowPolicy) Decode(value string) error {
+	switch policy := OverflowPolicy(value); policy {
+	case OverflowBlock, OverflowDropOldest, OverflowReject:
+		*p = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown overflow policy %q", value)
+	}
+}
+
+// TransportProvider defines how messages are delivered: to SMTP relays,
+// through the HTTP API of an email provider, to the local sendmail binary, or
+// into a Maildir on disk.
+type TransportProvider string
+
+const (
+	TransportSMTP     TransportProvider = "smtp"
+	TransportSendGrid TransportProvider = "sendgrid"
+	TransportMailgun  TransportProvider = "mailgun"
+	TransportSES      TransportProvider = "ses"
+	TransportPostmark TransportProvider = "postmark"
+	TransportSendmail TransportProvider = "sendmail"
+	TransportMaildir  TransportProvider = "maildir"
+)
+
+func (p *TransportProvider) Decode(value string) error {
+	switch provider := TransportProvider(value); provider {
+	case TransportSMTP, TransportSendGrid, TransportMailgun, TransportSES, TransportPostmark, TransportSendmail, TransportMaildir:
+		*p = provider
+		return nil
+	case "file":
+		*p = TransportMaildir
+		return nil
+	default:
+		return fmt.Errorf("unknown email transport %q", value)
+	}
+}
+
+// SMTPTLSMode defines how connections to the SMTP relay are secured:
+// in plain text, upgraded with STARTTLS when the relay offers it or in all
+// cases, or with TLS from the start of the connection.
+type SMTPTLSMode string
+
+const (
+	SMTPTLSNone             SMTPTLSMode = "none"
+	SMTPTLSStartTLSOptional SMTPTLSMode = "starttls-optional"
+	SMTPTLSStartTLSRequired SMTPTLSMode = "starttls-required"
+	SMTPTLSImplicit         SMTPTLSMode = "implicit"
+)
+
+func (m *SMTPTLSMode) Decode(value string) error {
+	switch mode := SMTPTLSMode(value); mode {
+	case SMTPTLSNone, SMTPTLSStartTLSOptional, SMTPTLSStartTLSRequired, SMTPTLSImplicit:
+		*m = mode
+		return nil
+	default:
+		return fmt.Errorf("unknown smtp tls mode %q", value)
+	}
+}
+
+// SMTPAuthMechanism defines how the webhook authenticates to the SMTP relay.
+// With auto, the mechanism is negotiated from the ones the relay offers.
+type SMTPAuthMechanism string
+
+const (
+	SMTPAuthAuto        SMTPAuthMechanism = "auto"
+	SMTPAuthNone        SMTPAuthMechanism = "none"
+	SMTPAuthPlain       SMTPAuthMechanism = "plain"
+	SMTPAuthLogin       SMTPAuthMechanism = "login"
+	SMTPAuthCRAMMD5     SMTPAuthMechanism = "cram-md5"
+	SMTPAuthXOAuth2     SMTPAuthMechanism = "xoauth2"
+	SMTPAuthOAuthBearer SMTPAuthMechanism = "oauthbearer"
+)
+
+func (m *SMTPAuthMechanism) Decode(value string) error {
+	switch mechanism := SMTPAuthMechanism(value); mechanism {
+	case SMTPAuthAuto, SMTPAuthNone, SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5, SMTPAuthXOAuth2, SMTPAuthOAuthBearer:
+		*m = mechanism
+		return nil
+	default:
+		return fmt.Errorf("unknown smtp auth mechanism %q", value)
+	}
+}
+
+// DedupBackend defines where the notifications that were queued recently are
+// remembered to skip duplicate webhooks.
+type DedupBackend string
+
+const (
+	DedupBackendMemory DedupBackend = "memory"
+	DedupBackendStore  DedupBackend = "store"
+	DedupBackendRedis  DedupBackend = "redis"
+)
+
+func (b *DedupBackend) Decode(value string) error {
+	switch backend := DedupBackend(value); backend {
+	case DedupBackendMemory, DedupBackendStore, DedupBackendRedis:
+		*b = backend
+		return nil
+	default:
+		return fmt.Errorf("unknown dedup backend %q", value)
+	}
 }
 
 func NewConfigFromEnv() (Config, error) {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -9,30 +10,154 @@ import (
 
 func TestNewConfigFromEnv(t *testing.T) {
 	t.Setenv("DRONE_SECRET", "test-secret")
+	t.Setenv("DRONE_PREVIOUS_SECRETS", "old-secret,older-secret")
+	t.Setenv("DRONE_SIGNATURE_MAX_SKEW", "1m")
 	t.Setenv("DRONE_SERVER_HOST", "127.0.0.1")
 	t.Setenv("DRONE_SERVER_PORT", "8080")
+	t.Setenv("DRONE_DATA_DIR", "/var/lib/drone-email-webhook")
+	t.Setenv("DRONE_EMAIL_TRANSPORT", "ses")
 	t.Setenv("DRONE_EMAIL_SMTP_HOST", "smtp.example.com")
 	t.Setenv("DRONE_EMAIL_SMTP_PORT", "587")
 	t.Setenv("DRONE_EMAIL_SMTP_USERNAME", "test@example.com")
 	t.Setenv("DRONE_EMAIL_SMTP_PASSWORD", "password123")
+	t.Setenv("DRONE_EMAIL_SMTP_TLS", "implicit")
+	t.Setenv("DRONE_EMAIL_SMTP_CA_FILE", "/etc/drone-email-webhook/ca.pem")
+	t.Setenv("DRONE_EMAIL_SMTP_CLIENT_CERT_FILE", "/etc/drone-email-webhook/client.pem")
+	t.Setenv("DRONE_EMAIL_SMTP_CLIENT_KEY_FILE", "/etc/drone-email-webhook/client-key.pem")
+	t.Setenv("DRONE_EMAIL_SMTP_SERVER_NAME", "relay.example.com")
+	t.Setenv("DRONE_EMAIL_SMTP_INSECURE_SKIP_VERIFY", "true")
+	t.Setenv("DRONE_EMAIL_SMTP_AUTH", "xoauth2")
+	t.Setenv("DRONE_EMAIL_SMTP_OAUTH_TOKEN_URL", "https://login.example.com/oauth2/token")
+	t.Setenv("DRONE_EMAIL_SMTP_OAUTH_CLIENT_ID", "drone")
+	t.Setenv("DRONE_EMAIL_SMTP_OAUTH_CLIENT_SECRET", "client-secret")
+	t.Setenv("DRONE_EMAIL_SMTP_OAUTH_REFRESH_TOKEN", "refresh-token")
+	t.Setenv("DRONE_EMAIL_SMTP_OAUTH_SCOPES", "https://outlook.office365.com/.default,offline_access")
+	t.Setenv("DRONE_EMAIL_SMTP_MAX_CONNECTIONS", "2")
+	t.Setenv("DRONE_EMAIL_SMTP_IDLE_TIMEOUT", "1m")
+	t.Setenv("DRONE_EMAIL_SMTP_MAX_MESSAGES", "20")
+	t.Setenv("DRONE_EMAIL_SMTP_RELAYS_FILE", "/etc/drone-email-webhook/relays.yml")
+	t.Setenv("DRONE_EMAIL_SMTP_BREAKER_THRESHOLD", "5")
+	t.Setenv("DRONE_EMAIL_SMTP_BREAKER_COOLDOWN", "2m")
+	t.Setenv("DRONE_EMAIL_API_KEY", "api-key")
+	t.Setenv("DRONE_EMAIL_API_URL", "https://api.eu.mailgun.net")
+	t.Setenv("DRONE_EMAIL_MAILGUN_DOMAIN", "mg.example.com")
+	t.Setenv("DRONE_EMAIL_SES_REGION", "eu-west-1")
+	t.Setenv("DRONE_EMAIL_SES_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("DRONE_EMAIL_SES_SECRET_ACCESS_KEY", "secret-access-key")
+	t.Setenv("DRONE_EMAIL_SES_SESSION_TOKEN", "session-token")
+	t.Setenv("DRONE_EMAIL_SENDMAIL_PATH", "/usr/bin/msmtp")
+	t.Setenv("DRONE_EMAIL_SENDMAIL_ARGS", "-C,/etc/msmtprc")
+	t.Setenv("DRONE_EMAIL_MAILDIR", "/var/mail/drone")
+	t.Setenv("DRONE_EMAIL_DKIM_DOMAIN", "example.com")
+	t.Setenv("DRONE_EMAIL_DKIM_SELECTOR", "drone")
+	t.Setenv("DRONE_EMAIL_DKIM_KEY_FILE", "/etc/drone-email-webhook/dkim.pem")
+	t.Setenv("DRONE_EMAIL_DKIM_HEADERS", "From,To,Subject")
 	t.Setenv("DRONE_EMAIL_FROM", "drone@example.com")
 	t.Setenv("DRONE_EMAIL_CC", "admin1@example.com,admin2@example.com")
 	t.Setenv("DRONE_EMAIL_BCC", "security1@example.com,security2@example.com")
+	t.Setenv("DRONE_EMAIL_RULES_FILE", "/etc/drone-email-webhook/rules.yml")
+	t.Setenv("DRONE_EMAIL_DIRECTORY_FILE", "/etc/drone-email-webhook/directory.yml")
+	t.Setenv("DRONE_EMAIL_TEMPLATE_DIR", "/etc/drone-email-webhook/templates")
+	t.Setenv("DRONE_EMAIL_HEADERS", "X-Team:platform,X-Environment:production")
+	t.Setenv("DRONE_EMAIL_INLINE_AVATARS", "true")
+	t.Setenv("DRONE_EMAIL_TRAILERS", "Co-authored-by,Reviewed-by")
+	t.Setenv("DRONE_EMAIL_MAX_ATTEMPTS", "5")
+	t.Setenv("DRONE_EMAIL_WORKERS", "8")
+	t.Setenv("DRONE_EMAIL_QUEUE_SIZE", "50")
+	t.Setenv("DRONE_EMAIL_QUEUE_OVERFLOW", "drop-oldest")
+	t.Setenv("DRONE_EMAIL_LOG_LINES", "20")
+	t.Setenv("DRONE_EMAIL_LOG_MAX_BYTES", "4096")
+	t.Setenv("DRONE_EMAIL_LOG_ATTACHMENT", "true")
+	t.Setenv("DRONE_DEDUP_WINDOW", "30m")
+	t.Setenv("DRONE_DEDUP_BACKEND", "store")
+	t.Setenv("DRONE_DEDUP_REDIS_URL", "redis://localhost:6379/0")
+	t.Setenv("DRONE_API_SERVER", "https://drone.example.com")
+	t.Setenv("DRONE_API_TOKEN", "test-token")
+	t.Setenv("DRONE_LDAP_URL", "ldaps://ldap.example.com")
+	t.Setenv("DRONE_LDAP_BIND_DN", "cn=drone,dc=example,dc=com")
+	t.Setenv("DRONE_LDAP_BIND_PASSWORD", "secret")
+	t.Setenv("DRONE_LDAP_BASE_DN", "ou=people,dc=example,dc=com")
+	t.Setenv("DRONE_LDAP_FILTER", "(mail={email})")
+	t.Setenv("DRONE_LDAP_MAIL_ATTRIBUTE", "userPrincipalName")
+	t.Setenv("DRONE_LDAP_CC_ATTRIBUTES", "manager,memberOf")
+	t.Setenv("DRONE_LDAP_CACHE_TTL", "15m")
 
 	actual, err := NewConfigFromEnv()
 
 	require.NoError(t, err)
 	assert.Equal(t, Config{
-		Secret:            "test-secret",
-		ServerHost:        "127.0.0.1",
-		ServerPort:        8080,
-		EmailSMTPHost:     "smtp.example.com",
-		EmailSMTPPort:     587,
-		EmailSMTPUsername: "test@example.com",
-		EmailSMTPPassword: "password123",
-		EmailFrom:         "drone@example.com",
-		EmailCC:           []string{"admin1@example.com", "admin2@example.com"},
-		EmailBCC:          []string{"security1@example.com", "security2@example.com"},
+		Secret:                      "test-secret",
+		PreviousSecrets:             []string{"old-secret", "older-secret"},
+		SignatureMaxSkew:            time.Minute,
+		ServerHost:                  "127.0.0.1",
+		ServerPort:                  8080,
+		DataDir:                     "/var/lib/drone-email-webhook",
+		EmailTransport:              TransportSES,
+		EmailSMTPHost:               "smtp.example.com",
+		EmailSMTPPort:               587,
+		EmailSMTPUsername:           "test@example.com",
+		EmailSMTPPassword:           "password123",
+		EmailSMTPTLS:                SMTPTLSImplicit,
+		EmailSMTPCAFile:             "/etc/drone-email-webhook/ca.pem",
+		EmailSMTPClientCertFile:     "/etc/drone-email-webhook/client.pem",
+		EmailSMTPClientKeyFile:      "/etc/drone-email-webhook/client-key.pem",
+		EmailSMTPServerName:         "relay.example.com",
+		EmailSMTPInsecureSkipVerify: true,
+		EmailSMTPAuth:               SMTPAuthXOAuth2,
+		EmailSMTPOAuthTokenURL:      "https://login.example.com/oauth2/token",
+		EmailSMTPOAuthClientID:      "drone",
+		EmailSMTPOAuthClientSecret:  "client-secret",
+		EmailSMTPOAuthRefreshToken:  "refresh-token",
+		EmailSMTPOAuthScopes:        []string{"https://outlook.office365.com/.default", "offline_access"},
+		EmailSMTPMaxConnections:     2,
+		EmailSMTPIdleTimeout:        time.Minute,
+		EmailSMTPMaxMessages:        20,
+		EmailSMTPRelaysFile:         "/etc/drone-email-webhook/relays.yml",
+		EmailSMTPBreakerThreshold:   5,
+		EmailSMTPBreakerCooldown:    2 * time.Minute,
+		EmailAPIKey:                 "api-key",
+		EmailAPIURL:                 "https://api.eu.mailgun.net",
+		EmailMailgunDomain:          "mg.example.com",
+		EmailSESRegion:              "eu-west-1",
+		EmailSESAccessKeyID:         "AKIDEXAMPLE",
+		EmailSESSecretAccessKey:     "secret-access-key",
+		EmailSESSessionToken:        "session-token",
+		EmailSendmailPath:           "/usr/bin/msmtp",
+		EmailSendmailArgs:           []string{"-C", "/etc/msmtprc"},
+		EmailMaildir:                "/var/mail/drone",
+		EmailDKIMDomain:             "example.com",
+		EmailDKIMSelector:           "drone",
+		EmailDKIMKeyFile:            "/etc/drone-email-webhook/dkim.pem",
+		EmailDKIMHeaders:            []string{"From", "To", "Subject"},
+		EmailFrom:                   "drone@example.com",
+		EmailCC:                     []string{"admin1@example.com", "admin2@example.com"},
+		EmailBCC:                    []string{"security1@example.com", "security2@example.com"},
+		EmailRulesFile:              "/etc/drone-email-webhook/rules.yml",
+		EmailDirectoryFile:          "/etc/drone-email-webhook/directory.yml",
+		EmailTemplateDir:            "/etc/drone-email-webhook/templates",
+		EmailHeaders:                map[string]string{"X-Team": "platform", "X-Environment": "production"},
+		EmailInlineAvatars:          true,
+		EmailTrailers:               []string{"Co-authored-by", "Reviewed-by"},
+		EmailMaxAttempts:            5,
+		EmailWorkers:                8,
+		EmailQueueSize:              50,
+		EmailQueueOverflow:          OverflowDropOldest,
+		EmailLogLines:               20,
+		EmailLogMaxBytes:            4096,
+		EmailLogAttachment:          true,
+		DedupWindow:                 30 * time.Minute,
+		DedupBackend:                DedupBackendStore,
+		DedupRedisURL:               "redis://localhost:6379/0",
+		APIServer:                   "https://drone.example.com",
+		APIToken:                    "test-token",
+		LDAPURL:                     "ldaps://ldap.example.com",
+		LDAPBindDN:                  "cn=drone,dc=example,dc=com",
+		LDAPBindPassword:            "secret",
+		LDAPBaseDN:                  "ou=people,dc=example,dc=com",
+		LDAPFilter:                  "(mail={email})",
+		LDAPMailAttribute:           "userPrincipalName",
+		LDAPCCAttributes:            []string{"manager", "memberOf"},
+		LDAPCacheTTL:                15 * time.Minute,
 	}, actual)
 }
 
@@ -42,11 +167,52 @@ func TestNewConfigFromEnv_Defaults(t *testing.T) {
 	cfg, err := NewConfigFromEnv()
 
 	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, cfg.SignatureMaxSkew)
 	assert.Equal(t, "0.0.0.0", cfg.ServerHost)
 	assert.Equal(t, uint16(3000), cfg.ServerPort)
+	assert.Equal(t, "/data", cfg.DataDir)
 	assert.Equal(t, "localhost", cfg.EmailSMTPHost)
 	assert.Equal(t, uint16(25), cfg.EmailSMTPPort)
+	assert.Equal(t, SMTPTLSStartTLSOptional, cfg.EmailSMTPTLS)
+	assert.False(t, cfg.EmailSMTPInsecureSkipVerify)
+	assert.Equal(t, SMTPAuthAuto, cfg.EmailSMTPAuth)
+	assert.Equal(t, uint16(4), cfg.EmailSMTPMaxConnections)
+	assert.Equal(t, 30*time.Second, cfg.EmailSMTPIdleTimeout)
+	assert.Equal(t, uint16(100), cfg.EmailSMTPMaxMessages)
+	assert.Empty(t, cfg.EmailSMTPRelaysFile)
+	assert.Equal(t, TransportSMTP, cfg.EmailTransport)
+	assert.Equal(t, uint16(3), cfg.EmailSMTPBreakerThreshold)
+	assert.Equal(t, time.Minute, cfg.EmailSMTPBreakerCooldown)
+	assert.Equal(t, "/usr/sbin/sendmail", cfg.EmailSendmailPath)
+	assert.Equal(t, []string{"-i"}, cfg.EmailSendmailArgs)
+	assert.Empty(t, cfg.EmailMaildir)
+	assert.Empty(t, cfg.EmailDKIMKeyFile)
+	assert.Equal(t, []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id", "In-Reply-To", "References", "Mime-Version", "Content-Type"}, cfg.EmailDKIMHeaders)
 	assert.Equal(t, "drone@localhost", cfg.EmailFrom)
+	assert.False(t, cfg.EmailInlineAvatars)
+	assert.Equal(t, []string{"Co-authored-by"}, cfg.EmailTrailers)
+	assert.Equal(t, uint16(10), cfg.EmailMaxAttempts)
+	assert.Equal(t, uint16(4), cfg.EmailWorkers)
+	assert.Equal(t, uint16(1000), cfg.EmailQueueSize)
+	assert.Equal(t, OverflowReject, cfg.EmailQueueOverflow)
+	assert.Equal(t, uint16(50), cfg.EmailLogLines)
+	assert.Equal(t, uint32(8192), cfg.EmailLogMaxBytes)
+	assert.False(t, cfg.EmailLogAttachment)
+	assert.Equal(t, time.Hour, cfg.DedupWindow)
+	assert.Equal(t, DedupBackendMemory, cfg.DedupBackend)
+	assert.Equal(t, "(|(mail={email})(uid={login})(cn={name}))", cfg.LDAPFilter)
+	assert.Equal(t, "mail", cfg.LDAPMailAttribute)
+	assert.Equal(t, time.Hour, cfg.LDAPCacheTTL)
+}
+
+func TestNewConfigFromEnv_FileTransport(t *testing.T) {
+	t.Setenv("DRONE_SECRET", "test-secret")
+	t.Setenv("DRONE_EMAIL_TRANSPORT", "file")
+
+	cfg, err := NewConfigFromEnv()
+
+	require.NoError(t, err)
+	assert.Equal(t, TransportMaildir, cfg.EmailTransport)
 }
 
 func TestNewConfigFromEnv_Errors(t *testing.T) {
@@ -69,4 +235,35 @@ func TestNewConfigFromEnv_Errors(t *testing.T) {
 		_, err := NewConfigFromEnv()
 		assert.Error(t, err)
 	})
+
+	t.Run("invalid email queue overflow policy", func(t *testing.T) {
+		t.Setenv("DRONE_SECRET", "test-secret")
+		t.Setenv("DRONE_EMAIL_QUEUE_OVERFLOW", "invalid")
+		_, err := NewConfigFromEnv()
+		assert.Error(t, err)
+	})
+	t.Run("invalid email transport", func(t *testing.T) {
+		t.Setenv("DRONE_SECRET", "test-secret")
+		t.Setenv("DRONE_EMAIL_TRANSPORT", "sparkpost")
+		_, err := NewConfigFromEnv()
+		assert.Error(t, err)
+	})
+	t.Run("invalid email SMTP TLS mode", func(t *testing.T) {
+		t.Setenv("DRONE_SECRET", "test-secret")
+		t.Setenv("DRONE_EMAIL_SMTP_TLS", "ssl")
+		_, err := NewConfigFromEnv()
+		assert.Error(t, err)
+	})
+	t.Run("invalid email SMTP auth mechanism", func(t *testing.T) {
+		t.Setenv("DRONE_SECRET", "test-secret")
+		t.Setenv("DRONE_EMAIL_SMTP_AUTH", "ntlm")
+		_, err := NewConfigFromEnv()
+		assert.Error(t, err)
+	})
+	t.Run("invalid dedup backend", func(t *testing.T) {
+		t.Setenv("DRONE_SECRET", "test-secret")
+		t.Setenv("DRONE_DEDUP_BACKEND", "etcd")
+		_, err := NewConfigFromEnv()
+		assert.Error(t, err)
+	})
 }
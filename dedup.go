@@ -0,0 +1,267 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/redis/go-redis/v9"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// dedupCacheSize bounds the number of builds remembered by the in-memory
+	// deduplicator. The least recently seen ones are forgotten first.
+	dedupCacheSize = 10000
+	// dedupPruneInterval is how often the persistent deduplicator removes
+	// expired entries.
+	dedupPruneInterval = time.Minute
+	// dedupRedisTimeout bounds each request to the Redis server, so that an
+	// unreachable server does not hold the webhooks.
+	dedupRedisTimeout = 5 * time.Second
+	// dedupRedisPrefix namespaces the keys of the Redis deduplicator.
+	dedupRedisPrefix = "drone-email-webhook:dedup:"
+)
+
+var dedupBucket = []byte("dedup")
+
+// Deduplicator remembers the notifications that were queued recently, so that
+// webhooks delivered more than once for the same build and status do not send
+// the same email twice.
+type Deduplicator interface {
+	// Claim records key and returns false if it was already recorded within the
+	// deduplication window.
+	Claim(ctx context.Context, key string) (bool, error)
+	// Release forgets key, so that the notification can be queued again.
+	Release(ctx context.Context, key string) error
+	// Close releases the connections to the shared deduplication state.
+	Close()
+}
+
+// NewDeduplicator returns the deduplicator selected by the config, or nil when
+// deduplication is disabled.
+func NewDeduplicator(cfg Config, store *Store) (Deduplicator, error) {
+	if cfg.DedupWindow <= 0 {
+		return nil, nil //nolint:nilnil // deduplication is disabled
+	}
+	switch cfg.DedupBackend {
+	case DedupBackendStore:
+		return NewStoreDeduplicator(store, cfg.DedupWindow)
+	case DedupBackendRedis:
+		return NewRedisDeduplicator(cfg.DedupRedisURL, cfg.DedupWindow)
+	default:
+		return NewMemoryDeduplicator(cfg.DedupWindow, dedupCacheSize), nil
+	}
+}
+
+// dedupKey identifies a notification by the ID of the build and its status.
+func dedupKey(build *drone.Build) string {
+	return strconv.FormatInt(build.ID, 10) + "\x00" + build.Status
+}
+
+// MemoryDeduplicator keeps recently claimed keys in a bounded LRU cache.
+type MemoryDeduplicator struct {
+	window time.Duration
+	size   int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryDedupEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+func NewMemoryDeduplicator(window time.Duration, size int) *MemoryDeduplicator {
+	return &MemoryDeduplicator{
+		window:  window,
+		size:    size,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (d *MemoryDeduplicator) Claim(_ context.Context, key string) (bool, error) {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if elem, ok := d.entries[key]; ok {
+		entry := elem.Value.(*memoryDedupEntry) //nolint:forcetypeassert // the list only holds entries
+		if now.Before(entry.expiresAt) {
+			d.lru.MoveToFront(elem)
+			return false, nil
+		}
+		d.lru.Remove(elem)
+		delete(d.entries, key)
+	}
+
+	d.entries[key] = d.lru.PushFront(&memoryDedupEntry{key: key, expiresAt: now.Add(d.window)})
+	for d.lru.Len() > d.size {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*memoryDedupEntry).key) //nolint:forcetypeassert // the list only holds entries
+	}
+	return true, nil
+}
+
+func (d *MemoryDeduplicator) Release(_ context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elem, ok := d.entries[key]; ok {
+		d.lru.Remove(elem)
+		delete(d.entries, key)
+	}
+	return nil
+}
+
+func (d *MemoryDeduplicator) Close() {}
+
+// DedupEntry is the expiry of a claimed key in the persistent deduplicator.
+type DedupEntry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StoreDeduplicator keeps claimed keys in the store, so that they survive
+// restarts.
+type StoreDeduplicator struct {
+	store  *Store
+	window time.Duration
+	now    func() time.Time
+
+	// prunedAt is only accessed within write transactions, which bbolt runs
+	// one at a time.
+	prunedAt time.Time
+}
+
+func NewStoreDeduplicator(store *Store, window time.Duration) (*StoreDeduplicator, error) {
+	if err := store.createBucket(dedupBucket); err != nil {
+		return nil, err
+	}
+	return &StoreDeduplicator{store: store, window: window, now: time.Now}, nil
+}
+
+func (d *StoreDeduplicator) Claim(_ context.Context, key string) (bool, error) {
+	now := d.now()
+	claimed := false
+	err := d.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dedupBucket)
+		if now.Sub(d.prunedAt) >= dedupPruneInterval {
+			if err := pruneDedupEntries(b, now); err != nil {
+				return err
+			}
+			d.prunedAt = now
+		}
+
+		if v := b.Get([]byte(key)); v != nil {
+			var entry DedupEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err //nolint:wrapcheck // wrapped below
+			}
+			if now.Before(entry.ExpiresAt) {
+				return nil
+			}
+		}
+
+		v, err := json.Marshal(&DedupEntry{ExpiresAt: now.Add(d.window)})
+		if err != nil {
+			return err //nolint:wrapcheck // wrapped below
+		}
+		claimed = true
+		return b.Put([]byte(key), v) //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return false, fmt.Errorf("deduplicator: claim %q: %w", key, err)
+	}
+	return claimed, nil
+}
+
+func (d *StoreDeduplicator) Release(_ context.Context, key string) error {
+	err := d.store.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(dedupBucket).Delete([]byte(key)) //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return fmt.Errorf("deduplicator: release %q: %w", key, err)
+	}
+	return nil
+}
+
+// Close does nothing, the store is closed by its owner.
+func (d *StoreDeduplicator) Close() {}
+
+func pruneDedupEntries(b *bbolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var entry DedupEntry
+		if err := json.Unmarshal(v, &entry); err != nil || !now.Before(entry.ExpiresAt) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err //nolint:wrapcheck // wrapped by the caller
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err //nolint:wrapcheck // wrapped by the caller
+		}
+	}
+	return nil
+}
+
+// RedisDeduplicator keeps claimed keys in a Redis server, which several
+// instances receiving the webhooks of the same Drone server can share. Keys
+// are claimed atomically with SET NX and expire with the window.
+type RedisDeduplicator struct {
+	client *redis.Client
+	window time.Duration
+}
+
+// NewRedisDeduplicator connects to the Redis server of a redis:// or rediss://
+// URL, such as redis://:password@localhost:6379/0.
+func NewRedisDeduplicator(url string, window time.Duration) (*RedisDeduplicator, error) {
+	if url == "" {
+		return nil, errors.New("deduplicator: missing redis url")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("deduplicator: %w", err)
+	}
+	return &RedisDeduplicator{client: redis.NewClient(opts), window: window}, nil
+}
+
+func (d *RedisDeduplicator) Claim(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dedupRedisTimeout)
+	defer cancel()
+	claimed, err := d.client.SetNX(ctx, dedupRedisPrefix+key, 1, d.window).Result()
+	if err != nil {
+		return false, fmt.Errorf("deduplicator: claim %q: %w", key, err)
+	}
+	return claimed, nil
+}
+
+func (d *RedisDeduplicator) Release(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dedupRedisTimeout)
+	defer cancel()
+	if err := d.client.Del(ctx, dedupRedisPrefix+key).Err(); err != nil {
+		return fmt.Errorf("deduplicator: release %q: %w", key, err)
+	}
+	return nil
+}
+
+func (d *RedisDeduplicator) Close() {
+	if err := d.client.Close(); err != nil {
+		slog.Error("deduplicator close error", "err", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/drone/drone-go/drone"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func assertClaim(t *testing.T, dedup Deduplicator, key string, expected bool) {
+	t.Helper()
+	claimed, err := dedup.Claim(t.Context(), key)
+	require.NoError(t, err)
+	assert.Equal(t, expected, claimed, key)
+}
+
+func TestNewDeduplicator(t *testing.T) {
+	store := newStore(t)
+
+	dedup, err := NewDeduplicator(Config{}, store)
+	require.NoError(t, err)
+	assert.Nil(t, dedup)
+
+	dedup, err = NewDeduplicator(Config{DedupWindow: time.Hour, DedupBackend: DedupBackendMemory}, store)
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryDeduplicator{}, dedup)
+
+	dedup, err = NewDeduplicator(Config{DedupWindow: time.Hour, DedupBackend: DedupBackendStore}, store)
+	require.NoError(t, err)
+	assert.IsType(t, &StoreDeduplicator{}, dedup)
+
+	dedup, err = NewDeduplicator(Config{DedupWindow: time.Hour, DedupBackend: DedupBackendRedis, DedupRedisURL: "redis://localhost:6379/0"}, store)
+	require.NoError(t, err)
+	assert.IsType(t, &RedisDeduplicator{}, dedup)
+
+	_, err = NewDeduplicator(Config{DedupWindow: time.Hour, DedupBackend: DedupBackendRedis}, store)
+	require.EqualError(t, err, "deduplicator: missing redis url")
+
+	_, err = NewDeduplicator(Config{DedupWindow: time.Hour, DedupBackend: DedupBackendRedis, DedupRedisURL: "localhost:6379"}, store)
+	require.ErrorContains(t, err, "deduplicator: ")
+}
+
+func TestDedupKey(t *testing.T) {
+	assert.Equal(t, "42\x00failure", dedupKey(&drone.Build{ID: 42, Number: 7, Status: "failure"}))
+	assert.NotEqual(t, dedupKey(&drone.Build{ID: 42, Status: "failure"}), dedupKey(&drone.Build{ID: 42, Status: "success"}))
+}
+
+func TestMemoryDeduplicator(t *testing.T) {
+	t.Run("claim", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		dedup := NewMemoryDeduplicator(time.Hour, 10)
+		dedup.now = func() time.Time { return now }
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		assertClaim(t, dedup, "1\x00failure", false)
+		assertClaim(t, dedup, "1\x00success", true)
+
+		now = now.Add(time.Hour)
+		assertClaim(t, dedup, "1\x00failure", true)
+	})
+
+	t.Run("release", func(t *testing.T) {
+		t.Parallel()
+		dedup := NewMemoryDeduplicator(time.Hour, 10)
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		require.NoError(t, dedup.Release(t.Context(), "1\x00failure"))
+		require.NoError(t, dedup.Release(t.Context(), "2\x00failure"))
+		assertClaim(t, dedup, "1\x00failure", true)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		t.Parallel()
+		dedup := NewMemoryDeduplicator(time.Hour, 3)
+
+		for i := range 3 {
+			assertClaim(t, dedup, strconv.Itoa(i), true)
+		}
+		assertClaim(t, dedup, "0", false)
+		assertClaim(t, dedup, "3", true)
+
+		assert.Equal(t, 3, dedup.lru.Len())
+		assertClaim(t, dedup, "0", false)
+		assertClaim(t, dedup, "1", true)
+	})
+}
+
+func TestStoreDeduplicator(t *testing.T) {
+	t.Run("claim", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		dedup, err := NewStoreDeduplicator(newStore(t), time.Hour)
+		require.NoError(t, err)
+		dedup.now = func() time.Time { return now }
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		assertClaim(t, dedup, "1\x00failure", false)
+		assertClaim(t, dedup, "1\x00success", true)
+
+		now = now.Add(time.Hour)
+		assertClaim(t, dedup, "1\x00failure", true)
+	})
+
+	t.Run("release", func(t *testing.T) {
+		t.Parallel()
+		dedup, err := NewStoreDeduplicator(newStore(t), time.Hour)
+		require.NoError(t, err)
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		require.NoError(t, dedup.Release(t.Context(), "1\x00failure"))
+		assertClaim(t, dedup, "1\x00failure", true)
+	})
+
+	t.Run("persists across reopen", func(t *testing.T) {
+		t.Parallel()
+		dataDir := t.TempDir()
+		store, err := OpenStore(dataDir)
+		require.NoError(t, err)
+		dedup, err := NewStoreDeduplicator(store, time.Hour)
+		require.NoError(t, err)
+		assertClaim(t, dedup, "1\x00failure", true)
+		store.Close()
+
+		store, err = OpenStore(dataDir)
+		require.NoError(t, err)
+		t.Cleanup(store.Close)
+		dedup, err = NewStoreDeduplicator(store, time.Hour)
+		require.NoError(t, err)
+		assertClaim(t, dedup, "1\x00failure", false)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		store := newStore(t)
+		dedup, err := NewStoreDeduplicator(store, time.Minute)
+		require.NoError(t, err)
+		dedup.now = func() time.Time { return now }
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		assertClaim(t, dedup, "2\x00failure", true)
+		now = now.Add(dedupPruneInterval)
+		assertClaim(t, dedup, "3\x00failure", true)
+
+		var keys []string
+		require.NoError(t, store.db.View(func(tx *bbolt.Tx) error {
+			return tx.Bucket(dedupBucket).ForEach(func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		}))
+		assert.Equal(t, []string{"3\x00failure"}, keys)
+	})
+}
+
+func newRedisDeduplicator(t *testing.T, server *miniredis.Miniredis) *RedisDeduplicator {
+	t.Helper()
+	dedup, err := NewRedisDeduplicator("redis://"+server.Addr()+"/0", time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(dedup.Close)
+	return dedup
+}
+
+func TestRedisDeduplicator(t *testing.T) {
+	t.Run("claim", func(t *testing.T) {
+		t.Parallel()
+		server := miniredis.RunT(t)
+		dedup := newRedisDeduplicator(t, server)
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		assertClaim(t, dedup, "1\x00failure", false)
+		assertClaim(t, dedup, "1\x00success", true)
+		assert.Equal(t, time.Hour, server.TTL(dedupRedisPrefix+"1\x00failure"))
+
+		server.FastForward(time.Hour)
+		assertClaim(t, dedup, "1\x00failure", true)
+	})
+
+	t.Run("release", func(t *testing.T) {
+		t.Parallel()
+		dedup := newRedisDeduplicator(t, miniredis.RunT(t))
+
+		assertClaim(t, dedup, "1\x00failure", true)
+		require.NoError(t, dedup.Release(t.Context(), "1\x00failure"))
+		assertClaim(t, dedup, "1\x00failure", true)
+	})
+
+	t.Run("shared by instances", func(t *testing.T) {
+		t.Parallel()
+		server := miniredis.RunT(t)
+
+		assertClaim(t, newRedisDeduplicator(t, server), "1\x00failure", true)
+		assertClaim(t, newRedisDeduplicator(t, server), "1\x00failure", false)
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		t.Parallel()
+		dedup := newRedisDeduplicator(t, miniredis.RunT(t))
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		_, err := dedup.Claim(ctx, "1\x00failure")
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, dedup.Release(ctx, "1\x00failure"), context.Canceled)
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		t.Parallel()
+		server := miniredis.RunT(t)
+		dedup := newRedisDeduplicator(t, server)
+		server.Close()
+
+		_, err := dedup.Claim(t.Context(), "1\x00failure")
+		require.ErrorContains(t, err, `deduplicator: claim "1\x00failure": `)
+		require.ErrorContains(t, dedup.Release(t.Context(), "1\x00failure"), `deduplicator: release "1\x00failure": `)
+	})
+}
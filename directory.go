@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Author identifies the person behind a build by git email and Drone logins.
+type Author struct {
+	Name   string
+	Email  string
+	Logins []string
+}
+
+// Directory maps git author emails and Drone logins to canonical delivery
+// addresses, rewrites email domains and provides a fallback recipient.
+type Directory struct {
+	Users         []DirectoryUser    `yaml:"users"`
+	Rewrites      []DirectoryRewrite `yaml:"rewrites"`
+	Undeliverable []string           `yaml:"undeliverable"`
+	Fallback      string             `yaml:"fallback"`
+
+	byEmail map[string]string
+	byLogin map[string]string
+}
+
+type DirectoryUser struct {
+	Email   string   `yaml:"email"`
+	Aliases []string `yaml:"aliases"`
+	Logins  []string `yaml:"logins"`
+}
+
+// DirectoryRewrite replaces the domain of addresses matching From, a pattern
+// of the form "*@<domain glob>", with the domain of To, of the form "*@<domain>".
+type DirectoryRewrite struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+func LoadDirectory(filename string) (*Directory, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("directory: %w", err)
+	}
+	defer f.Close()
+
+	var d Directory
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&d); err != nil {
+		return nil, fmt.Errorf("directory: parse %s: %w", filename, err)
+	}
+	if err := d.init(); err != nil {
+		return nil, fmt.Errorf("directory: %s: %w", filename, err)
+	}
+	return &d, nil
+}
+
+func (d *Directory) init() error {
+	var errs []error
+	d.byEmail = make(map[string]string)
+	d.byLogin = make(map[string]string)
+	for i, user := range d.Users {
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			errs = append(errs, fmt.Errorf("user #%d: invalid email %q: %w", i+1, user.Email, err))
+			continue
+		}
+		d.byEmail[strings.ToLower(user.Email)] = user.Email
+		for _, alias := range user.Aliases {
+			d.byEmail[strings.ToLower(alias)] = user.Email
+		}
+		for _, login := range user.Logins {
+			d.byLogin[strings.ToLower(login)] = user.Email
+		}
+	}
+	for i, rewrite := range d.Rewrites {
+		from, fromOK := strings.CutPrefix(rewrite.From, "*@")
+		to, toOK := strings.CutPrefix(rewrite.To, "*@")
+		if _, err := path.Match(from, ""); !fromOK || err != nil {
+			errs = append(errs, fmt.Errorf("rewrite #%d: invalid from %q", i+1, rewrite.From))
+		}
+		if !toOK || to == "" || strings.ContainsAny(to, "*?[@") {
+			errs = append(errs, fmt.Errorf("rewrite #%d: invalid to %q", i+1, rewrite.To))
+		}
+	}
+	for _, pattern := range d.Undeliverable {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid undeliverable pattern %q: %w", pattern, err))
+		}
+	}
+	if d.Fallback != "" {
+		if _, err := mail.ParseAddress(d.Fallback); err != nil {
+			errs = append(errs, fmt.Errorf("invalid fallback %q: %w", d.Fallback, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lookup returns the address of the user mapped to the author by email or
+// login, or false when the author is not listed.
+func (d *Directory) Lookup(a Author) (string, bool) {
+	if addr, ok := d.byEmail[strings.ToLower(a.Email)]; ok {
+		return formatAddress(a.Name, addr), true
+	}
+	for _, login := range a.Logins {
+		if addr, ok := d.byLogin[strings.ToLower(login)]; ok {
+			return formatAddress(a.Name, addr), true
+		}
+	}
+	return "", false
+}
+
+// Resolve returns the delivery address for the author: a mapped user by email
+// or login first, then the author email with domain rewrites applied, then the
+// fallback. It returns an empty string when none of them is deliverable.
+func (d *Directory) Resolve(a Author) string {
+	if addr, ok := d.Lookup(a); ok {
+		return addr
+	}
+	if addr := d.rewrite(a.Email); d.deliverable(addr) {
+		return formatAddress(a.Name, addr)
+	}
+	return d.Fallback
+}
+
+func (d *Directory) rewrite(addr string) string {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok {
+		return addr
+	}
+	for _, rewrite := range d.Rewrites {
+		from := strings.TrimPrefix(rewrite.From, "*@")
+		if matched, _ := path.Match(strings.ToLower(from), strings.ToLower(domain)); matched {
+			return local + "@" + strings.TrimPrefix(rewrite.To, "*@")
+		}
+	}
+	return addr
+}
+
+func (d *Directory) deliverable(addr string) bool {
+	if parsed, err := mail.ParseAddress(addr); err != nil || parsed.Address != addr {
+		return false
+	}
+	for _, pattern := range d.Undeliverable {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(addr)); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// formatAddress formats addr, which may already carry a display name, as an
+// email address with the given name unless it has one.
+func formatAddress(name, addr string) string {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+	if parsed.Name == "" {
+		parsed.Name = name
+	}
+	if parsed.Name == "" {
+		return parsed.Address
+	}
+	return parsed.String()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDirectory = `
+users:
+  - email: Alice Smith <alice@corp.example.com>
+    aliases: [alice@gmail.com, 1234+alice@users.noreply.github.com]
+    logins: [alice, asmith]
+  - email: bob@corp.example.com
+    logins: [bob]
+rewrites:
+  - from: "*@old-corp.example.com"
+    to: "*@corp.example.com"
+  - from: "*@*.old-corp.example.com"
+    to: "*@corp.example.com"
+undeliverable:
+  - "*@users.noreply.github.com"
+  - "*@localhost"
+fallback: ci-failures@corp.example.com
+`
+
+func TestLoadDirectory(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		d, err := LoadDirectory(writeFile(t, "directory.yml", testDirectory))
+
+		require.NoError(t, err)
+		assert.Len(t, d.Users, 2)
+		assert.Len(t, d.Rewrites, 2)
+		assert.Equal(t, "ci-failures@corp.example.com", d.Fallback)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		for name, content := range map[string]string{
+			"invalid user email":  "users:\n  - email: not an address\n",
+			"invalid rewrite":     "rewrites:\n  - from: old.example.com\n    to: \"*@new.example.com\"\n",
+			"wildcard rewrite to": "rewrites:\n  - from: \"*@old.example.com\"\n    to: \"*@*.example.com\"\n",
+			"invalid pattern":     "undeliverable: [\"[\"]\n",
+			"invalid fallback":    "fallback: nobody\n",
+			"unknown field":       "groups: []\n",
+		} {
+			_, err := LoadDirectory(writeFile(t, "directory.yml", content))
+			assert.Error(t, err, name)
+		}
+
+		_, err := LoadDirectory(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestDirectory_Resolve(t *testing.T) {
+	d, err := LoadDirectory(writeFile(t, "directory.yml", testDirectory))
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		author   Author
+		expected string
+	}{
+		"mapped email": {
+			author:   Author{Name: "Alice", Email: "ALICE@gmail.com"},
+			expected: "\"Alice Smith\" <alice@corp.example.com>",
+		},
+		"mapped noreply email": {
+			author:   Author{Name: "Alice", Email: "1234+alice@users.noreply.github.com"},
+			expected: "\"Alice Smith\" <alice@corp.example.com>",
+		},
+		"mapped login": {
+			author:   Author{Name: "Bob", Email: "bob@home.example.com", Logins: []string{"", "bob"}},
+			expected: "\"Bob\" <bob@corp.example.com>",
+		},
+		"rewritten domain": {
+			author:   Author{Name: "Carol", Email: "carol@old-corp.example.com"},
+			expected: "\"Carol\" <carol@corp.example.com>",
+		},
+		"rewritten subdomain": {
+			author:   Author{Name: "Carol", Email: "carol@eu.old-corp.example.com"},
+			expected: "\"Carol\" <carol@corp.example.com>",
+		},
+		"unmapped valid email": {
+			author:   Author{Name: "Dave", Email: "dave@example.com"},
+			expected: "\"Dave\" <dave@example.com>",
+		},
+		"name with comma": {
+			author:   Author{Name: "Doe, John", Email: "john@example.com"},
+			expected: "\"Doe, John\" <john@example.com>",
+		},
+		"unmapped noreply email": {
+			author:   Author{Name: "Eve", Email: "5678+eve@users.noreply.github.com"},
+			expected: "ci-failures@corp.example.com",
+		},
+		"invalid email": {
+			author:   Author{Name: "Frank", Email: "frank"},
+			expected: "ci-failures@corp.example.com",
+		},
+		"empty email": {
+			author:   Author{Name: "Grace", Logins: []string{"grace"}},
+			expected: "ci-failures@corp.example.com",
+		},
+	} {
+		assert.Equal(t, tc.expected, d.Resolve(tc.author), name)
+	}
+
+	t.Run("without fallback", func(t *testing.T) {
+		t.Parallel()
+		d, err := LoadDirectory(writeFile(t, "directory.yml", "undeliverable: [\"*@localhost\"]\n"))
+		require.NoError(t, err)
+
+		assert.Empty(t, d.Resolve(Author{Name: "Root", Email: "root@localhost"}))
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/jordan-wright/email"
+)
+
+// dkimMinRSABits is the smallest RSA key that verifiers accept, see RFC 8301.
+const dkimMinRSABits = 1024
+
+// DKIMSigner adds a DKIM-Signature header to outgoing messages, with the
+// relaxed canonicalization of both the header and the body, so that the
+// signature survives the whitespace changes made by relays.
+type DKIMSigner struct {
+	options dkim.SignOptions
+}
+
+// NewDKIMSigner loads the RSA or Ed25519 private key of DRONE_EMAIL_DKIM_KEY_FILE.
+// It returns a nil signer when DKIM signing is not configured.
+func NewDKIMSigner(cfg Config) (*DKIMSigner, error) {
+	if cfg.EmailDKIMKeyFile == "" {
+		if cfg.EmailDKIMDomain != "" || cfg.EmailDKIMSelector != "" {
+			return nil, errors.New("dkim: missing key file")
+		}
+		return nil, nil
+	}
+	if cfg.EmailDKIMDomain == "" || cfg.EmailDKIMSelector == "" {
+		return nil, errors.New("dkim: missing domain or selector")
+	}
+	if !slices.ContainsFunc(cfg.EmailDKIMHeaders, func(key string) bool { return strings.EqualFold(key, "From") }) {
+		return nil, errors.New("dkim: signed headers must include From")
+	}
+	key, err := loadDKIMKey(cfg.EmailDKIMKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	// DMARC only passes when the signing domain is aligned with the domain of
+	// the From address.
+	if from, err := mail.ParseAddress(cfg.EmailFrom); err == nil {
+		_, fromDomain, _ := strings.Cut(from.Address, "@")
+		fromDomain, domain := strings.ToLower(fromDomain), strings.ToLower(cfg.EmailDKIMDomain)
+		if fromDomain != domain && !strings.HasSuffix(fromDomain, "."+domain) {
+			slog.Warn("dkim domain is not aligned with the sender domain", "domain", cfg.EmailDKIMDomain, "from", from.Address)
+		}
+	}
+
+	return &DKIMSigner{options: dkim.SignOptions{
+		Domain:                 cfg.EmailDKIMDomain,
+		Selector:               cfg.EmailDKIMSelector,
+		Signer:                 key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             cfg.EmailDKIMHeaders,
+	}}, nil
+}
+
+// loadDKIMKey reads a PEM encoded private key, either an RSA key in PKCS #1
+// form or an RSA or Ed25519 key in PKCS #8 form.
+func loadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key in %s", path)
+	}
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < dkimMinRSABits {
+			return nil, fmt.Errorf("rsa key in %s is shorter than %d bits", path, dkimMinRSABits)
+		}
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported %T private key in %s, expected RSA or Ed25519", key, path)
+	}
+}
+
+// Sign returns the message with its DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(msg), &s.options); err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	return signed.Bytes(), nil
+}
+
+// messageBytes returns the MIME message sent by the transports that deliver
+// it as is, signed when signer is set.
+func messageBytes(emailMsg *email.Email, signer *DKIMSigner) ([]byte, error) {
+	msg, err := emailMsg.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("build message: %w", err)
+	}
+	if signer == nil {
+		return msg, nil
+	}
+	return signer.Sign(msg)
+}
@@ -7,7 +7,15 @@ const ourDir = join(__dirname, "out");
 await rm(ourDir, { recursive: true, force: true });
 await mkdir(ourDir, { recursive: true });
 
-const html = await render(<Email {...Email.BuildProps} />, { pretty: false });
+const variants = {
+  "email.html": "failure",
+  "recovery.html": "recovery",
+} as const;
 
-const outFile = join(ourDir, "email.html");
-await writeFile(outFile, html, "utf-8");
+for (const [file, variant] of Object.entries(variants)) {
+  const html = await render(
+    <Email {...Email.BuildProps} goTemplate variant={variant} />,
+    { pretty: false },
+  );
+  await writeFile(join(ourDir, file), html, "utf-8");
+}
@@ -14,13 +14,38 @@ import {
   Text,
 } from "@react-email/components";
 import { readFileSync } from "fs";
+import { Fragment } from "react";
 import { join } from "path";
 
-const droneLogoPng = `data:image/png;base64,${readFileSync(join(__dirname, "../images/drone-logo.png")).toString("base64")}`;
-const referencePng = `data:image/png;base64,${readFileSync(join(__dirname, "../images/reference.png")).toString("base64")}`;
-const commitPng = `data:image/png;base64,${readFileSync(join(__dirname, "../images/commit.png")).toString("base64")}`;
+// Images are inlined as data URIs in the preview, and referenced by the
+// Content-ID of the inline attachments that the sender adds in Go templates.
+const image = (name: string, goTemplate: boolean) =>
+  goTemplate
+    ? `cid:${name}`
+    : `data:image/png;base64,${readFileSync(join(__dirname, "../images", name)).toString("base64")}`;
+
+export interface StepProps {
+  name: string;
+  status: string;
+  exitCode: string;
+  duration: string;
+  link: string;
+  failed: boolean;
+  logTail?: string;
+}
+
+export interface StageProps {
+  name: string;
+  status: string;
+  link: string;
+  steps: StepProps[];
+}
 
 export interface EmailProps {
+  // goTemplate wraps repeated and conditional blocks in Go template actions
+  // when rendering the templates embedded in the Go binary.
+  goTemplate?: boolean;
+  variant?: "failure" | "recovery";
   subject: string;
   from: string;
   to: string;
@@ -31,12 +56,16 @@ export interface EmailProps {
   commitMessage: string;
   authorAvatar: string;
   authorName: string;
+  participants: { role: string; name: string }[];
+  stages: StageProps[];
   droneBuildLink: string;
   droneServerHost: string;
   droneServerLink: string;
 }
 
 export const Email = ({
+  goTemplate = false,
+  variant = "failure",
   subject,
   from,
   to,
@@ -47,10 +76,55 @@ export const Email = ({
   commitMessage,
   authorAvatar,
   authorName,
+  participants,
+  stages,
   droneBuildLink,
   droneServerHost,
   droneServerLink,
 }: EmailProps) => {
+  const action = (name: string) => (goTemplate ? `{{${name}}}` : null);
+
+  const failedStep = (step: StepProps) => (
+    <>
+      <Row className="rounded bg-red-50 font-semibold text-red-700 dark:bg-red-950 dark:text-red-400">
+        <Column className="py-1 pl-4">
+          <Link
+            className="text-red-700 underline dark:text-red-400"
+            href={step.link}
+          >
+            {step.name}
+          </Link>
+        </Column>
+        <Column className="w-1/4 text-right">exit code {step.exitCode}</Column>
+        <Column className="w-[15%] pr-1 text-right">{step.duration}</Column>
+      </Row>
+      {action("with .LogTail")}
+      {(goTemplate || step.logTail) && (
+        <pre className="mb-2 mt-1 overflow-x-auto whitespace-pre-wrap break-all rounded bg-slate-800 p-2 font-mono text-xs text-slate-200 dark:bg-slate-900">
+          {goTemplate ? "{{.}}" : step.logTail}
+        </pre>
+      )}
+      {action("end")}
+    </>
+  );
+
+  const passedStep = (step: StepProps) => (
+    <Row>
+      <Column className="py-1 pl-4">
+        <Link
+          className="text-sky-500 no-underline dark:text-sky-700"
+          href={step.link}
+        >
+          {step.name}
+        </Link>
+      </Column>
+      <Column className="w-1/4 text-right text-slate-500">{step.status}</Column>
+      <Column className="w-[15%] pr-1 text-right text-slate-500">
+        {step.duration}
+      </Column>
+    </Row>
+  );
+
   return (
     <Tailwind
       config={{
@@ -65,11 +139,17 @@ export const Email = ({
             <Img
               className="mx-auto my-6"
               height="64"
-              src={droneLogoPng}
+              src={image("drone-logo.png", goTemplate)}
               width="64"
             />
             <Section className="rounded-lg bg-slate-50 p-4 shadow dark:bg-slate-950">
-              <Heading className="m-0 rounded bg-red-500 px-4 py-2 text-center text-lg text-slate-100 dark:bg-red-700">
+              <Heading
+                className={`m-0 rounded px-4 py-2 text-center text-lg text-slate-100 ${
+                  variant === "recovery"
+                    ? "bg-green-500 dark:bg-green-700"
+                    : "bg-red-500 dark:bg-red-700"
+                }`}
+              >
                 {header}
               </Heading>
               <Section className="my-6 min-w-80 text-sm">
@@ -85,7 +165,7 @@ export const Email = ({
                     <Img
                       className="inline align-middle"
                       height="24"
-                      src={referencePng}
+                      src={image("reference.png", goTemplate)}
                       width="24"
                     />{" "}
                     {reference}
@@ -97,7 +177,7 @@ export const Email = ({
                     <Img
                       className="inline align-middle"
                       height="24"
-                      src={commitPng}
+                      src={image("commit.png", goTemplate)}
                       width="24"
                     />{" "}
                     {commitHash}
@@ -117,7 +197,61 @@ export const Email = ({
                     {authorName}
                   </Column>
                 </Row>
+                {action("range .Participants")}
+                {participants.map(({ role, name }) => (
+                  <Row key={`${role}:${name}`} className="pt-2">
+                    <Column className="w-1/4 pr-1">{role}</Column>
+                    <Column className="line-clamp-3 text-ellipsis break-all">
+                      {name}
+                    </Column>
+                  </Row>
+                ))}
+                {action("end")}
               </Section>
+              {action("if .Stages")}
+              {(goTemplate || stages.length > 0) && (
+                <Section className="mb-6 min-w-80 text-sm">
+                  {action("range .Stages")}
+                  {stages.map((stage) => (
+                    <Fragment key={stage.link}>
+                      <Row className="pb-1 pt-2">
+                        <Column className="font-semibold">
+                          <Link
+                            className="text-slate-800 no-underline dark:text-slate-200"
+                            href={stage.link}
+                          >
+                            {stage.name}
+                          </Link>
+                        </Column>
+                        <Column className="w-1/4 text-right text-slate-500">
+                          {stage.status}
+                        </Column>
+                      </Row>
+                      {action("range .Steps")}
+                      {stage.steps.map((step) => (
+                        <Fragment key={step.link}>
+                          {goTemplate ? (
+                            <>
+                              {action("if .Failed")}
+                              {failedStep(step)}
+                              {action("else")}
+                              {passedStep(step)}
+                              {action("end")}
+                            </>
+                          ) : step.failed ? (
+                            failedStep(step)
+                          ) : (
+                            passedStep(step)
+                          )}
+                        </Fragment>
+                      ))}
+                      {action("end")}
+                    </Fragment>
+                  ))}
+                  {action("end")}
+                </Section>
+              )}
+              {action("end")}
               <Section className="text-center">
                 <Button
                   className="rounded bg-sky-500 px-6 py-3 text-center font-semibold text-slate-100 no-underline dark:bg-sky-700"
@@ -156,6 +290,34 @@ Email.PreviewProps = {
   authorAvatar:
     "https://secure.gravatar.com/avatar/83c8d33e33a4999d1618d48ba0135e11?d=identicon",
   authorName: "Sarah Johnson",
+  participants: [{ role: "Co-authored-by", name: "Michael Chen" }],
+  stages: [
+    {
+      name: "default",
+      status: "failure",
+      link: "https://ci.harness.io/harness/drone/4321/1",
+      steps: [
+        {
+          name: "clone",
+          status: "success",
+          exitCode: "0",
+          duration: "4s",
+          link: "https://ci.harness.io/harness/drone/4321/1/1",
+          failed: false,
+        },
+        {
+          name: "test",
+          status: "failure",
+          exitCode: "2",
+          duration: "1m32s",
+          link: "https://ci.harness.io/harness/drone/4321/1/2",
+          failed: true,
+          logTail:
+            "--- FAIL: TestDelivery (0.02s)\n    delivery_test.go:42: expected 1 message, got 0\nFAIL",
+        },
+      ],
+    },
+  ],
   droneBuildLink: "https://ci.harness.io/harness/drone/4321",
   droneServerHost: "ci.harness.io",
   droneServerLink: "https://ci.harness.io",
@@ -172,6 +334,24 @@ Email.BuildProps = {
   commitMessage: "{{.CommitMessage}}",
   authorAvatar: "{{.AuthorAvatar}}",
   authorName: "{{.AuthorName}}",
+  participants: [{ role: "{{.Role}}", name: "{{.DisplayName}}" }],
+  stages: [
+    {
+      name: "{{.Name}}",
+      status: "{{.Status}}",
+      link: "{{.Link}}",
+      steps: [
+        {
+          name: "{{.Name}}",
+          status: "{{.Status}}",
+          exitCode: "{{.ExitCode}}",
+          duration: "{{.Duration}}",
+          link: "{{.Link}}",
+          failed: false,
+        },
+      ],
+    },
+  ],
   droneBuildLink: "{{.DroneBuildLink}}",
   droneServerHost: "{{.DroneServerHost}}",
   droneServerLink: "{{.DroneServerLink}}",
@@ -2,156 +2,669 @@ package main
 
 import (
 	"bytes"
-	_ "embed"
+	"context"
+	"errors"
 	"fmt"
-	htmlTemplate "html/template"
 	"log/slog"
-	"net"
-	"net/smtp"
+	"math/rand/v2"
+	"net/mail"
 	"net/textproto"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
-	textTemplate "text/template"
 	"time"
 
+	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/webhook"
 	"github.com/jordan-wright/email"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const emailSenderShutdownTimeout = 60 * time.Second
+const (
+	emailSenderShutdownTimeout = 60 * time.Second
+	emailRetryBaseDelay        = 10 * time.Second
+	emailRetryMaxDelay         = time.Hour
+	// emailRenderBudget bounds the time spent querying LDAP and fetching logs
+	// and the avatar while rendering a message, which happens while Drone waits
+	// for the webhook response.
+	emailRenderBudget = 10 * time.Second
+)
 
 var (
-	//go:embed email.html
-	htmlTemplStr string
-	//go:embed email.txt
-	textTemplStr string
-
-	htmlTempl = htmlTemplate.Must(htmlTemplate.New("html").Parse(htmlTemplStr))
-	textTempl = textTemplate.Must(textTemplate.New("text").Parse(textTemplStr))
+	errEmailSenderClosed = errors.New("email sender is closed")
+	errEmailQueueFull    = errors.New("email queue is full")
+	errEmailSuppressed   = errors.New("email suppressed")
 )
 
+type QueueStats struct {
+	Pending  int `json:"pending"`
+	Buffered int `json:"buffered"`
+	Capacity int `json:"capacity"`
+	InFlight int `json:"in_flight"`
+	Workers  int `json:"workers"`
+}
+
 type EmailSender struct {
-	host     string
-	addr     string
-	username string
-	password string
-	from     string
-	cc       []string
-	bcc      []string
+	transport   Transport
+	from        string
+	cc          []string
+	bcc         []string
+	trailers    []string
+	headers     map[string]string
+	rules       *RoutingRules
+	directory   *Directory
+	ldap        *LDAPResolver
+	templates   *Templates
+	avatars     *AvatarCache
+	threads     *ThreadTracker
+	logs        *LogFetcher
+	attachLogs  bool
+	maxAttempts int
+	workers     int
+	overflow    OverflowPolicy
 
-	closed atomic.Bool
-	wg     sync.WaitGroup
+	queue    *Queue
+	jobs     chan *QueueItem
+	inFlight atomic.Int64
+	closed   atomic.Bool
+	done     chan struct{}
+	wg       sync.WaitGroup
 }
 
-func NewEmailSender(cfg Config) *EmailSender {
-	return &EmailSender{
-		host:     cfg.EmailSMTPHost,
-		addr:     net.JoinHostPort(cfg.EmailSMTPHost, strconv.Itoa(int(cfg.EmailSMTPPort))),
-		username: cfg.EmailSMTPUsername,
-		password: cfg.EmailSMTPPassword,
-		from:     cfg.EmailFrom,
-		cc:       cfg.EmailCC,
-		bcc:      cfg.EmailBCC,
+func NewEmailSender(cfg Config, queue *Queue, threads *ThreadTracker) (*EmailSender, error) {
+	if err := validateHeaders(cfg.EmailHeaders); err != nil {
+		return nil, fmt.Errorf("email sender cannot use custom headers: %w", err)
+	}
+
+	var rules *RoutingRules
+	if cfg.EmailRulesFile != "" {
+		var err error
+		if rules, err = LoadRoutingRules(cfg.EmailRulesFile); err != nil {
+			return nil, fmt.Errorf("email sender cannot load routing rules: %w", err)
+		}
+		slog.Info("email sender loaded routing rules", "file", cfg.EmailRulesFile, "mode", rules.Mode, "rules", len(rules.Rules))
+	}
+
+	var directory *Directory
+	if cfg.EmailDirectoryFile != "" {
+		var err error
+		if directory, err = LoadDirectory(cfg.EmailDirectoryFile); err != nil {
+			return nil, fmt.Errorf("email sender cannot load directory: %w", err)
+		}
+		slog.Info("email sender loaded directory", "file", cfg.EmailDirectoryFile, "users", len(directory.Users))
+	}
+
+	var ldapResolver *LDAPResolver
+	if cfg.LDAPURL != "" {
+		var err error
+		if ldapResolver, err = NewLDAPResolver(cfg); err != nil {
+			return nil, fmt.Errorf("email sender cannot configure ldap resolver: %w", err)
+		}
+		slog.Info("email sender configured ldap resolver", "url", cfg.LDAPURL, "base_dn", cfg.LDAPBaseDN)
+	}
+
+	templates, err := LoadTemplates(cfg.EmailTemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("email sender cannot load templates: %w", err)
+	}
+	if cfg.EmailTemplateDir != "" {
+		if err := templates.Watch(); err != nil {
+			return nil, fmt.Errorf("email sender cannot watch templates: %w", err)
+		}
+		slog.Info("email sender loaded templates", "dir", cfg.EmailTemplateDir)
+	}
+
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("email sender cannot configure transport: %w", err)
+	}
+
+	var avatars *AvatarCache
+	if cfg.EmailInlineAvatars {
+		avatars = NewAvatarCache()
+	}
+
+	var logs *LogFetcher
+	if cfg.APIToken != "" {
+		logs = NewLogFetcher(cfg)
+		slog.Info("email sender configured drone api log fetcher", "server", cfg.APIServer, "lines", cfg.EmailLogLines, "attach", cfg.EmailLogAttachment)
+	}
+
+	s := &EmailSender{
+		transport:   transport,
+		from:        cfg.EmailFrom,
+		cc:          cfg.EmailCC,
+		bcc:         cfg.EmailBCC,
+		trailers:    cfg.EmailTrailers,
+		headers:     cfg.EmailHeaders,
+		rules:       rules,
+		directory:   directory,
+		ldap:        ldapResolver,
+		templates:   templates,
+		avatars:     avatars,
+		threads:     threads,
+		logs:        logs,
+		attachLogs:  cfg.EmailLogAttachment,
+		maxAttempts: max(int(cfg.EmailMaxAttempts), 1),
+		workers:     max(int(cfg.EmailWorkers), 1),
+		overflow:    cfg.EmailQueueOverflow,
+
+		queue:    queue,
+		jobs:     make(chan *QueueItem, max(int(cfg.EmailQueueSize), 1)),
+		inFlight: atomic.Int64{},
+		closed:   atomic.Bool{},
+		done:     make(chan struct{}),
+		wg:       sync.WaitGroup{},
+	}
 
-		closed: atomic.Bool{},
-		wg:     sync.WaitGroup{},
+	items, err := queue.Pending()
+	if err != nil {
+		templates.Close()
+		transport.Close()
+		return nil, fmt.Errorf("email sender cannot load pending messages: %w", err)
+	}
+	if len(items) > 0 {
+		slog.Info("email sender resuming pending deliveries", "count", len(items))
 	}
+	for _, item := range items {
+		s.schedule(item)
+	}
+	for range s.workers {
+		s.wg.Go(s.work)
+	}
+	return s, nil
 }
 
-func (s *EmailSender) SendAsync(req *webhook.Request) {
+// SendAsync renders the message and persists it in the queue before returning,
+// so that it survives delivery failures and process restarts. When the buffer
+// in front of the workers is full, the configured overflow policy applies.
+func (s *EmailSender) SendAsync(ctx context.Context, n *Notification) error {
 	if s.closed.Load() {
-		return
+		return errEmailSenderClosed
 	}
 
-	s.wg.Go(func() {
-		_ = s.Send(req)
-	})
+	req := n.Request
+	emailMsg, err := s.render(ctx, n)
+	if errors.Is(err, errEmailSuppressed) {
+		return nil
+	}
+	if err != nil {
+		emailsFailed.WithLabelValues(failureRender).Inc()
+		return err
+	}
+	emailsRendered.WithLabelValues(string(n.Kind)).Inc()
+
+	// The trace context is persisted along with the message, so that delivery
+	// attempts are part of the trace of the webhook even after a restart.
+	traceContext := propagation.MapCarrier{}
+	propagator.Inject(ctx, traceContext)
+
+	now := time.Now()
+	item := &QueueItem{
+		BuildNumber:   req.Build.Number,
+		BuildID:       req.Build.ID,
+		RepoSlug:      req.Repo.Slug,
+		Email:         emailMsg,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+		TraceContext:  traceContext,
+	}
+	if err := s.queue.Push(item); err != nil {
+		emailsFailed.WithLabelValues(failureEnqueue).Inc()
+		slog.ErrorContext(ctx, "email sender cannot enqueue message", "build_number", req.Build.Number, "error", err)
+		return fmt.Errorf("email sender cannot enqueue message: %w", err)
+	}
+	return s.dispatch(ctx, item)
+}
+
+func (s *EmailSender) QueueStats() QueueStats {
+	return QueueStats{
+		Pending:  s.queue.Len(),
+		Buffered: len(s.jobs),
+		Capacity: cap(s.jobs),
+		InFlight: int(s.inFlight.Load()),
+		Workers:  s.workers,
+	}
+}
+
+// CheckDelivery verifies that the transport can deliver messages without
+// sending any: it performs the handshake of a delivery with the SMTP relays,
+// or checks the credentials of the email API.
+func (s *EmailSender) CheckDelivery(ctx context.Context) error {
+	return s.transport.Check(ctx)
 }
 
-func (s *EmailSender) Send(req *webhook.Request) error {
-	author := req.Build.AuthorName
-	if author == "" {
-		author = req.Build.Author
+func (s *EmailSender) Send(n *Notification) error {
+	ctx := context.Background()
+	emailMsg, err := s.render(ctx, n)
+	if errors.Is(err, errEmailSuppressed) {
+		return nil
 	}
+	if err != nil {
+		emailsFailed.WithLabelValues(failureRender).Inc()
+		return err
+	}
+	emailsRendered.WithLabelValues(string(n.Kind)).Inc()
+	return s.deliver(ctx, n.Request.Build.Number, emailMsg)
+}
+
+func (s *EmailSender) render(ctx context.Context, n *Notification) (_ *email.Email, err error) {
+	req := n.Request
+	ctx, span := tracer.Start(ctx, "email.render", trace.WithAttributes(buildAttributes(req)...), trace.WithAttributes(attribute.String("notification.kind", string(n.Kind))))
+	defer func() {
+		if err != nil && !errors.Is(err, errEmailSuppressed) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	templ, ok := s.templates.Get(n.Kind)
+	if !ok {
+		return nil, fmt.Errorf("email sender has no template for %q notifications", n.Kind)
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, emailRenderBudget)
+	defer cancel()
+
+	participants := participants(req.Build.Message, req.Build.AuthorEmail, s.trailers)
+	rcpt, ok := s.recipients(fetchCtx, n, participants)
+	if !ok {
+		span.SetAttributes(attribute.Bool("email.suppressed", true))
+		slog.InfoContext(ctx, "email sender suppressed message by routing rules", "build_number", req.Build.Number, "repo_slug", req.Repo.Slug)
+		return nil, errEmailSuppressed
+	}
+	if len(rcpt.To)+len(rcpt.Cc)+len(rcpt.Bcc) == 0 {
+		span.SetAttributes(attribute.Bool("email.suppressed", true))
+		slog.WarnContext(ctx, "email sender has no recipients for message", "build_number", req.Build.Number, "repo_slug", req.Repo.Slug)
+		return nil, errEmailSuppressed
+	}
+
+	author := authorName(req.Build)
 
 	commitHash := req.Build.After
 	if len(commitHash) > 8 {
 		commitHash = commitHash[:8]
 	}
 
-	data := struct {
-		Subject         string
-		From            string
-		To              string
-		Header          string
-		Repository      string
-		Reference       string
-		CommitHash      string
-		CommitMessage   string
-		AuthorAvatar    string
-		AuthorName      string
-		DroneBuildLink  string
-		DroneServerHost string
-		DroneServerLink string
-	}{
-		Subject:         fmt.Sprintf("[%s] Failed build #%d for %s (%s)", req.Repo.Slug, req.Build.Number, req.Build.Ref, commitHash),
+	buildLink := fmt.Sprintf("%s/%s/%d", req.System.Link, req.Repo.Slug, req.Build.Number)
+	stages := summarizeStages(req.Build, buildLink)
+	attachments := s.fetchLogs(fetchCtx, req, stages)
+
+	data := emailData{
 		From:            s.from,
-		To:              fmt.Sprintf("%s <%s>", author, req.Build.AuthorEmail),
-		Header:          fmt.Sprintf("Build #%d has failed", req.Build.Number),
+		To:              strings.Join(rcpt.To, ", "),
+		Header:          fmt.Sprintf(templ.header, req.Build.Number),
 		Repository:      req.Repo.Slug,
 		Reference:       req.Build.Ref,
+		BuildNumber:     req.Build.Number,
+		Event:           req.Build.Event,
+		Status:          req.Build.Status,
 		CommitHash:      commitHash,
 		CommitMessage:   strings.TrimSpace(strings.Split(req.Build.Message, "\n")[0]),
-		AuthorAvatar:    req.Build.AuthorAvatar,
+		AuthorAvatar:    avatarURL(req.Build.AuthorAvatar),
 		AuthorName:      author,
-		DroneBuildLink:  fmt.Sprintf("%s/%s/%d", req.System.Link, req.Repo.Slug, req.Build.Number),
+		Participants:    participants,
+		Stages:          stages,
+		DroneBuildLink:  buildLink,
 		DroneServerHost: req.System.Host,
 		DroneServerLink: req.System.Link,
 	}
 
+	images := inlineImages
+	if s.avatars != nil && data.AuthorAvatar != "" {
+		if avatar, ok := s.avatars.Get(fetchCtx, string(data.AuthorAvatar)); ok {
+			data.AuthorAvatar = cidURL(avatar.name)
+			images = append(slices.Clip(images), avatar)
+		}
+	}
+
+	var subject strings.Builder
+	if err := templ.subject.Execute(&subject, &data); err != nil {
+		slog.ErrorContext(ctx, "email sender cannot execute subject template", "build_number", req.Build.Number, "error", err)
+		return nil, fmt.Errorf("email sender cannot execute subject template: %w", err)
+	}
+	data.Subject = strings.Join(strings.Fields(subject.String()), " ")
+
 	var html bytes.Buffer
-	if err := htmlTempl.Execute(&html, &data); err != nil {
-		slog.Error("email sender cannot execute HTML template", "build_number", req.Build.Number, "error", err)
-		return fmt.Errorf("email sender cannot execute HTML template: %w", err)
+	if err := templ.html.Execute(&html, &data); err != nil {
+		slog.ErrorContext(ctx, "email sender cannot execute HTML template", "build_number", req.Build.Number, "error", err)
+		return nil, fmt.Errorf("email sender cannot execute HTML template: %w", err)
 	}
 
 	var text bytes.Buffer
-	if err := textTempl.Execute(&text, &data); err != nil {
-		slog.Error("email sender cannot execute text template", "build_number", req.Build.Number, "error", err)
-		return fmt.Errorf("email sender cannot execute text template: %w", err)
+	if err := templ.text.Execute(&text, &data); err != nil {
+		slog.ErrorContext(ctx, "email sender cannot execute text template", "build_number", req.Build.Number, "error", err)
+		return nil, fmt.Errorf("email sender cannot execute text template: %w", err)
+	}
+
+	headers := droneHeaders(n, buildLink, messageIDDomain(s.from))
+	s.setThreadHeaders(headers, n)
+	for key, value := range s.headers {
+		headers.Set(key, value)
+	}
+
+	return &email.Email{
+		From:        data.From,
+		To:          rcpt.To,
+		Cc:          rcpt.Cc,
+		Bcc:         rcpt.Bcc,
+		Subject:     data.Subject,
+		HTML:        html.Bytes(),
+		Text:        text.Bytes(),
+		Headers:     headers,
+		Attachments: append(inlineAttachments(html.Bytes(), images), attachments...),
+	}, nil
+}
+
+// setThreadHeaders sets the headers that group the message with the previous
+// ones of its repo and ref. Messages are still sent, unthreaded, when the thread
+// cannot be recorded.
+func (s *EmailSender) setThreadHeaders(headers textproto.MIMEHeader, n *Notification) {
+	if s.threads == nil {
+		return
 	}
+	thread, err := s.threads.Next(n, messageIDDomain(s.from))
+	if err != nil {
+		slog.Warn("email sender cannot thread message", "build_number", n.Request.Build.Number, "error", err)
+		return
+	}
+	headers.Set("Message-Id", thread.MessageID)
+	if thread.InReplyTo != "" {
+		headers.Set("In-Reply-To", thread.InReplyTo)
+		headers.Set("References", thread.References)
+	}
+}
+
+// fetchLogs adds the log tails of the failed steps to the stage summaries and
+// returns the full logs as attachments when enabled. Steps whose logs cannot be
+// fetched before ctx is done are rendered without them.
+func (s *EmailSender) fetchLogs(ctx context.Context, req *webhook.Request, stages []StageSummary) []*email.Attachment {
+	if s.logs == nil {
+		return nil
+	}
+	var attachments []*email.Attachment
+	for i, stage := range req.Build.Stages {
+		for j, step := range stage.Steps {
+			if !stages[i].Steps[j].Failed {
+				continue
+			}
+			if ctx.Err() != nil {
+				slog.WarnContext(ctx, "email sender skipped step logs", "build_number", req.Build.Number, "error", context.Cause(ctx))
+				return attachments
+			}
+			log, err := s.logs.Fetch(ctx, req, stage, step)
+			if err != nil {
+				slog.WarnContext(ctx, "email sender cannot fetch step log", "build_number", req.Build.Number, "stage", stage.Name, "step", step.Name, "error", err)
+				continue
+			}
+			stages[i].Steps[j].LogTail = s.logs.Tail(log)
+			if s.attachLogs {
+				attachments = append(attachments, &email.Attachment{
+					Filename:    logFilename(stage.Name, step.Name),
+					ContentType: "text/plain; charset=utf-8",
+					Header:      textproto.MIMEHeader{},
+					Content:     []byte(tailBytes(log, logAttachmentMaxBytes)),
+				})
+			}
+		}
+	}
+	return attachments
+}
+
+// recipients returns the commit author and the trailer participants, and for
+// recoveries the authors of the preceding failed builds, along with the global
+// CC and BCC lists, adjusted by the routing rules if any. It returns false when
+// the message is suppressed.
+func (s *EmailSender) recipients(ctx context.Context, n *Notification, participants []Participant) (Recipients, bool) {
+	rcpt := Recipients{
+		Cc:  slices.Clone(s.cc),
+		Bcc: slices.Clone(s.bcc),
+	}
+	authors := []Author{buildAuthor(n.Request.Build)}
+	for _, p := range participants {
+		authors = append(authors, p.Author())
+	}
+	for _, addr := range n.FailedAuthors {
+		authors = append(authors, parseAuthor(addr))
+	}
+	for _, author := range authors {
+		addr, cc := s.resolve(ctx, author)
+		if addr == "" {
+			slog.Warn("email sender has no deliverable address for author", "build_number", n.Request.Build.Number, "author_email", author.Email)
+			continue
+		}
+		rcpt.To = appendAddress(rcpt.To, addr)
+		for _, addr := range cc {
+			rcpt.Cc = appendAddress(rcpt.Cc, addr)
+		}
+	}
+	if s.rules == nil {
+		return rcpt, true
+	}
+	return s.rules.Apply(n.Request, rcpt)
+}
+
+// resolve returns the delivery address of the author along with the addresses
+// to copy. Explicit directory mappings take precedence over LDAP, which in turn
+// takes precedence over directory rewrites and the fallback.
+func (s *EmailSender) resolve(ctx context.Context, author Author) (string, []string) {
+	if s.directory != nil {
+		if addr, ok := s.directory.Lookup(author); ok {
+			return addr, nil
+		}
+	}
+	if s.ldap != nil {
+		if entry, ok := s.ldap.Resolve(ctx, author); ok {
+			return entry.Mail, entry.Cc
+		}
+	}
+	if s.directory == nil {
+		return formatAddress(author.Name, author.Email), nil
+	}
+	return s.directory.Resolve(author), nil
+}
 
-	emailMsg := &email.Email{
-		From:    data.From,
-		To:      []string{data.To},
-		Cc:      s.cc,
-		Bcc:     s.bcc,
-		Subject: data.Subject,
-		HTML:    html.Bytes(),
-		Text:    text.Bytes(),
-		Headers: textproto.MIMEHeader{},
+func buildAuthor(build *drone.Build) Author {
+	return Author{
+		Name:   authorName(build),
+		Email:  build.AuthorEmail,
+		Logins: []string{build.Author, build.Sender},
 	}
+}
+
+func parseAuthor(addr string) Author {
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return Author{Email: addr}
+	}
+	return Author{Name: parsed.Name, Email: parsed.Address}
+}
 
-	var auth smtp.Auth
-	if s.username != "" && s.password != "" {
-		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+func authorName(build *drone.Build) string {
+	if build.AuthorName != "" {
+		return build.AuthorName
 	}
+	return build.Author
+}
+
+func authorAddress(build *drone.Build) string {
+	return (&mail.Address{Name: authorName(build), Address: build.AuthorEmail}).String()
+}
+
+func (s *EmailSender) deliver(ctx context.Context, buildNumber int64, emailMsg *email.Email) error {
+	ctx, span := tracer.Start(ctx, "email.send", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.Int("email.recipients", len(emailMsg.To)+len(emailMsg.Cc)+len(emailMsg.Bcc)),
+	))
+	defer span.End()
 
-	if err := emailMsg.Send(s.addr, auth); err != nil {
-		slog.Error("email sender failed to send message", "build_number", req.Build.Number, "to", data.To, "error", err)
+	start := time.Now()
+	if err := s.transport.Send(ctx, emailMsg); err != nil {
+		smtpDuration.WithLabelValues("failure").Observe(time.Since(start).Seconds())
+		emailsFailed.WithLabelValues(deliveryFailureReason(err)).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "email sender failed to send message", "build_number", buildNumber, "to", emailMsg.To, "error", err)
 		return fmt.Errorf("email sender failed to send message: %w", err)
 	}
-	slog.Info("email sender successfully sent message", "build_number", req.Build.Number, "to", data.To)
+	smtpDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+	emailsSent.Inc()
+	slog.InfoContext(ctx, "email sender successfully sent message", "build_number", buildNumber, "to", emailMsg.To)
 	return nil
 }
 
+func (s *EmailSender) dispatch(ctx context.Context, item *QueueItem) error {
+	select {
+	case s.jobs <- item:
+		return nil
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowBlock:
+		select {
+		case s.jobs <- item:
+			return nil
+		case <-s.done:
+			// The item stays persisted and is resumed on the next start.
+			return nil
+		case <-ctx.Done():
+			emailsFailed.WithLabelValues(failureEnqueue).Inc()
+			s.remove(item)
+			return fmt.Errorf("email sender cannot enqueue message: %w", ctx.Err())
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.jobs <- item:
+				return nil
+			case oldest := <-s.jobs:
+				emailsFailed.WithLabelValues(failureDropped).Inc()
+				slog.Warn("email sender dropped oldest queued message", "build_number", oldest.BuildNumber)
+				s.remove(oldest)
+			}
+		}
+	case OverflowReject:
+		fallthrough
+	default:
+		emailsFailed.WithLabelValues(failureQueueFull).Inc()
+		slog.Warn("email sender rejected message because the queue is full", "build_number", item.BuildNumber)
+		s.remove(item)
+		return errEmailQueueFull
+	}
+}
+
+// schedule hands an item over to the workers once its next attempt is due.
+// Unlike new messages, scheduled items wait for free buffer space rather than
+// being subject to the overflow policy.
+func (s *EmailSender) schedule(item *QueueItem) {
+	s.wg.Go(func() {
+		if !s.waitUntil(item.NextAttemptAt) {
+			return
+		}
+		select {
+		case s.jobs <- item:
+		case <-s.done:
+		}
+	})
+}
+
+func (s *EmailSender) work() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case item := <-s.jobs:
+			s.inFlight.Add(1)
+			s.process(item)
+			s.inFlight.Add(-1)
+		}
+	}
+}
+
+// process makes a single delivery attempt for a queued item and schedules a
+// retry with exponential backoff on failure until it runs out of attempts or
+// the message is permanently rejected. On shutdown the item is left in the
+// queue and picked up again on the next start.
+func (s *EmailSender) process(item *QueueItem) {
+	ctx := withLogAttrs(propagator.Extract(context.Background(), propagation.MapCarrier(item.TraceContext)),
+		"build_id", item.BuildID, "repo_slug", item.RepoSlug)
+	ctx, span := tracer.Start(ctx, "email.deliver", trace.WithAttributes(
+		attribute.Int64("drone.build.id", item.BuildID),
+		attribute.Int64("drone.build.number", item.BuildNumber),
+		attribute.String("drone.repo.slug", item.RepoSlug),
+		attribute.Int("email.attempt", item.Attempts+1),
+	))
+	defer span.End()
+
+	err := s.deliver(ctx, item.BuildNumber, item.Email)
+	if err == nil {
+		s.remove(item)
+		return
+	}
+	span.SetStatus(codes.Error, err.Error())
+
+	item.Attempts++
+	item.LastError = err.Error()
+	if item.Attempts >= s.maxAttempts || isPermanent(err) {
+		emailsFailed.WithLabelValues(failureGaveUp).Inc()
+		slog.ErrorContext(ctx, "email sender gave up delivering message", "build_number", item.BuildNumber, "attempts", item.Attempts, "permanent", isPermanent(err), "error", err)
+		s.remove(item)
+		return
+	}
+
+	item.NextAttemptAt = time.Now().Add(retryDelay(item.Attempts))
+	if err := s.queue.Update(item); err != nil {
+		slog.ErrorContext(ctx, "email sender cannot update queued message", "build_number", item.BuildNumber, "error", err)
+	}
+	slog.WarnContext(ctx, "email sender scheduled delivery retry", "build_number", item.BuildNumber, "attempts", item.Attempts, "next_attempt_at", item.NextAttemptAt)
+	s.schedule(item)
+}
+
+func (s *EmailSender) waitUntil(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *EmailSender) remove(item *QueueItem) {
+	if err := s.queue.Remove(item.ID); err != nil {
+		slog.Error("email sender cannot remove queued message", "build_number", item.BuildNumber, "error", err)
+	}
+}
+
+// retryDelay returns the exponential backoff for the given attempt, capped at
+// emailRetryMaxDelay, with jitter spread over the upper half of the interval.
+func retryDelay(attempt int) time.Duration {
+	d := emailRetryBaseDelay
+	for i := 1; i < attempt && d < emailRetryMaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, emailRetryMaxDelay)
+	return d/2 + rand.N(d/2+1) //nolint:gosec // jitter does not need a secure source
+}
+
+// ReloadTemplates reloads the templates from the template directory, if any.
+func (s *EmailSender) ReloadTemplates() {
+	s.templates.Reload()
+}
+
 func (s *EmailSender) Shutdown() {
 	if s.closed.Swap(true) {
 		return
 	}
 	slog.Info("email sender initiating shutdown")
+	close(s.done)
+	s.templates.Close()
 
 	done := make(chan struct{})
 	go func() {
@@ -161,7 +674,8 @@ func (s *EmailSender) Shutdown() {
 
 	select {
 	case <-done:
-		slog.Info("email sender completed shutdown")
+		s.transport.Close()
+		slog.Info("email sender completed shutdown", "pending", s.queue.Len())
 	case <-time.After(emailSenderShutdownTimeout):
 		slog.Error("email sender shutdown timed out")
 	}
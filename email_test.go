@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand/v2"
@@ -8,10 +9,13 @@ import (
 	"net/http"
 	"net/mail"
 	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/webhook"
+	"github.com/jordan-wright/email"
 	"github.com/moby/moby/api/types/network"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -64,6 +68,15 @@ func buildConfig(mailpit *MailpitClient, fns ...func(*Config)) Config {
 	return cfg
 }
 
+func newEmailSender(t *testing.T, cfg Config, queue *Queue) *EmailSender {
+	t.Helper()
+	threads, err := NewThreadTracker(queue.store)
+	require.NoError(t, err)
+	emailSender, err := NewEmailSender(cfg, queue, threads)
+	require.NoError(t, err)
+	return emailSender
+}
+
 func buildWebhookRequest(fns ...func(*webhook.Request)) *webhook.Request {
 	req := &webhook.Request{
 		Event:  webhook.EventBuild,
@@ -94,16 +107,35 @@ func buildWebhookRequest(fns ...func(*webhook.Request)) *webhook.Request {
 	return req
 }
 
+// fileAttachments returns the attachments of the message other than the inline
+// images.
+func fileAttachments(emailMsg *email.Email) []*email.Attachment {
+	var attachments []*email.Attachment
+	for _, a := range emailMsg.Attachments {
+		if !a.HTMLRelated {
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments
+}
+
+func buildNotification(req *webhook.Request) *Notification {
+	return &Notification{Kind: NotificationFailure, Request: req}
+}
+
 func TestEmailSender(t *testing.T) {
 	mailpit := setupMailpit(t)
 
 	t.Run("send async", func(t *testing.T) {
 		t.Parallel()
 		cfg := buildConfig(mailpit)
-		emailSender := NewEmailSender(cfg)
+		queue := newQueue(t)
+		emailSender := newEmailSender(t, cfg, queue)
 		req := buildWebhookRequest()
 
-		emailSender.SendAsync(req)
+		err := emailSender.SendAsync(t.Context(), buildNotification(req))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return queue.Len() == 0 }, 10*time.Second, 50*time.Millisecond)
 		emailSender.Shutdown()
 
 		msg := mailpit.FindByBuildNumber(req.Build.Number)
@@ -118,23 +150,71 @@ func TestEmailSender(t *testing.T) {
 	t.Run("send async with closed sender", func(t *testing.T) {
 		t.Parallel()
 		cfg := buildConfig(mailpit)
-		emailSender := NewEmailSender(cfg)
+		queue := newQueue(t)
+		emailSender := newEmailSender(t, cfg, queue)
 		req := buildWebhookRequest()
 
 		emailSender.Shutdown()
-		emailSender.SendAsync(req)
+		err := emailSender.SendAsync(t.Context(), buildNotification(req))
+		require.ErrorIs(t, err, errEmailSenderClosed)
 
 		msg := mailpit.FindByBuildNumber(req.Build.Number)
 		assert.Nil(t, msg)
+		assert.Equal(t, 0, queue.Len())
+	})
+
+	t.Run("send async resumes pending messages", func(t *testing.T) {
+		t.Parallel()
+		cfg := buildConfig(mailpit)
+		queue := newQueue(t)
+		req := buildWebhookRequest()
+		emailSender := newEmailSender(t, cfg, queue)
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+		require.NoError(t, err)
+		err = queue.Push(&QueueItem{BuildNumber: req.Build.Number, Email: emailMsg})
+		require.NoError(t, err)
+
+		emailSender = newEmailSender(t, cfg, queue)
+		require.Eventually(t, func() bool { return queue.Len() == 0 }, 10*time.Second, 50*time.Millisecond)
+		emailSender.Shutdown()
+
+		msg := mailpit.FindByBuildNumber(req.Build.Number)
+		assert.NotNil(t, msg)
+	})
+
+	t.Run("send async keeps failed messages queued", func(t *testing.T) {
+		t.Parallel()
+		cfg := buildConfig(mailpit, func(cfg *Config) {
+			cfg.EmailSMTPHost = "127.0.0.1"
+			cfg.EmailSMTPPort = 1
+			cfg.EmailMaxAttempts = 3
+		})
+		queue := newQueue(t)
+		emailSender := newEmailSender(t, cfg, queue)
+		req := buildWebhookRequest()
+
+		err := emailSender.SendAsync(t.Context(), buildNotification(req))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			items, err := queue.Pending()
+			return err == nil && len(items) == 1 && items[0].Attempts == 1
+		}, 10*time.Second, 50*time.Millisecond)
+		emailSender.Shutdown()
+
+		items, err := queue.Pending()
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.NotEmpty(t, items[0].LastError)
+		assert.True(t, items[0].NextAttemptAt.After(items[0].CreatedAt))
 	})
 
 	t.Run("send", func(t *testing.T) {
 		t.Parallel()
 		cfg := buildConfig(mailpit)
-		emailSender := NewEmailSender(cfg)
+		emailSender := newEmailSender(t, cfg, newQueue(t))
 		req := buildWebhookRequest()
 
-		err := emailSender.Send(req)
+		err := emailSender.Send(buildNotification(req))
 		require.NoError(t, err)
 
 		msg := mailpit.FindByBuildNumber(req.Build.Number)
@@ -144,12 +224,12 @@ func TestEmailSender(t *testing.T) {
 	t.Run("send with empty author name", func(t *testing.T) {
 		t.Parallel()
 		cfg := buildConfig(mailpit)
-		emailSender := NewEmailSender(cfg)
+		emailSender := newEmailSender(t, cfg, newQueue(t))
 		req := buildWebhookRequest(func(req *webhook.Request) {
 			req.Build.AuthorName = ""
 		})
 
-		err := emailSender.Send(req)
+		err := emailSender.Send(buildNotification(req))
 		require.NoError(t, err)
 
 		msg := mailpit.FindByBuildNumber(req.Build.Number)
@@ -167,10 +247,10 @@ func TestEmailSender(t *testing.T) {
 			cfg.EmailSMTPHost = "127.0.0.1"
 			cfg.EmailSMTPPort = uint16(l.Addr().(*net.TCPAddr).Port)
 		})
-		emailSender := NewEmailSender(cfg)
+		emailSender := newEmailSender(t, cfg, newQueue(t))
 		req := buildWebhookRequest()
 
-		err := emailSender.Send(req)
+		err := emailSender.Send(buildNotification(req))
 		require.Error(t, err)
 
 		msg := mailpit.FindByBuildNumber(req.Build.Number)
@@ -180,12 +260,596 @@ func TestEmailSender(t *testing.T) {
 	t.Run("shutdown", func(t *testing.T) {
 		t.Parallel()
 		cfg := buildConfig(mailpit)
-		emailSender := NewEmailSender(cfg)
+		emailSender := newEmailSender(t, cfg, newQueue(t))
 		assert.NotPanics(t, func() { emailSender.Shutdown() })
 		assert.NotPanics(t, func() { emailSender.Shutdown() })
 	})
 }
 
+func TestNewEmailSender(t *testing.T) {
+	t.Run("invalid headers", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{EmailHeaders: map[string]string{"To": "eve@example.com"}}
+
+		_, err := NewEmailSender(cfg, newQueue(t), nil)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("routing rules", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{EmailRulesFile: writeFile(t, "rules.yml", "rules:\n  - suppress: true\n")}
+
+		emailSender := newEmailSender(t, cfg, newQueue(t))
+		defer emailSender.Shutdown()
+
+		require.NotNil(t, emailSender.rules)
+		assert.Len(t, emailSender.rules.Rules, 1)
+	})
+
+	t.Run("invalid routing rules", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{EmailRulesFile: writeFile(t, "rules.yml", "mode: any\n")}
+
+		_, err := NewEmailSender(cfg, newQueue(t), nil)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{EmailDirectoryFile: writeFile(t, "directory.yml", testDirectory)}
+
+		emailSender := newEmailSender(t, cfg, newQueue(t))
+		defer emailSender.Shutdown()
+
+		require.NotNil(t, emailSender.directory)
+		assert.Len(t, emailSender.directory.Users, 2)
+	})
+
+	t.Run("invalid directory", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{EmailDirectoryFile: writeFile(t, "directory.yml", "fallback: nobody\n")}
+
+		_, err := NewEmailSender(cfg, newQueue(t), nil)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("templates", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "{{.Repository}}"})
+		cfg := Config{EmailTemplateDir: dir}
+
+		emailSender := newEmailSender(t, cfg, newQueue(t))
+		defer emailSender.Shutdown()
+
+		require.NotNil(t, emailSender.templates)
+		assert.NotNil(t, emailSender.templates.watcher)
+	})
+
+	t.Run("invalid templates", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "{{.Repo}}"})
+		cfg := Config{EmailTemplateDir: dir}
+
+		_, err := NewEmailSender(cfg, newQueue(t), nil)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("ldap", func(t *testing.T) {
+		t.Parallel()
+		cfg := buildLDAPConfig("ldap://localhost")
+
+		emailSender := newEmailSender(t, cfg, newQueue(t))
+		defer emailSender.Shutdown()
+
+		assert.NotNil(t, emailSender.ldap)
+	})
+
+	t.Run("invalid ldap filter", func(t *testing.T) {
+		t.Parallel()
+		cfg := buildLDAPConfig("ldap://localhost", func(cfg *Config) {
+			cfg.LDAPFilter = "mail={email}"
+		})
+
+		_, err := NewEmailSender(cfg, newQueue(t), nil)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestEmailSender_Render(t *testing.T) {
+	t.Run("failure", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "ci@example.com", cc: []string{"admin@example.com"}}
+		req := buildWebhookRequest()
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Equal(t, "ci@example.com", emailMsg.From)
+		assert.Equal(t, []string{"\"Test User\" <test@example.com>"}, emailMsg.To)
+		assert.Equal(t, []string{"admin@example.com"}, emailMsg.Cc)
+		assert.Equal(t, fmt.Sprintf("[test/repo] Failed build #%d for refs/heads/main (e92d9f39)", req.Build.Number), emailMsg.Subject)
+		assert.Contains(t, string(emailMsg.Text), fmt.Sprintf("Build #%d has failed", req.Build.Number))
+		assert.Contains(t, string(emailMsg.HTML), "#ef4444")
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "ci@example.com"}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Status = "success"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), &Notification{
+			Kind:          NotificationRecovery,
+			Request:       req,
+			FailedAuthors: []string{"Other User <other@example.com>", "Test User <TEST@example.com>"},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"\"Test User\" <test@example.com>", "\"Other User\" <other@example.com>"}, emailMsg.To)
+		assert.Equal(t, fmt.Sprintf("[test/repo] Fixed build #%d for refs/heads/main (e92d9f39)", req.Build.Number), emailMsg.Subject)
+		assert.Contains(t, string(emailMsg.Text), fmt.Sprintf("Build #%d is back to green", req.Build.Number))
+		assert.Contains(t, string(emailMsg.HTML), "#22c55e")
+	})
+
+	t.Run("routing rules", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{
+			from: "ci@example.com",
+			cc:   []string{"admin@example.com"},
+			rules: &RoutingRules{Mode: RulesFirstMatch, Rules: []RoutingRule{
+				{Match: RuleMatch{Repos: []string{"test/*"}}, Bcc: []string{"audit@example.com"}},
+			}},
+		}
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(buildWebhookRequest()))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"\"Test User\" <test@example.com>"}, emailMsg.To)
+		assert.Equal(t, []string{"admin@example.com"}, emailMsg.Cc)
+		assert.Equal(t, []string{"audit@example.com"}, emailMsg.Bcc)
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		t.Parallel()
+		directory, err := LoadDirectory(writeFile(t, "directory.yml", testDirectory))
+		require.NoError(t, err)
+		emailSender := &EmailSender{from: "ci@example.com", directory: directory}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Author = "alice"
+			req.Build.AuthorEmail = "alice@home.example.com"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), &Notification{
+			Kind:          NotificationRecovery,
+			Request:       req,
+			FailedAuthors: []string{"Bob <bob@old-corp.example.com>", "Eve <5678+eve@users.noreply.github.com>"},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"\"Alice Smith\" <alice@corp.example.com>",
+			"\"Bob\" <bob@corp.example.com>",
+			"ci-failures@corp.example.com",
+		}, emailMsg.To)
+	})
+
+	t.Run("trailers", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "ci@example.com", trailers: []string{"Co-authored-by", "Reviewed-by"}}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Message = "test commit\n\nCo-authored-by: Alice <alice@example.com>\nReviewed-by: bob@example.com\nCo-authored-by: Test User <test@example.com>\n"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"\"Test User\" <test@example.com>", "\"Alice\" <alice@example.com>", "bob@example.com"}, emailMsg.To)
+		assert.Contains(t, string(emailMsg.Text), "Commit Message: test commit\n")
+		assert.Contains(t, string(emailMsg.Text), "Co-authored-by: Alice\nReviewed-by: bob@example.com\n")
+		assert.Contains(t, string(emailMsg.HTML), ">Co-authored-by</td>")
+		assert.Contains(t, string(emailMsg.HTML), ">bob@example.com</td>")
+	})
+
+	t.Run("stages", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "ci@example.com"}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Stages = buildStages()
+		})
+		stepLink := fmt.Sprintf("https://drone.example.com/test/repo/%d/1/3", req.Build.Number)
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Contains(t, string(emailMsg.Text), "\nStage default: failure\n"+
+			"  - clone: success in 4s\n"+
+			"  - lint: failure in 6s\n"+
+			"  x test: failure (exit code 2) in 1m32s\n"+
+			"    "+stepLink+"\n"+
+			"  - publish: skipped\n\n"+
+			"Stage docs: running\n"+
+			"  - build: running\n\n"+
+			"View build:")
+		assert.Contains(t, string(emailMsg.HTML), `href="`+stepLink+`" style="color:#b91c1c;text-decoration:underline" target="_blank">test</a>`)
+		assert.Contains(t, string(emailMsg.HTML), "exit code 2</td>")
+		assert.Empty(t, fileAttachments(emailMsg))
+	})
+
+	t.Run("logs", func(t *testing.T) {
+		t.Parallel()
+		api := startDroneAPI(t, map[string][]string{
+			"42/1/3": {"+ go test ./...\n", "--- FAIL: TestFoo <nil>\n", "password=hunter2\n", "FAIL\n"},
+		})
+		emailSender := &EmailSender{
+			from:       "ci@example.com",
+			logs:       NewLogFetcher(Config{APIServer: api.URL, APIToken: testAPIToken, EmailLogLines: 3, EmailLogMaxBytes: 8192}),
+			attachLogs: true,
+		}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Repo.Namespace, req.Repo.Name = "test", "repo"
+			req.Build.Number = 42
+			req.Build.Stages = buildStages()
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Contains(t, string(emailMsg.Text), "    https://drone.example.com/test/repo/42/1/3\n\n"+
+			"--- FAIL: TestFoo <nil>\n"+
+			"password=********\n"+
+			"FAIL\n\n"+
+			"  - publish: skipped\n")
+		assert.Contains(t, string(emailMsg.HTML), ">--- FAIL: TestFoo &lt;nil&gt;\npassword=********\nFAIL</pre>")
+		attachments := fileAttachments(emailMsg)
+		require.Len(t, attachments, 1)
+		assert.Equal(t, "default-test.txt", attachments[0].Filename)
+		assert.Equal(t, "+ go test ./...\n--- FAIL: TestFoo <nil>\npassword=********\nFAIL\n", string(attachments[0].Content))
+	})
+
+	t.Run("logs unavailable", func(t *testing.T) {
+		t.Parallel()
+		api := startDroneAPI(t, nil)
+		emailSender := &EmailSender{
+			from:       "ci@example.com",
+			logs:       NewLogFetcher(Config{APIServer: api.URL, APIToken: testAPIToken, EmailLogLines: 3, EmailLogMaxBytes: 8192}),
+			attachLogs: true,
+		}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Repo.Namespace, req.Repo.Name = "test", "repo"
+			req.Build.Stages = buildStages()
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Contains(t, string(emailMsg.Text), fmt.Sprintf("    https://drone.example.com/test/repo/%d/1/3\n  - publish: skipped\n", req.Build.Number))
+		assert.NotContains(t, string(emailMsg.HTML), "<pre")
+		assert.Empty(t, fileAttachments(emailMsg))
+	})
+
+	t.Run("logs after request done", func(t *testing.T) {
+		t.Parallel()
+		api := startDroneAPI(t, map[string][]string{"42/1/3": {"FAIL\n"}})
+		emailSender := &EmailSender{
+			from:       "ci@example.com",
+			logs:       NewLogFetcher(Config{APIServer: api.URL, APIToken: testAPIToken, EmailLogLines: 3, EmailLogMaxBytes: 8192}),
+			attachLogs: true,
+		}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Repo.Namespace, req.Repo.Name = "test", "repo"
+			req.Build.Number = 42
+			req.Build.Stages = buildStages()
+		})
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		emailMsg, err := emailSender.render(ctx, buildNotification(req))
+
+		require.NoError(t, err)
+		assert.NotContains(t, string(emailMsg.HTML), "<pre")
+		assert.Empty(t, fileAttachments(emailMsg))
+	})
+
+	t.Run("inline images", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "ci@example.com"}
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(buildWebhookRequest()))
+
+		require.NoError(t, err)
+		assert.NotContains(t, string(emailMsg.HTML), "data:image")
+		assert.Contains(t, string(emailMsg.HTML), `src="https://example.com/avatar.png"`)
+		var names []string
+		for _, a := range emailMsg.Attachments {
+			assert.True(t, a.HTMLRelated)
+			assert.Equal(t, "image/png", a.ContentType)
+			assert.Contains(t, string(emailMsg.HTML), `src="cid:`+a.Filename+`"`)
+			names = append(names, a.Filename)
+		}
+		assert.ElementsMatch(t, []string{"drone-logo.png", "reference.png", "commit.png"}, names)
+
+		raw, err := emailMsg.Bytes()
+		require.NoError(t, err)
+		assert.Contains(t, string(raw), "Content-Type: multipart/related;")
+		assert.Contains(t, string(raw), "Content-Id: <drone-logo.png>")
+	})
+
+	t.Run("inline avatar", func(t *testing.T) {
+		t.Parallel()
+		avatar := startAvatarServer(t)
+		emailSender := &EmailSender{from: "ci@example.com", avatars: NewAvatarCache()}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.AuthorAvatar = avatar.URL + "/avatar"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Contains(t, string(emailMsg.HTML), `src="cid:avatar.png"`)
+		assert.NotContains(t, string(emailMsg.HTML), avatar.URL)
+		require.Len(t, emailMsg.Attachments, 4)
+		assert.Equal(t, "avatar.png", emailMsg.Attachments[3].Filename)
+		assert.Equal(t, testAvatarPNG, emailMsg.Attachments[3].Content)
+	})
+
+	t.Run("inline avatar unavailable", func(t *testing.T) {
+		t.Parallel()
+		avatar := startAvatarServer(t)
+		emailSender := &EmailSender{from: "ci@example.com", avatars: NewAvatarCache()}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.AuthorAvatar = avatar.URL + "/missing"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Contains(t, string(emailMsg.HTML), `src="`+avatar.URL+`/missing"`)
+		assert.Len(t, emailMsg.Attachments, 3)
+	})
+
+	t.Run("threading", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "Drone <ci@example.com>", threads: newThreadTracker(t)}
+		failure := buildWebhookRequest()
+		recovery := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Number = failure.Build.Number + 1
+			req.Build.Status = "success"
+		})
+
+		failureMsg, err := emailSender.render(t.Context(), buildNotification(failure))
+		require.NoError(t, err)
+		recoveryMsg, err := emailSender.render(t.Context(), &Notification{Kind: NotificationRecovery, Request: recovery})
+		require.NoError(t, err)
+
+		failureID := fmt.Sprintf("<%d.failure.test.repo@example.com>", failure.Build.Number)
+		assert.Equal(t, failureID, failureMsg.Headers.Get("Message-ID"))
+		assert.Empty(t, failureMsg.Headers.Get("In-Reply-To"))
+		assert.Empty(t, failureMsg.Headers.Get("References"))
+		assert.Equal(t, fmt.Sprintf("<%d.recovery.test.repo@example.com>", recovery.Build.Number), recoveryMsg.Headers.Get("Message-ID"))
+		assert.Equal(t, failureID, recoveryMsg.Headers.Get("In-Reply-To"))
+		assert.Equal(t, failureID, recoveryMsg.Headers.Get("References"))
+
+		raw, err := recoveryMsg.Bytes()
+		require.NoError(t, err)
+		assert.Contains(t, string(raw), "Message-Id: <"+strconv.FormatInt(recovery.Build.Number, 10)+".recovery.test.repo@example.com>\r\n")
+		assert.Contains(t, string(raw), "In-Reply-To: "+failureID+"\r\n")
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{from: "ci@example.com", headers: map[string]string{"X-Team": "platform", "Precedence": "list"}}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Event = "push"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), buildNotification(req))
+
+		require.NoError(t, err)
+		assert.Equal(t, "test/repo", emailMsg.Headers.Get("X-Drone-Repo"))
+		assert.Equal(t, strconv.FormatInt(req.Build.Number, 10), emailMsg.Headers.Get("X-Drone-Build-Number"))
+		assert.Equal(t, `"test/repo" <repo.test.example.com>`, emailMsg.Headers.Get("List-Id"))
+		assert.Equal(t, "auto-generated", emailMsg.Headers.Get("Auto-Submitted"))
+		assert.Equal(t, "platform", emailMsg.Headers.Get("X-Team"))
+		assert.Equal(t, "list", emailMsg.Headers.Get("Precedence"))
+		assert.Empty(t, emailMsg.Headers.Get("Message-Id"))
+	})
+
+	t.Run("template directory", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{
+			"subject.tmpl":           "{{.Repository}} #{{.BuildNumber}} {{.Status}} on {{.Event}}\n",
+			"body.txt.tmpl":          "{{.Header}} by {{.AuthorName}}",
+			"recovery/body.txt.tmpl": "{{.Header}}",
+		})
+		templates, err := LoadTemplates(dir)
+		require.NoError(t, err)
+		emailSender := &EmailSender{from: "ci@example.com", templates: templates}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Event = "push"
+		})
+
+		failure, err := emailSender.render(t.Context(), buildNotification(req))
+		require.NoError(t, err)
+		recovery, err := emailSender.render(t.Context(), &Notification{Kind: NotificationRecovery, Request: req})
+		require.NoError(t, err)
+
+		assert.Equal(t, fmt.Sprintf("test/repo #%d failure on push", req.Build.Number), failure.Subject)
+		assert.Equal(t, fmt.Sprintf("Build #%d has failed by Test User", req.Build.Number), string(failure.Text))
+		assert.Contains(t, string(failure.HTML), fmt.Sprintf("Build #%d has failed</h1>", req.Build.Number))
+		assert.Equal(t, fmt.Sprintf("Build #%d is back to green", req.Build.Number), string(recovery.Text))
+	})
+
+	t.Run("ldap", func(t *testing.T) {
+		t.Parallel()
+		directory, err := LoadDirectory(writeFile(t, "directory.yml", `
+users:
+  - email: bob@corp.example.com
+    aliases: [bob@home.example.com]
+`))
+		require.NoError(t, err)
+		ldapResolver, err := NewLDAPResolver(buildLDAPConfig(startLDAP(t, testLDAPEntries).url, func(cfg *Config) {
+			cfg.LDAPBaseDN = "dc=example,dc=com"
+			cfg.LDAPCCAttributes = []string{"manager", "memberOf"}
+		}))
+		require.NoError(t, err)
+		emailSender := &EmailSender{from: "ci@example.com", cc: []string{"admin@example.com"}, directory: directory, ldap: ldapResolver}
+		req := buildWebhookRequest(func(req *webhook.Request) {
+			req.Build.Author = "alice"
+			req.Build.AuthorEmail = "alice@home.example.com"
+		})
+
+		emailMsg, err := emailSender.render(t.Context(), &Notification{
+			Kind:          NotificationRecovery,
+			Request:       req,
+			FailedAuthors: []string{"Bob <bob@home.example.com>", "Eve <eve@example.com>"},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"\"Test User\" <alice@corp.example.com>",
+			"\"Bob\" <bob@corp.example.com>",
+			"\"Eve\" <eve@example.com>",
+		}, emailMsg.To)
+		assert.Equal(t, []string{"admin@example.com", "carol@corp.example.com", "backend@corp.example.com"}, emailMsg.Cc)
+	})
+
+	t.Run("no deliverable recipients", func(t *testing.T) {
+		t.Parallel()
+		directory, err := LoadDirectory(writeFile(t, "directory.yml", "undeliverable: [\"*@example.com\"]\n"))
+		require.NoError(t, err)
+		emailSender := &EmailSender{directory: directory}
+
+		_, err = emailSender.render(t.Context(), buildNotification(buildWebhookRequest()))
+
+		require.ErrorIs(t, err, errEmailSuppressed)
+	})
+
+	t.Run("suppressed by routing rules", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{
+			rules: &RoutingRules{Mode: RulesFirstMatch, Rules: []RoutingRule{
+				{Match: RuleMatch{Repos: []string{"test/*"}}, Suppress: true},
+			}},
+		}
+
+		_, err := emailSender.render(t.Context(), buildNotification(buildWebhookRequest()))
+
+		require.ErrorIs(t, err, errEmailSuppressed)
+		assert.NoError(t, emailSender.Send(buildNotification(buildWebhookRequest())))
+	})
+
+	t.Run("unknown kind", func(t *testing.T) {
+		t.Parallel()
+		emailSender := &EmailSender{}
+
+		_, err := emailSender.render(t.Context(), &Notification{Kind: "unknown", Request: buildWebhookRequest()})
+
+		assert.Error(t, err)
+	})
+}
+
+func TestEmailSender_Dispatch(t *testing.T) {
+	newSender := func(t *testing.T, overflow OverflowPolicy) *EmailSender {
+		t.Helper()
+		return &EmailSender{
+			overflow: overflow,
+			queue:    newQueue(t),
+			jobs:     make(chan *QueueItem, 1),
+			done:     make(chan struct{}),
+		}
+	}
+	push := func(t *testing.T, s *EmailSender, buildNumber int64) *QueueItem {
+		t.Helper()
+		item := &QueueItem{BuildNumber: buildNumber}
+		require.NoError(t, s.queue.Push(item))
+		return item
+	}
+
+	t.Run("buffer has space", func(t *testing.T) {
+		t.Parallel()
+		s := newSender(t, OverflowReject)
+		item := push(t, s, 1)
+
+		err := s.dispatch(t.Context(), item)
+
+		require.NoError(t, err)
+		assert.Equal(t, item, <-s.jobs)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+		s := newSender(t, OverflowReject)
+		require.NoError(t, s.dispatch(t.Context(), push(t, s, 1)))
+
+		err := s.dispatch(t.Context(), push(t, s, 2))
+
+		require.ErrorIs(t, err, errEmailQueueFull)
+		assert.Equal(t, 1, s.queue.Len())
+		assert.Equal(t, int64(1), (<-s.jobs).BuildNumber)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		t.Parallel()
+		s := newSender(t, OverflowDropOldest)
+		require.NoError(t, s.dispatch(t.Context(), push(t, s, 1)))
+
+		err := s.dispatch(t.Context(), push(t, s, 2))
+
+		require.NoError(t, err)
+		assert.Equal(t, 1, s.queue.Len())
+		assert.Equal(t, int64(2), (<-s.jobs).BuildNumber)
+	})
+
+	t.Run("block until space", func(t *testing.T) {
+		t.Parallel()
+		s := newSender(t, OverflowBlock)
+		require.NoError(t, s.dispatch(t.Context(), push(t, s, 1)))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			<-s.jobs
+		}()
+		err := s.dispatch(t.Context(), push(t, s, 2))
+
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), (<-s.jobs).BuildNumber)
+	})
+
+	t.Run("block until context is canceled", func(t *testing.T) {
+		t.Parallel()
+		s := newSender(t, OverflowBlock)
+		require.NoError(t, s.dispatch(t.Context(), push(t, s, 1)))
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+
+		err := s.dispatch(ctx, push(t, s, 2))
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, s.queue.Len())
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	t.Parallel()
+	assert.GreaterOrEqual(t, retryDelay(1), emailRetryBaseDelay/2)
+	assert.LessOrEqual(t, retryDelay(1), emailRetryBaseDelay)
+	assert.GreaterOrEqual(t, retryDelay(2), emailRetryBaseDelay)
+	assert.LessOrEqual(t, retryDelay(2), 2*emailRetryBaseDelay)
+	for attempt := 1; attempt <= 100; attempt++ {
+		assert.LessOrEqual(t, retryDelay(attempt), emailRetryMaxDelay)
+	}
+	assert.GreaterOrEqual(t, retryDelay(100), emailRetryMaxDelay/2)
+}
+
 type MailpitClient struct {
 	t         *testing.T
 	host      string
@@ -1,27 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 
-	"github.com/99designs/httpsignatures-go"
 	"github.com/drone/drone-go/plugin/webhook"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// webhookMaxBodyBytes bounds the size of webhook requests, which are read in
+// full to verify their digest.
+const webhookMaxBodyBytes = 10 << 20
+
 type AsyncEmailSender interface {
-	SendAsync(req *webhook.Request)
+	SendAsync(ctx context.Context, n *Notification) error
+	QueueStats() QueueStats
+	CheckDelivery(ctx context.Context) error
 }
 
 type Handler struct {
 	http.Handler
 }
 
-func NewHandler(cfg Config, emailSender AsyncEmailSender) *Handler {
+func NewHandler(cfg Config, tracker *StatusTracker, dedup Deduplicator, emailSender AsyncEmailSender) *Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", healthHandler)
-	mux.Handle("POST /", webhookHandler(cfg.Secret, emailSender))
+	mux.Handle("GET /ready", readyHandler(NewTransportChecker(emailSender.CheckDelivery), emailSender))
+	mux.Handle("GET /queue", queueHandler(emailSender))
+	mux.Handle("GET /metrics", metricsHandler(emailSender))
+	mux.Handle("POST /", otelhttp.NewHandler(webhookHandler(NewWebhookVerifier(cfg), tracker, dedup, emailSender), "webhook"))
 	return &Handler{Handler: withRecovery(mux)}
 }
 
@@ -29,28 +43,99 @@ func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	_, _ = fmt.Fprint(w, "OK")
 }
 
-func webhookHandler(secret string, emailSender AsyncEmailSender) http.Handler {
+func queueHandler(emailSender AsyncEmailSender) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(emailSender.QueueStats())
+	})
+}
+
+func webhookHandler(verifier *WebhookVerifier, tracker *StatusTracker, dedup Deduplicator, emailSender AsyncEmailSender) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		signature, err := httpsignatures.FromRequest(r)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBodyBytes))
 		if err != nil {
-			slog.Error("webhook handler received invalid or missing signature", "error", err)
-			httpError(w, http.StatusBadRequest, "Invalid or Missing Signature")
+			webhookDecodeFailures.Inc()
+			slog.ErrorContext(r.Context(), "webhook handler cannot read request body", "error", err)
+			httpError(w, http.StatusBadRequest, "Invalid Input")
 			return
 		}
-		if !signature.IsValid(secret, r) {
-			slog.Error("webhook handler received invalid signature")
-			httpError(w, http.StatusBadRequest, "Invalid Signature")
+		if err := verifier.Verify(r, body); err != nil {
+			webhookSignatureFailures.WithLabelValues(signatureFailureReason(err)).Inc()
+			switch {
+			case errors.Is(err, errMissingSignature):
+				slog.ErrorContext(r.Context(), "webhook handler received invalid or missing signature", "error", err)
+				httpError(w, http.StatusBadRequest, "Invalid or Missing Signature")
+			case errors.Is(err, errReplayedRequest):
+				slog.WarnContext(r.Context(), "webhook handler received replayed request")
+				httpError(w, http.StatusConflict, "Replayed Request")
+			case errors.Is(err, errStaleRequest):
+				slog.ErrorContext(r.Context(), "webhook handler received stale request", "error", err)
+				httpError(w, http.StatusBadRequest, "Stale Request")
+			default:
+				slog.ErrorContext(r.Context(), "webhook handler received invalid signature", "error", err)
+				httpError(w, http.StatusBadRequest, "Invalid Signature")
+			}
 			return
 		}
 		var req webhook.Request
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			slog.Error("webhook handler cannot unmarshal request body", "error", err)
+		if err := json.Unmarshal(body, &req); err != nil {
+			webhookDecodeFailures.Inc()
+			slog.ErrorContext(r.Context(), "webhook handler cannot unmarshal request body", "error", err)
 			httpError(w, http.StatusBadRequest, "Invalid Input")
 			return
 		}
-		if req.Event == webhook.EventBuild && req.Action == webhook.ActionUpdated && req.Build != nil && req.Build.Status == "failure" {
-			slog.Info("webhook handler processing build failure event", "build_id", req.Build.ID, "repo_slug", req.Repo.Slug)
-			emailSender.SendAsync(&req)
+		var status string
+		if req.Build != nil {
+			status = req.Build.Status
+		}
+		webhooksReceived.WithLabelValues(req.Event, req.Action, status).Inc()
+		if req.Event != webhook.EventBuild || req.Action != webhook.ActionUpdated || req.Build == nil || req.Repo == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ctx := withLogAttrs(r.Context(), "build_id", req.Build.ID, "repo_slug", req.Repo.Slug)
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(buildAttributes(&req)...)
+		n, err := tracker.Track(&req)
+		if err != nil {
+			span.RecordError(err)
+			slog.ErrorContext(ctx, "webhook handler cannot track build status", "error", err)
+			verifier.Forget(r, body)
+			httpError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if n != nil {
+			span.SetAttributes(attribute.String("notification.kind", string(n.Kind)))
+			key := dedupKey(req.Build)
+			if dedup != nil {
+				claimed, err := dedup.Claim(ctx, key)
+				if err != nil {
+					slog.ErrorContext(ctx, "webhook handler cannot check for duplicate notification, sending anyway", "error", err)
+				} else if !claimed {
+					slog.InfoContext(ctx, "webhook handler skipping duplicate build notification", "kind", n.Kind)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			slog.InfoContext(ctx, "webhook handler processing build notification", "kind", n.Kind)
+			if err := emailSender.SendAsync(ctx, n); err != nil {
+				span.RecordError(err)
+				if err := tracker.Rollback(n); err != nil {
+					slog.ErrorContext(ctx, "webhook handler cannot roll back build status", "error", err)
+				}
+				if dedup != nil {
+					if err := dedup.Release(ctx, key); err != nil {
+						slog.ErrorContext(ctx, "webhook handler cannot release duplicate notification key", "error", err)
+					}
+				}
+				verifier.Forget(r, body)
+				if errors.Is(err, errEmailQueueFull) {
+					httpError(w, http.StatusServiceUnavailable, "Service Unavailable")
+					return
+				}
+				httpError(w, http.StatusInternalServerError, "Internal Server Error")
+				return
+			}
 		}
 		w.WriteHeader(http.StatusNoContent)
 	})
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
-	"github.com/99designs/httpsignatures-go"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/webhook"
 	"github.com/stretchr/testify/assert"
@@ -22,6 +27,16 @@ var webhookRequest = &webhook.Request{
 	Repo:   &drone.Repo{Slug: "test/repo"},
 }
 
+// duplicateWebhookRequest is another updated event for the build of webhookRequest.
+var duplicateWebhookRequest = &webhook.Request{
+	Event:  webhook.EventBuild,
+	Action: webhook.ActionUpdated,
+	Build:  &drone.Build{Status: "failure", ID: 42, Updated: 1},
+	Repo:   &drone.Repo{Slug: "test/repo"},
+}
+
+var webhookConfig = Config{Secret: "test-secret", SignatureMaxSkew: 5 * time.Minute}
+
 type MockEmailSender struct {
 	mock.Mock
 }
@@ -30,8 +45,26 @@ func NewMockEmailSender() *MockEmailSender {
 	return &MockEmailSender{}
 }
 
-func (m *MockEmailSender) SendAsync(req *webhook.Request) {
-	m.Called(req)
+func (m *MockEmailSender) SendAsync(_ context.Context, n *Notification) error {
+	args := m.Called(n)
+	return args.Error(0)
+}
+
+func (m *MockEmailSender) QueueStats() QueueStats {
+	args := m.Called()
+	return args.Get(0).(QueueStats)
+}
+
+func (m *MockEmailSender) CheckDelivery(_ context.Context) error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func newStatusTracker(t *testing.T) *StatusTracker {
+	t.Helper()
+	tracker, err := NewStatusTracker(newStore(t))
+	require.NoError(t, err)
+	return tracker
 }
 
 func assertHTTPStatusCode(t *testing.T, handler http.HandlerFunc, method, url string, body any, statuscode int) {
@@ -39,7 +72,9 @@ func assertHTTPStatusCode(t *testing.T, handler http.HandlerFunc, method, url st
 	jsonBody, err := json.Marshal(body)
 	require.NoError(t, err)
 	req := httptest.NewRequest(method, url, bytes.NewReader(jsonBody))
-	err = httpsignatures.DefaultSha256Signer.SignRequest("test-key-id", "test-secret", req)
+	sum := sha256.Sum256(jsonBody)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	err = digestSigner.SignRequest("test-key-id", "test-secret", req)
 	require.NoError(t, err)
 	w := httptest.NewRecorder()
 	handler(w, req)
@@ -49,10 +84,10 @@ func assertHTTPStatusCode(t *testing.T, handler http.HandlerFunc, method, url st
 func TestNewHandler(t *testing.T) {
 	t.Parallel()
 	emailSender := NewMockEmailSender()
-	emailSender.On("SendAsync", mock.Anything).Return()
+	emailSender.On("SendAsync", mock.Anything).Return(nil)
 	defer emailSender.AssertExpectations(t)
 
-	handler := NewHandler(Config{Secret: "test-secret"}, emailSender).ServeHTTP
+	handler := NewHandler(Config{Secret: "test-secret"}, newStatusTracker(t), nil, emailSender).ServeHTTP
 
 	assert.HTTPSuccess(t, handler, http.MethodGet, "/health", nil)
 	assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusNoContent)
@@ -65,23 +100,164 @@ func TestHealthHandler(t *testing.T) {
 	assert.HTTPBodyContains(t, healthHandler, http.MethodGet, url, nil, "OK")
 }
 
+func TestQueueHandler(t *testing.T) {
+	t.Parallel()
+	emailSender := NewMockEmailSender()
+	emailSender.On("QueueStats").Return(QueueStats{Pending: 3, Buffered: 2, Capacity: 10, InFlight: 1, Workers: 4})
+	defer emailSender.AssertExpectations(t)
+
+	handler := queueHandler(emailSender).ServeHTTP
+
+	req := httptest.NewRequest(http.MethodGet, "/queue", http.NoBody)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"pending":3,"buffered":2,"capacity":10,"in_flight":1,"workers":4}`, w.Body.String())
+}
+
 func TestWebhookHandler(t *testing.T) {
 	t.Run("happy path", func(t *testing.T) {
 		t.Parallel()
 		emailSender := NewMockEmailSender()
-		emailSender.On("SendAsync", mock.Anything).Return()
+		emailSender.On("SendAsync", mock.Anything).Return(nil)
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusNoContent)
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.MatchedBy(func(n *Notification) bool { return n.Kind == NotificationFailure })).Return(nil).Once()
+		emailSender.On("SendAsync", mock.MatchedBy(func(n *Notification) bool { return n.Kind == NotificationRecovery })).Return(nil).Once()
 		defer emailSender.AssertExpectations(t)
 
-		handler := webhookHandler("test-secret", emailSender).ServeHTTP
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		failed := &webhook.Request{
+			Event:  webhook.EventBuild,
+			Action: webhook.ActionUpdated,
+			Build:  &drone.Build{Status: "failure", Number: 1, Ref: "refs/heads/main"},
+			Repo:   &drone.Repo{Slug: "test/repo"},
+		}
+		passed := &webhook.Request{
+			Event:  webhook.EventBuild,
+			Action: webhook.ActionUpdated,
+			Build:  &drone.Build{Status: "success", Number: 2, Ref: "refs/heads/main"},
+			Repo:   &drone.Repo{Slug: "test/repo"},
+		}
+		passedAgain := &webhook.Request{
+			Event:  webhook.EventBuild,
+			Action: webhook.ActionUpdated,
+			Build:  &drone.Build{Status: "success", Number: 3, Ref: "refs/heads/main"},
+			Repo:   &drone.Repo{Slug: "test/repo"},
+		}
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", failed, http.StatusNoContent)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", passed, http.StatusNoContent)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", passedAgain, http.StatusNoContent)
+	})
+
+	t.Run("recovery retried after queue full", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.MatchedBy(func(n *Notification) bool { return n.Kind == NotificationFailure })).Return(nil).Once()
+		emailSender.On("SendAsync", mock.MatchedBy(func(n *Notification) bool { return n.Kind == NotificationRecovery })).Return(errEmailQueueFull).Once()
+		emailSender.On("SendAsync", mock.MatchedBy(func(n *Notification) bool { return n.Kind == NotificationRecovery })).Return(nil).Once()
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		failed := &webhook.Request{
+			Event:  webhook.EventBuild,
+			Action: webhook.ActionUpdated,
+			Build:  &drone.Build{Status: "failure", Number: 1, Ref: "refs/heads/main"},
+			Repo:   &drone.Repo{Slug: "test/repo"},
+		}
+		passed := &webhook.Request{
+			Event:  webhook.EventBuild,
+			Action: webhook.ActionUpdated,
+			Build:  &drone.Build{Status: "success", Number: 2, Ref: "refs/heads/main"},
+			Repo:   &drone.Repo{Slug: "test/repo"},
+		}
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", failed, http.StatusNoContent)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", passed, http.StatusServiceUnavailable)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", passed, http.StatusNoContent)
+	})
+
+	t.Run("duplicate build", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(nil).Once()
+		defer emailSender.AssertExpectations(t)
+
+		dedup := NewMemoryDeduplicator(time.Hour, 10)
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), dedup, emailSender).ServeHTTP
 
 		assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusNoContent)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", duplicateWebhookRequest, http.StatusNoContent)
+	})
+
+	t.Run("duplicate build after queue full", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(errEmailQueueFull).Once()
+		emailSender.On("SendAsync", mock.Anything).Return(nil).Once()
+		defer emailSender.AssertExpectations(t)
+
+		dedup := NewMemoryDeduplicator(time.Hour, 10)
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), dedup, emailSender).ServeHTTP
+
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusServiceUnavailable)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", duplicateWebhookRequest, http.StatusNoContent)
+	})
+
+	t.Run("ignored event", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		running := &webhook.Request{
+			Event:  webhook.EventBuild,
+			Action: webhook.ActionUpdated,
+			Build:  &drone.Build{Status: "running"},
+			Repo:   &drone.Repo{Slug: "test/repo"},
+		}
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", running, http.StatusNoContent)
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", &webhook.Request{Event: webhook.EventRepo}, http.StatusNoContent)
+	})
+
+	t.Run("email sender error", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(errors.New("queue unavailable"))
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusInternalServerError)
+	})
+
+	t.Run("email queue full", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(errEmailQueueFull)
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusServiceUnavailable)
 	})
 
 	t.Run("missing signature", func(t *testing.T) {
 		t.Parallel()
 		emailSender := NewMockEmailSender()
 
-		handler := webhookHandler("test-secret", emailSender).ServeHTTP
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
 
 		jsonBody, err := json.Marshal(webhookRequest)
 		require.NoError(t, err)
@@ -95,13 +271,80 @@ func TestWebhookHandler(t *testing.T) {
 		t.Parallel()
 		emailSender := NewMockEmailSender()
 
-		handler := webhookHandler("test-secret", emailSender).ServeHTTP
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
 
 		jsonBody, err := json.Marshal(webhookRequest)
 		require.NoError(t, err)
-		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBody))
-		err = httpsignatures.DefaultSha256Signer.SignRequest("test-key-id", "invalid-secret", req)
+		req := signedRequest(t, digestSigner, "invalid-secret", time.Now(), string(jsonBody))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("previous secret", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(nil)
+		defer emailSender.AssertExpectations(t)
+
+		cfg := Config{Secret: "new-secret", PreviousSecrets: []string{"test-secret"}, SignatureMaxSkew: time.Minute}
+		handler := webhookHandler(NewWebhookVerifier(cfg), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		assertHTTPStatusCode(t, handler, http.MethodPost, "/", webhookRequest, http.StatusNoContent)
+	})
+
+	t.Run("replayed request", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(nil).Once()
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		jsonBody, err := json.Marshal(webhookRequest)
+		require.NoError(t, err)
+		req := signedRequest(t, digestSigner, "test-secret", time.Now(), string(jsonBody))
+		replay := req.Clone(req.Context())
+		replay.Body = io.NopCloser(bytes.NewReader(jsonBody))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = httptest.NewRecorder()
+		handler(w, replay)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("request retried after queue full", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+		emailSender.On("SendAsync", mock.Anything).Return(errEmailQueueFull).Once()
+		emailSender.On("SendAsync", mock.Anything).Return(nil).Once()
+		defer emailSender.AssertExpectations(t)
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		jsonBody, err := json.Marshal(webhookRequest)
+		require.NoError(t, err)
+		req := signedRequest(t, digestSigner, "test-secret", time.Now(), string(jsonBody))
+		retry := req.Clone(req.Context())
+		retry.Body = io.NopCloser(bytes.NewReader(jsonBody))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		w = httptest.NewRecorder()
+		handler(w, retry)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("stale request", func(t *testing.T) {
+		t.Parallel()
+		emailSender := NewMockEmailSender()
+
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+		jsonBody, err := json.Marshal(webhookRequest)
 		require.NoError(t, err)
+		req := signedRequest(t, digestSigner, "test-secret", time.Now().Add(-time.Hour), string(jsonBody))
 		w := httptest.NewRecorder()
 		handler(w, req)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -111,11 +354,9 @@ func TestWebhookHandler(t *testing.T) {
 		t.Parallel()
 		emailSender := NewMockEmailSender()
 
-		handler := webhookHandler("test-secret", emailSender).ServeHTTP
+		handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
 
-		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("invalid json")))
-		err := httpsignatures.DefaultSha256Signer.SignRequest("test-key-id", "test-secret", req)
-		require.NoError(t, err)
+		req := signedRequest(t, digestSigner, "test-secret", time.Now(), "invalid json")
 		w := httptest.NewRecorder()
 		handler(w, req)
 		assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/drone/drone-go/plugin/webhook"
+)
+
+var (
+	headerNameRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+	// reservedHeaders are set from the message itself and cannot be replaced by
+	// custom headers.
+	reservedHeaders = []string{
+		"Bcc", "Cc", "Content-Transfer-Encoding", "Content-Type", "Date", "From", "In-Reply-To", "Message-Id",
+		"Mime-Version", "References", "Reply-To", "Subject", "To",
+	}
+)
+
+// droneHeaders returns the headers that describe the build for mail filters,
+// along with the ones that keep autoresponders from replying.
+func droneHeaders(n *Notification, buildLink, domain string) textproto.MIMEHeader {
+	req := n.Request
+	namespace, name := repoName(req)
+	headers := textproto.MIMEHeader{}
+	headers.Set("X-Drone-Repo", req.Repo.Slug)
+	headers.Set("X-Drone-Namespace", namespace)
+	headers.Set("X-Drone-Ref", req.Build.Ref)
+	headers.Set("X-Drone-Event", req.Build.Event)
+	headers.Set("X-Drone-Status", req.Build.Status)
+	headers.Set("X-Drone-Build-Number", strconv.FormatInt(req.Build.Number, 10))
+	headers.Set("X-Drone-Build-Link", buildLink)
+	headers.Set("X-Drone-Notification", string(n.Kind))
+	headers.Set("List-Id", listIDPhrase(req.Repo.Slug)+" <"+listID(name, namespace, domain)+">")
+	headers.Set("Auto-Submitted", "auto-generated")
+	headers.Set("Precedence", "bulk")
+	for key, values := range headers {
+		if values[0] == "" {
+			delete(headers, key)
+		}
+	}
+	return headers
+}
+
+// validateHeaders checks that custom headers are well-formed and do not replace
+// the ones set from the message.
+func validateHeaders(headers map[string]string) error {
+	for key, value := range headers {
+		if !headerNameRegexp.MatchString(key) {
+			return fmt.Errorf("invalid header name %q", key)
+		}
+		if slices.Contains(reservedHeaders, textproto.CanonicalMIMEHeaderKey(key)) {
+			return fmt.Errorf("header %s cannot be overridden", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of header %s", key)
+		}
+	}
+	return nil
+}
+
+func repoName(req *webhook.Request) (string, string) {
+	if req.Repo.Namespace != "" || req.Repo.Name != "" {
+		return req.Repo.Namespace, req.Repo.Name
+	}
+	if namespace, name, ok := strings.Cut(req.Repo.Slug, "/"); ok {
+		return namespace, name
+	}
+	return "", req.Repo.Slug
+}
+
+// listIDPhrase returns the description of a List-Id header as an RFC 5322
+// quoted string, or as an RFC 2047 encoded word when it is not ASCII.
+func listIDPhrase(description string) string {
+	if encoded := mime.QEncoding.Encode("utf-8", description); encoded != description {
+		return encoded
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(description) + `"`
+}
+
+// listID returns an RFC 2919 list identifier of the repository, such as
+// hello-world.octocat.example.com.
+func listID(name, namespace, domain string) string {
+	var parts []string
+	for _, part := range []string{name, namespace} {
+		if part = strings.Trim(messageIDRegexp.ReplaceAllString(part, "."), "."); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(append(parts, domain), ".")
+}
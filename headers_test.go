@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDroneHeaders(t *testing.T) {
+	t.Run("headers", func(t *testing.T) {
+		t.Parallel()
+		n := &Notification{
+			Kind: NotificationFailure,
+			Request: &webhook.Request{
+				Repo:  &drone.Repo{Namespace: "octocat", Name: "hello-world", Slug: "octocat/hello-world"},
+				Build: &drone.Build{Number: 42, Event: "push", Status: "failure", Ref: "refs/heads/main"},
+			},
+		}
+
+		actual := droneHeaders(n, "https://drone.example.com/octocat/hello-world/42", "example.com")
+
+		assert.Equal(t, textproto.MIMEHeader{
+			"X-Drone-Repo":         {"octocat/hello-world"},
+			"X-Drone-Namespace":    {"octocat"},
+			"X-Drone-Ref":          {"refs/heads/main"},
+			"X-Drone-Event":        {"push"},
+			"X-Drone-Status":       {"failure"},
+			"X-Drone-Build-Number": {"42"},
+			"X-Drone-Build-Link":   {"https://drone.example.com/octocat/hello-world/42"},
+			"X-Drone-Notification": {"failure"},
+			"List-Id":              {`"octocat/hello-world" <hello-world.octocat.example.com>`},
+			"Auto-Submitted":       {"auto-generated"},
+			"Precedence":           {"bulk"},
+		}, actual)
+	})
+
+	t.Run("missing fields", func(t *testing.T) {
+		t.Parallel()
+		n := &Notification{
+			Kind: NotificationRecovery,
+			Request: &webhook.Request{
+				Repo:  &drone.Repo{Slug: "octocat/Hello_World.go"},
+				Build: &drone.Build{Number: 7, Status: "success"},
+			},
+		}
+
+		actual := droneHeaders(n, "https://drone.example.com/octocat/Hello_World.go/7", "example.com")
+
+		assert.Equal(t, "octocat", actual.Get("X-Drone-Namespace"))
+		assert.Equal(t, `"octocat/Hello_World.go" <Hello_World.go.octocat.example.com>`, actual.Get("List-Id"))
+		assert.NotContains(t, actual, "X-Drone-Ref")
+		assert.NotContains(t, actual, "X-Drone-Event")
+	})
+}
+
+func TestListIDPhrase(t *testing.T) {
+	for description, expected := range map[string]string{
+		"octocat/hello-world":     `"octocat/hello-world"`,
+		`octo"cat\hello`:          `"octo\"cat\\hello"`,
+		"octocat/héllo-wörld":     "=?utf-8?q?octocat/h=C3=A9llo-w=C3=B6rld?=",
+		"octocat/hello\r\nBcc: x": "=?utf-8?q?octocat/hello=0D=0ABcc:_x?=",
+	} {
+		assert.Equal(t, expected, listIDPhrase(description), description)
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	assert.NoError(t, validateHeaders(nil))
+	assert.NoError(t, validateHeaders(map[string]string{"X-Team": "platform", "Organization": "Example Inc."}))
+	assert.Error(t, validateHeaders(map[string]string{"X Team": "platform"}))
+	assert.Error(t, validateHeaders(map[string]string{"X-Team:": "platform"}))
+	assert.Error(t, validateHeaders(map[string]string{"X-Team": "platform\r\nBcc: eve@example.com"}))
+	assert.Error(t, validateHeaders(map[string]string{"bcc": "eve@example.com"}))
+	assert.Error(t, validateHeaders(map[string]string{"MESSAGE-ID": "<1@example.com>"}))
+}
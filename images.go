@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmlTemplate "html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+const (
+	avatarFetchTimeout = 10 * time.Second
+	avatarMaxBytes     = 1 << 20
+	avatarCacheTTL     = time.Hour
+	avatarCacheSize    = 1024
+)
+
+var (
+	//go:embed email-template/images/*.png
+	imagesFS embed.FS
+
+	inlineImages = mustLoadInlineImages()
+
+	avatarExtensions = map[string]string{
+		"image/gif":  ".gif",
+		"image/jpeg": ".jpg",
+		"image/png":  ".png",
+		"image/webp": ".webp",
+	}
+)
+
+// inlineImage is an image shipped as an inline attachment and referenced from
+// HTML templates as cid:<name>.
+type inlineImage struct {
+	name        string
+	contentType string
+	content     []byte
+}
+
+func mustLoadInlineImages() []inlineImage {
+	entries, err := imagesFS.ReadDir("email-template/images")
+	if err != nil {
+		panic(err)
+	}
+	images := make([]inlineImage, 0, len(entries))
+	for _, entry := range entries {
+		content, err := imagesFS.ReadFile(path.Join("email-template/images", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		images = append(images, inlineImage{name: entry.Name(), contentType: "image/png", content: content})
+	}
+	return images
+}
+
+// attachment returns the image as an inline attachment whose Content-ID is the
+// name of the image.
+func (i inlineImage) attachment() *email.Attachment {
+	return &email.Attachment{
+		Filename:    i.name,
+		ContentType: i.contentType,
+		Header:      textproto.MIMEHeader{},
+		Content:     i.content,
+		HTMLRelated: true,
+	}
+}
+
+// inlineAttachments returns the attachments of the images referenced by the
+// HTML body, so that custom templates only carry the images they use.
+func inlineAttachments(html []byte, images []inlineImage) []*email.Attachment {
+	var attachments []*email.Attachment
+	for _, image := range images {
+		if bytes.Contains(html, []byte("cid:"+image.name)) {
+			attachments = append(attachments, image.attachment())
+		}
+	}
+	return attachments
+}
+
+// cidURL returns the URL that refers to an inline attachment.
+func cidURL(name string) htmlTemplate.URL {
+	return htmlTemplate.URL("cid:" + name) //nolint:gosec // names of inline attachments are not user input
+}
+
+// avatarURL returns the avatar URL if it is an http or https URL, so that it can
+// be rendered without escaping in HTML templates.
+func avatarURL(raw string) htmlTemplate.URL {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return htmlTemplate.URL(raw) //nolint:gosec // only http and https URLs are allowed
+}
+
+// AvatarCache fetches author avatars so that they can be shipped as inline
+// attachments, and caches them in memory.
+type AvatarCache struct {
+	httpClient *http.Client
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]avatarCacheEntry
+}
+
+type avatarCacheEntry struct {
+	image     inlineImage
+	expiresAt time.Time
+}
+
+func NewAvatarCache() *AvatarCache {
+	return &AvatarCache{
+		httpClient: &http.Client{Timeout: avatarFetchTimeout},
+		ttl:        avatarCacheTTL,
+		now:        time.Now,
+		cache:      make(map[string]avatarCacheEntry),
+	}
+}
+
+// Get returns the avatar image at rawURL, fetching it unless it is cached. It
+// returns false when the avatar cannot be fetched before ctx is done or is not
+// a GIF, JPEG, PNG or WebP image.
+func (c *AvatarCache) Get(ctx context.Context, rawURL string) (inlineImage, bool) {
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.cache[rawURL]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.image, true
+	}
+
+	image, err := c.fetch(ctx, rawURL)
+	if err != nil {
+		slog.WarnContext(ctx, "avatar cache cannot fetch avatar", "url", rawURL, "error", err)
+		return inlineImage{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= avatarCacheSize {
+		for key, entry := range c.cache {
+			if !now.Before(entry.expiresAt) {
+				delete(c.cache, key)
+			}
+		}
+	}
+	if len(c.cache) >= avatarCacheSize {
+		for key := range c.cache {
+			delete(c.cache, key)
+			break
+		}
+	}
+	c.cache[rawURL] = avatarCacheEntry{image: image, expiresAt: now.Add(c.ttl)}
+	return image, true
+}
+
+func (c *AvatarCache) fetch(ctx context.Context, rawURL string) (inlineImage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, http.NoBody)
+	if err != nil {
+		return inlineImage{}, fmt.Errorf("avatar cache: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return inlineImage{}, fmt.Errorf("avatar cache: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return inlineImage{}, fmt.Errorf("avatar cache: %s: unexpected status %s", rawURL, resp.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	ext, ok := avatarExtensions[contentType]
+	if !ok {
+		return inlineImage{}, fmt.Errorf("avatar cache: %s: unexpected content type %q", rawURL, contentType)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, avatarMaxBytes+1))
+	if err != nil {
+		return inlineImage{}, fmt.Errorf("avatar cache: %s: %w", rawURL, err)
+	}
+	if len(content) > avatarMaxBytes {
+		return inlineImage{}, fmt.Errorf("avatar cache: %s: larger than %d bytes", rawURL, avatarMaxBytes)
+	}
+
+	return inlineImage{name: "avatar" + ext, contentType: contentType, content: content}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAvatarPNG = inlineImages[0].content
+
+// avatarServer serves testAvatarPNG at /avatar, along with malformed avatars,
+// and counts the requests it receives.
+type avatarServer struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+func startAvatarServer(t *testing.T) *avatarServer {
+	t.Helper()
+	s := &avatarServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /avatar", func(w http.ResponseWriter, _ *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(testAvatarPNG)
+	})
+	mux.HandleFunc("GET /html", func(w http.ResponseWriter, _ *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("GET /svg", func(w http.ResponseWriter, _ *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte("<svg/>"))
+	})
+	mux.HandleFunc("GET /large", func(w http.ResponseWriter, _ *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write(bytes.Repeat([]byte{0}, avatarMaxBytes+1))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestInlineImages(t *testing.T) {
+	names := make([]string, 0, len(inlineImages))
+	for _, image := range inlineImages {
+		assert.Equal(t, "image/png", image.contentType)
+		assert.NotEmpty(t, image.content)
+		names = append(names, image.name)
+	}
+	assert.ElementsMatch(t, []string{"commit.png", "drone-logo.png", "reference.png"}, names)
+
+	for _, templ := range defaultTemplates {
+		var html bytes.Buffer
+		require.NoError(t, templ.html.Execute(&html, &sampleEmailData))
+		assert.Len(t, inlineAttachments(html.Bytes(), inlineImages), len(inlineImages))
+	}
+}
+
+func TestInlineAttachments(t *testing.T) {
+	attachments := inlineAttachments([]byte(`<img src="cid:commit.png"/><img src="https://example.com/logo.png"/>`), inlineImages)
+
+	require.Len(t, attachments, 1)
+	assert.Equal(t, "commit.png", attachments[0].Filename)
+	assert.Equal(t, "image/png", attachments[0].ContentType)
+	assert.True(t, attachments[0].HTMLRelated)
+	assert.Empty(t, inlineAttachments([]byte("<p>no images</p>"), inlineImages))
+}
+
+func TestAvatarURL(t *testing.T) {
+	assert.Equal(t, "https://example.com/avatar.png?s=64", string(avatarURL("https://example.com/avatar.png?s=64")))
+	assert.Equal(t, "http://example.com/avatar.png", string(avatarURL("http://example.com/avatar.png")))
+	assert.Empty(t, avatarURL("javascript:alert(1)"))
+	assert.Empty(t, avatarURL("data:image/png;base64,AAAA"))
+	assert.Empty(t, avatarURL("/avatar.png"))
+	assert.Empty(t, avatarURL(""))
+}
+
+func TestAvatarCache_Get(t *testing.T) {
+	t.Run("fetch", func(t *testing.T) {
+		t.Parallel()
+		server := startAvatarServer(t)
+		cache := NewAvatarCache()
+
+		image, ok := cache.Get(t.Context(), server.URL+"/avatar")
+
+		require.True(t, ok)
+		assert.Equal(t, inlineImage{name: "avatar.png", contentType: "image/png", content: testAvatarPNG}, image)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		t.Parallel()
+		server := startAvatarServer(t)
+		now := time.Now()
+		cache := NewAvatarCache()
+		cache.now = func() time.Time { return now }
+
+		_, ok := cache.Get(t.Context(), server.URL+"/avatar")
+		require.True(t, ok)
+		_, ok = cache.Get(t.Context(), server.URL+"/avatar")
+		require.True(t, ok)
+		assert.Equal(t, int64(1), server.requests.Load())
+
+		now = now.Add(avatarCacheTTL)
+		_, ok = cache.Get(t.Context(), server.URL+"/avatar")
+		require.True(t, ok)
+		assert.Equal(t, int64(2), server.requests.Load())
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		t.Parallel()
+		server := startAvatarServer(t)
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		_, ok := NewAvatarCache().Get(ctx, server.URL+"/avatar")
+
+		assert.False(t, ok)
+		assert.Equal(t, int64(0), server.requests.Load())
+	})
+
+	server := startAvatarServer(t)
+	for name, rawURL := range map[string]string{
+		"not found":  server.URL + "/missing",
+		"not image":  server.URL + "/html",
+		"svg":        server.URL + "/svg",
+		"too large":  server.URL + "/large",
+		"no server":  "http://127.0.0.1:1/avatar",
+		"bad scheme": "ftp://example.com/avatar.png",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, ok := NewAvatarCache().Get(t.Context(), rawURL)
+
+			assert.False(t, ok)
+		})
+	}
+}
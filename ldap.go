@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	ldapTimeout = 10 * time.Second
+	// ldapRetryInterval is how long the directory is left alone after a failed
+	// lookup, so that a server that is down costs at most one lookup per interval
+	// instead of one per author of every rendered message.
+	ldapRetryInterval = 30 * time.Second
+	// ldapCacheSize bounds the number of authors whose lookup results are
+	// cached. Expired entries are pruned first once it is reached.
+	ldapCacheSize = 1024
+)
+
+var ldapFilterPlaceholders = []string{"{email}", "{login}", "{name}"}
+
+// LDAPEntry is the result of an LDAP lookup: the primary delivery address of
+// the author and the addresses of related entries, such as their manager or
+// team group, to be copied.
+type LDAPEntry struct {
+	Mail string
+	Cc   []string
+}
+
+// LDAPResolver looks up authors in an LDAP directory and caches the results,
+// including misses, for the configured TTL, up to ldapCacheSize authors. After
+// a lookup error, authors that are not cached are not looked up for
+// ldapRetryInterval.
+type LDAPResolver struct {
+	url           string
+	bindDN        string
+	bindPassword  string
+	baseDN        string
+	filter        string
+	mailAttribute string
+	ccAttributes  []string
+	ttl           time.Duration
+	now           func() time.Time
+
+	mu          sync.Mutex
+	cache       map[string]ldapCacheEntry
+	failedUntil time.Time
+}
+
+type ldapCacheEntry struct {
+	entry   *LDAPEntry
+	expires time.Time
+}
+
+func NewLDAPResolver(cfg Config) (*LDAPResolver, error) {
+	if _, err := ldap.CompileFilter(expandLDAPFilter(cfg.LDAPFilter, Author{Name: "x", Email: "x", Logins: []string{"x"}})); err != nil {
+		return nil, fmt.Errorf("ldap: invalid filter %q: %w", cfg.LDAPFilter, err)
+	}
+	if cfg.LDAPMailAttribute == "" {
+		return nil, errors.New("ldap: mail attribute is required")
+	}
+	return &LDAPResolver{
+		url:           cfg.LDAPURL,
+		bindDN:        cfg.LDAPBindDN,
+		bindPassword:  cfg.LDAPBindPassword,
+		baseDN:        cfg.LDAPBaseDN,
+		filter:        cfg.LDAPFilter,
+		mailAttribute: cfg.LDAPMailAttribute,
+		ccAttributes:  cfg.LDAPCCAttributes,
+		ttl:           cfg.LDAPCacheTTL,
+		now:           time.Now,
+
+		mu:    sync.Mutex{},
+		cache: make(map[string]ldapCacheEntry),
+	}, nil
+}
+
+// Resolve returns the LDAP entry of the author, or false when the author is not
+// found or the directory cannot be queried before ctx is done.
+func (r *LDAPResolver) Resolve(ctx context.Context, a Author) (LDAPEntry, bool) {
+	key := strings.ToLower(a.Email) + "\x00" + strings.ToLower(firstLogin(a)) + "\x00" + a.Name
+
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	failedUntil := r.failedUntil
+	r.mu.Unlock()
+	now := r.now()
+	if ok && now.Before(cached.expires) {
+		return entryOrZero(cached.entry)
+	}
+	if now.Before(failedUntil) {
+		return LDAPEntry{}, false
+	}
+
+	entry, err := r.lookup(ctx, a)
+	if err != nil {
+		slog.WarnContext(ctx, "ldap resolver failed to look up author", "author_email", a.Email, "error", err)
+		// A cancelled request says nothing about the health of the directory.
+		if !errors.Is(err, context.Canceled) {
+			r.mu.Lock()
+			r.failedUntil = r.now().Add(ldapRetryInterval)
+			r.mu.Unlock()
+		}
+		return LDAPEntry{}, false
+	}
+	if ctx.Err() != nil {
+		// The related entries may be incomplete, so the entry is not cached.
+		return entryOrZero(entry)
+	}
+
+	now = r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= ldapCacheSize {
+		for key, cached := range r.cache {
+			if !now.Before(cached.expires) {
+				delete(r.cache, key)
+			}
+		}
+	}
+	if len(r.cache) >= ldapCacheSize {
+		for key := range r.cache {
+			delete(r.cache, key)
+			break
+		}
+	}
+	r.cache[key] = ldapCacheEntry{entry: entry, expires: now.Add(r.ttl)}
+	return entryOrZero(entry)
+}
+
+// lookup queries the directory for the author. The connection is closed once
+// ctx is done, which aborts the pending request, and no request outlives the
+// deadline of ctx.
+func (r *LDAPResolver) lookup(ctx context.Context, a Author) (_ *LDAPEntry, err error) {
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("ldap: %w", context.Cause(ctx))
+	}
+	timeout := ldapTimeout
+	deadline, ok := ctx.Deadline()
+	if ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+
+	conn, err := ldap.DialURL(r.url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout, Deadline: deadline}))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: dial %s: %w", r.url, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("ldap: %w", context.Cause(ctx))
+		}
+	}()
+	conn.SetTimeout(timeout)
+
+	if r.bindDN != "" {
+		if err := conn.Bind(r.bindDN, r.bindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: bind as %s: %w", r.bindDN, err)
+		}
+	}
+
+	attributes := append([]string{r.mailAttribute}, r.ccAttributes...)
+	res, err := conn.Search(ldap.NewSearchRequest(
+		r.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		expandLDAPFilter(r.filter, a), attributes, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: search %s: %w", r.baseDN, err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, nil
+	}
+	found := res.Entries[0]
+	mail := found.GetAttributeValue(r.mailAttribute)
+	if mail == "" {
+		return nil, nil
+	}
+
+	entry := &LDAPEntry{Mail: formatAddress(a.Name, mail)}
+	for _, attribute := range r.ccAttributes {
+		for _, dn := range found.GetAttributeValues(attribute) {
+			if ctx.Err() != nil {
+				// The primary address is still worth returning without the
+				// related entries that are left.
+				return entry, nil
+			}
+			addr, err := r.mailOf(conn, dn)
+			if err != nil {
+				slog.Warn("ldap resolver failed to look up related entry", "dn", dn, "error", err)
+				continue
+			}
+			if addr != "" {
+				entry.Cc = appendAddress(entry.Cc, addr)
+			}
+		}
+	}
+	return entry, nil
+}
+
+// mailOf returns the mail attribute of the entry with the given DN.
+func (r *LDAPResolver) mailOf(conn *ldap.Conn, dn string) (string, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		"(objectClass=*)", []string{r.mailAttribute}, nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", nil
+		}
+		return "", fmt.Errorf("ldap: search %s: %w", dn, err)
+	}
+	if len(res.Entries) == 0 {
+		return "", nil
+	}
+	return res.Entries[0].GetAttributeValue(r.mailAttribute), nil
+}
+
+// expandLDAPFilter replaces the {email}, {login} and {name} placeholders in the
+// filter with the escaped author attributes.
+func expandLDAPFilter(filter string, a Author) string {
+	values := []string{a.Email, firstLogin(a), a.Name}
+	var oldnew []string
+	for i, placeholder := range ldapFilterPlaceholders {
+		oldnew = append(oldnew, placeholder, ldap.EscapeFilter(values[i]))
+	}
+	return strings.NewReplacer(oldnew...).Replace(filter)
+}
+
+func firstLogin(a Author) string {
+	for _, login := range a.Logins {
+		if login != "" {
+			return login
+		}
+	}
+	return ""
+}
+
+func entryOrZero(entry *LDAPEntry) (LDAPEntry, bool) {
+	if entry == nil {
+		return LDAPEntry{}, false
+	}
+	return *entry, true
+}
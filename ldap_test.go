@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/gldap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ldapAssertionRegexp = regexp.MustCompile(`\(([A-Za-z]+)=([^()]*)\)`)
+
+// fakeLDAP is a minimal LDAP server that evaluates filters as a disjunction of
+// their equality assertions, which is enough for the default resolver filter.
+type fakeLDAP struct {
+	url      string
+	entries  map[string]map[string][]string
+	searches atomic.Int64
+}
+
+func startLDAP(t *testing.T, entries map[string]map[string][]string) *fakeLDAP {
+	t.Helper()
+	l := &fakeLDAP{entries: entries}
+
+	srv, err := gldap.NewServer()
+	require.NoError(t, err)
+	mux, err := gldap.NewMux()
+	require.NoError(t, err)
+	require.NoError(t, mux.Bind(l.bind))
+	require.NoError(t, mux.Search(l.search))
+	require.NoError(t, srv.Router(mux))
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	go func() { _ = srv.Run(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))) }()
+	t.Cleanup(func() { _ = srv.Stop() })
+	require.Eventually(t, srv.Ready, 5*time.Second, 10*time.Millisecond)
+
+	l.url = fmt.Sprintf("ldap://127.0.0.1:%d", port)
+	return l
+}
+
+func (l *fakeLDAP) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	res := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer func() { _ = w.Write(res) }()
+	m, err := r.GetSimpleBindMessage()
+	if err == nil && m.UserName == "cn=drone,dc=example,dc=com" && m.Password == "secret" {
+		res.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func (l *fakeLDAP) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	l.searches.Add(1)
+	res := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer func() { _ = w.Write(res) }()
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		res.SetResultCode(gldap.ResultOperationsError)
+		return
+	}
+
+	if m.Scope == gldap.BaseObject {
+		attrs, ok := l.entries[m.BaseDN]
+		if !ok {
+			res.SetResultCode(gldap.ResultNoSuchObject)
+			return
+		}
+		_ = w.Write(r.NewSearchResponseEntry(m.BaseDN, gldap.WithAttributes(attrs)))
+		return
+	}
+
+	assertions := ldapAssertionRegexp.FindAllStringSubmatch(m.Filter, -1)
+	for dn, attrs := range l.entries {
+		if !strings.HasSuffix(dn, m.BaseDN) {
+			continue
+		}
+		for _, assertion := range assertions {
+			if slices.Contains(attrs[assertion[1]], assertion[2]) {
+				_ = w.Write(r.NewSearchResponseEntry(dn, gldap.WithAttributes(attrs)))
+				break
+			}
+		}
+	}
+}
+
+var testLDAPEntries = map[string]map[string][]string{
+	"uid=alice,ou=people,dc=example,dc=com": {
+		"uid":      {"alice"},
+		"cn":       {"Alice Smith"},
+		"mail":     {"alice@corp.example.com"},
+		"manager":  {"uid=carol,ou=people,dc=example,dc=com"},
+		"memberOf": {"cn=backend,ou=groups,dc=example,dc=com", "cn=missing,ou=groups,dc=example,dc=com"},
+	},
+	"uid=carol,ou=people,dc=example,dc=com": {
+		"uid":  {"carol"},
+		"cn":   {"Carol Jones"},
+		"mail": {"carol@corp.example.com"},
+	},
+	"uid=dave,ou=people,dc=example,dc=com": {
+		"uid": {"dave"},
+		"cn":  {"Dave Brown"},
+	},
+	"cn=backend,ou=groups,dc=example,dc=com": {
+		"cn":   {"backend"},
+		"mail": {"backend@corp.example.com"},
+	},
+}
+
+func buildLDAPConfig(url string, fns ...func(*Config)) Config {
+	cfg := Config{
+		LDAPURL:           url,
+		LDAPBindDN:        "cn=drone,dc=example,dc=com",
+		LDAPBindPassword:  "secret",
+		LDAPBaseDN:        "ou=people,dc=example,dc=com",
+		LDAPFilter:        "(|(mail={email})(uid={login})(cn={name}))",
+		LDAPMailAttribute: "mail",
+		LDAPCacheTTL:      time.Hour,
+	}
+	for _, fn := range fns {
+		fn(&cfg)
+	}
+	return cfg
+}
+
+func TestNewLDAPResolver(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewLDAPResolver(buildLDAPConfig("ldap://localhost"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewLDAPResolver(buildLDAPConfig("ldap://localhost", func(cfg *Config) {
+			cfg.LDAPFilter = "(mail={email}"
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("missing mail attribute", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewLDAPResolver(buildLDAPConfig("ldap://localhost", func(cfg *Config) {
+			cfg.LDAPMailAttribute = ""
+		}))
+		assert.Error(t, err)
+	})
+}
+
+func TestLDAPResolver_Resolve(t *testing.T) {
+	server := startLDAP(t, testLDAPEntries)
+
+	t.Run("by email", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+
+		entry, ok := r.Resolve(t.Context(), Author{Name: "Carol", Email: "carol@corp.example.com"})
+
+		require.True(t, ok)
+		assert.Equal(t, LDAPEntry{Mail: "\"Carol\" <carol@corp.example.com>"}, entry)
+	})
+
+	t.Run("by login", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+
+		entry, ok := r.Resolve(t.Context(), Author{Name: "Alice", Email: "alice@home.example.com", Logins: []string{"alice", "bob"}})
+
+		require.True(t, ok)
+		assert.Equal(t, "\"Alice\" <alice@corp.example.com>", entry.Mail)
+		assert.Empty(t, entry.Cc)
+	})
+
+	t.Run("by name", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+
+		entry, ok := r.Resolve(t.Context(), Author{Name: "Alice Smith", Email: "alice@home.example.com"})
+
+		require.True(t, ok)
+		assert.Equal(t, "\"Alice Smith\" <alice@corp.example.com>", entry.Mail)
+	})
+
+	t.Run("manager and groups", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url, func(cfg *Config) {
+			cfg.LDAPBaseDN = "dc=example,dc=com"
+			cfg.LDAPCCAttributes = []string{"manager", "memberOf"}
+		}))
+		require.NoError(t, err)
+
+		entry, ok := r.Resolve(t.Context(), Author{Name: "Alice", Email: "alice@corp.example.com"})
+
+		require.True(t, ok)
+		assert.Equal(t, LDAPEntry{
+			Mail: "\"Alice\" <alice@corp.example.com>",
+			Cc:   []string{"carol@corp.example.com", "backend@corp.example.com"},
+		}, entry)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+
+		_, ok := r.Resolve(t.Context(), Author{Name: "Eve", Email: "eve@example.com", Logins: []string{"eve"}})
+
+		assert.False(t, ok)
+	})
+
+	t.Run("no mail attribute", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+
+		_, ok := r.Resolve(t.Context(), Author{Name: "Dave", Email: "dave@example.com", Logins: []string{"dave"}})
+
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url, func(cfg *Config) {
+			cfg.LDAPBindPassword = "wrong"
+		}))
+		require.NoError(t, err)
+
+		_, ok := r.Resolve(t.Context(), Author{Name: "Carol", Email: "carol@corp.example.com"})
+
+		assert.False(t, ok)
+	})
+
+	t.Run("unreachable server", func(t *testing.T) {
+		t.Parallel()
+		r, err := NewLDAPResolver(buildLDAPConfig("ldap://127.0.0.1:1"))
+		require.NoError(t, err)
+
+		_, ok := r.Resolve(t.Context(), Author{Name: "Carol", Email: "carol@corp.example.com"})
+
+		assert.False(t, ok)
+	})
+}
+
+func TestLDAPResolver_Cache(t *testing.T) {
+	server := startLDAP(t, testLDAPEntries)
+	r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	carol := Author{Name: "Carol", Email: "carol@corp.example.com"}
+	eve := Author{Name: "Eve", Email: "eve@example.com"}
+
+	_, ok := r.Resolve(t.Context(), carol)
+	require.True(t, ok)
+	_, ok = r.Resolve(t.Context(), eve)
+	require.False(t, ok)
+	assert.Equal(t, int64(2), server.searches.Load())
+
+	_, ok = r.Resolve(t.Context(), carol)
+	require.True(t, ok)
+	_, ok = r.Resolve(t.Context(), eve)
+	require.False(t, ok)
+	assert.Equal(t, int64(2), server.searches.Load(), "hits and misses are cached")
+
+	now = now.Add(time.Hour)
+	_, ok = r.Resolve(t.Context(), carol)
+	require.True(t, ok)
+	assert.Equal(t, int64(3), server.searches.Load(), "expired entries are looked up again")
+}
+
+func TestLDAPResolver_Failure(t *testing.T) {
+	t.Run("retry interval", func(t *testing.T) {
+		t.Parallel()
+		server := startLDAP(t, testLDAPEntries)
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+		now := time.Now()
+		r.now = func() time.Time { return now }
+		r.url = "ldap://127.0.0.1:1"
+
+		_, ok := r.Resolve(t.Context(), Author{Name: "Carol", Email: "carol@corp.example.com"})
+		require.False(t, ok)
+
+		r.url = server.url
+		_, ok = r.Resolve(t.Context(), Author{Name: "Alice", Email: "alice@corp.example.com"})
+		assert.False(t, ok)
+		assert.Equal(t, int64(0), server.searches.Load(), "the directory is not queried after a failure")
+
+		now = now.Add(ldapRetryInterval)
+		_, ok = r.Resolve(t.Context(), Author{Name: "Alice", Email: "alice@corp.example.com"})
+		assert.True(t, ok)
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		t.Parallel()
+		server := startLDAP(t, testLDAPEntries)
+		r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		_, ok := r.Resolve(ctx, Author{Name: "Carol", Email: "carol@corp.example.com"})
+		require.False(t, ok)
+		assert.Equal(t, int64(0), server.searches.Load())
+
+		_, ok = r.Resolve(t.Context(), Author{Name: "Carol", Email: "carol@corp.example.com"})
+		assert.True(t, ok, "a cancelled lookup is not a failure of the directory")
+	})
+
+	t.Run("expired context", func(t *testing.T) {
+		t.Parallel()
+		var lc net.ListenConfig
+		listener, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = listener.Close() })
+		// The server accepts connections but never responds.
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+		r, err := NewLDAPResolver(buildLDAPConfig("ldap://" + listener.Addr().String()))
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, ok := r.Resolve(ctx, Author{Name: "Carol", Email: "carol@corp.example.com"})
+
+		assert.False(t, ok)
+		assert.Less(t, time.Since(start), ldapTimeout)
+	})
+}
+
+func TestLDAPResolver_CacheSize(t *testing.T) {
+	server := startLDAP(t, testLDAPEntries)
+	r, err := NewLDAPResolver(buildLDAPConfig(server.url))
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := range ldapCacheSize {
+		r.cache[strconv.Itoa(i)] = ldapCacheEntry{expires: now}
+	}
+	_, ok := r.Resolve(t.Context(), Author{Name: "Carol", Email: "carol@corp.example.com"})
+	require.True(t, ok)
+	assert.Len(t, r.cache, 1, "expired entries are pruned")
+
+	for i := range ldapCacheSize - 1 {
+		r.cache[strconv.Itoa(i)] = ldapCacheEntry{expires: now.Add(time.Hour)}
+	}
+	_, ok = r.Resolve(t.Context(), Author{Name: "Eve", Email: "eve@example.com"})
+	require.False(t, ok)
+	assert.Len(t, r.cache, ldapCacheSize)
+}
+
+func TestExpandLDAPFilter(t *testing.T) {
+	actual := expandLDAPFilter("(|(mail={email})(uid={login})(cn={name}))", Author{
+		Name:   "Evil (*)",
+		Email:  "evil@example.com",
+		Logins: []string{"", "evil"},
+	})
+
+	assert.Equal(t, `(|(mail=evil@example.com)(uid=evil)(cn=Evil \28\2a\29))`, actual)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+)
+
+const (
+	droneAPITimeout       = 10 * time.Second
+	logAttachmentMaxBytes = 1 << 20
+	logMask               = "********"
+)
+
+var (
+	logFilenameRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	ansiRegexp        = regexp.MustCompile(`\x1b(?:\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\))`)
+
+	// secretRegexps match common credential formats. Drone already masks the
+	// values of repository secrets, these catch the ones printed otherwise.
+	// The first and second groups, if any, are kept around the mask.
+	secretRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)(\bauthorization:\s*(?:bearer|basic|token)\s+)\S+`),
+		regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|access[_-]?key)\w*["']?\s*[=:]\s*["']?)[^\s"']+`),
+		regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+(@)`),
+		regexp.MustCompile(`\b()(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+		regexp.MustCompile(`\b()(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`),
+		regexp.MustCompile(`\b()xox[abprs]-[A-Za-z0-9-]{10,}`),
+		regexp.MustCompile(`()(?s:-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(?:-----END [A-Z ]*PRIVATE KEY-----|$))`),
+	}
+)
+
+// LogFetcher fetches the logs of build steps from the Drone API and prepares
+// them for emails.
+type LogFetcher struct {
+	server    string
+	token     string
+	transport http.RoundTripper
+	lines     int
+	maxBytes  int
+}
+
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req) //nolint:wrapcheck // transport errors are wrapped by the HTTP client
+}
+
+// contextTransport binds requests to a context, since the Drone client does
+// not take one.
+type contextTransport struct {
+	ctx  context.Context //nolint:containedctx // the Drone client does not take a context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx)) //nolint:wrapcheck // transport errors are wrapped by the HTTP client
+}
+
+func NewLogFetcher(cfg Config) *LogFetcher {
+	return &LogFetcher{
+		server:    strings.TrimSuffix(cfg.APIServer, "/"),
+		token:     cfg.APIToken,
+		transport: &tokenTransport{token: cfg.APIToken, base: http.DefaultTransport},
+		lines:     max(int(cfg.EmailLogLines), 1),
+		maxBytes:  max(int(cfg.EmailLogMaxBytes), 1),
+	}
+}
+
+// Fetch returns the log of a step, with ANSI escape sequences removed and
+// likely secrets masked. The Drone server of the request is used unless an API
+// server is configured.
+func (f *LogFetcher) Fetch(ctx context.Context, req *webhook.Request, stage *drone.Stage, step *drone.Step) (string, error) {
+	server := f.server
+	if server == "" {
+		server = req.System.Link
+	}
+	ctx, cancel := context.WithTimeout(ctx, droneAPITimeout)
+	defer cancel()
+	client := drone.NewClient(server, &http.Client{Transport: &contextTransport{ctx: ctx, base: f.transport}})
+	lines, err := client.Logs(req.Repo.Namespace, req.Repo.Name, int(req.Build.Number), stage.Number, step.Number)
+	if err != nil {
+		return "", fmt.Errorf("log fetcher: %s/%d/%d/%d: %w", req.Repo.Slug, req.Build.Number, stage.Number, step.Number, err)
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line.Message)
+	}
+	return f.clean(b.String()), nil
+}
+
+func (f *LogFetcher) clean(log string) string {
+	log = ansiRegexp.ReplaceAllString(log, "")
+	log = strings.ReplaceAll(log, "\r\n", "\n")
+	for _, re := range secretRegexps {
+		log = re.ReplaceAllString(log, "${1}"+logMask+"${2}")
+	}
+	if f.token != "" {
+		log = strings.ReplaceAll(log, f.token, logMask)
+	}
+	return log
+}
+
+// Tail returns the last lines of the log that fit into the configured limits.
+func (f *LogFetcher) Tail(log string) string {
+	lines := strings.Split(strings.TrimRight(log, "\n"), "\n")
+	if len(lines) > f.lines {
+		lines = lines[len(lines)-f.lines:]
+	}
+	return tailBytes(strings.Join(lines, "\n"), f.maxBytes)
+}
+
+func logFilename(stage, step string) string {
+	return logFilenameRegexp.ReplaceAllString(stage+"-"+step, "_") + ".txt"
+}
+
+// tailBytes returns the last n bytes of s, starting at a line boundary when
+// possible, and at a rune boundary otherwise.
+func tailBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 && i < len(s)-1 {
+		return s[i+1:]
+	}
+	return strings.ToValidUTF8(s, "")
+}
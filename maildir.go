@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// MaildirTransport writes messages as .eml files into the new directory of a
+// Maildir, where mail clients pick them up, instead of sending them. It is
+// meant for development and for inspecting the rendered messages.
+type MaildirTransport struct {
+	dir      string
+	hostname string
+	dkim     *DKIMSigner
+	now      func() time.Time
+	seq      atomic.Uint64
+}
+
+// NewMaildirTransport creates the tmp, new and cur directories of the Maildir
+// in DRONE_EMAIL_MAILDIR, or else in the maildir directory of DRONE_DATA_DIR.
+func NewMaildirTransport(cfg Config) (*MaildirTransport, error) {
+	signer, err := NewDKIMSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("maildir: %w", err)
+	}
+	dir := cmp.Or(cfg.EmailMaildir, filepath.Join(cfg.DataDir, "maildir"))
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+			return nil, fmt.Errorf("maildir: %w", err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// The separators of the file names must not appear in the host name.
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &MaildirTransport{dir: dir, hostname: hostname, dkim: signer, now: time.Now}, nil
+}
+
+// Send writes the message into the Maildir. The envelope sender and
+// recipients, including the Bcc ones that the message has no header for, are
+// recorded in the Return-Path and X-Envelope-To headers as a local delivery
+// agent would.
+func (t *MaildirTransport) Send(_ context.Context, emailMsg *email.Email) error {
+	from, to, err := envelope(emailMsg)
+	if err != nil {
+		return fmt.Errorf("maildir: %w", err)
+	}
+	msg, err := messageBytes(emailMsg, t.dkim)
+	if err != nil {
+		return fmt.Errorf("maildir: %w", err)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\nX-Envelope-To: %s\r\n", from, strings.Join(to, ", "))
+	buf.Write(msg)
+
+	// Files are written into tmp and moved into new once complete, so that
+	// readers never see a partial message.
+	name := t.uniqueName()
+	tmp := filepath.Join(t.dir, "tmp", name)
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("maildir: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(t.dir, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("maildir: %w", err)
+	}
+	return nil
+}
+
+// Check verifies that files can be created in the Maildir.
+func (t *MaildirTransport) Check(context.Context) error {
+	f, err := os.CreateTemp(filepath.Join(t.dir, "tmp"), ".check-*")
+	if err != nil {
+		return fmt.Errorf("maildir: %w", err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("maildir: %w", err)
+	}
+	return nil
+}
+
+func (t *MaildirTransport) Close() {}
+
+// uniqueName returns a file name that is unique across the deliveries of all
+// processes and hosts, in the time.MusecPpidQseq.host form of the Maildir
+// specification.
+func (t *MaildirTransport) uniqueName() string {
+	now := t.now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s.eml", now.Unix(), now.Nanosecond()/1000, os.Getpid(), t.seq.Add(1), t.hostname)
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err //nolint:wrapcheck // wrapped by the caller
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err //nolint:wrapcheck // wrapped by the caller
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err //nolint:wrapcheck // wrapped by the caller
+	}
+	return f.Close() //nolint:wrapcheck // wrapped by the caller
+}
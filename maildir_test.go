@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaildirTransport_Send(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		dir := filepath.Join(t.TempDir(), "maildir")
+		transport, err := NewMaildirTransport(Config{EmailMaildir: dir})
+		require.NoError(t, err)
+		transport.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC) }
+
+		require.NoError(t, transport.Send(t.Context(), testAPIEmail()))
+		require.NoError(t, transport.Send(t.Context(), testEmail()))
+
+		entries, err := os.ReadDir(filepath.Join(dir, "new"))
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Regexp(t, `^1714564800\.M123456P\d+Q1\.[^/:]+\.eml$`, entries[0].Name())
+		assert.Regexp(t, `^1714564800\.M123456P\d+Q2\.[^/:]+\.eml$`, entries[1].Name())
+		data, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(data), "Return-Path: <ci@example.com>\r\nX-Envelope-To: alice@example.com, team@example.com, audit@example.com\r\n"))
+		assert.Contains(t, string(data), "Subject: Build #1 failed\r\n")
+		assert.NotContains(t, string(data), "Bcc:")
+		tmp, err := os.ReadDir(filepath.Join(dir, "tmp"))
+		require.NoError(t, err)
+		assert.Empty(t, tmp)
+	})
+
+	t.Run("data dir", func(t *testing.T) {
+		t.Parallel()
+		dataDir := t.TempDir()
+		transport, err := NewMaildirTransport(Config{DataDir: dataDir})
+		require.NoError(t, err)
+
+		require.NoError(t, transport.Send(t.Context(), testEmail()))
+
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			assert.DirExists(t, filepath.Join(dataDir, "maildir", sub))
+		}
+	})
+
+	t.Run("invalid recipient", func(t *testing.T) {
+		t.Parallel()
+		transport, err := NewMaildirTransport(Config{EmailMaildir: t.TempDir()})
+		require.NoError(t, err)
+		emailMsg := testEmail()
+		emailMsg.To = []string{"not an address"}
+
+		assert.ErrorContains(t, transport.Send(t.Context(), emailMsg), "maildir: invalid recipient")
+	})
+
+	t.Run("removed directory", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		transport, err := NewMaildirTransport(Config{EmailMaildir: dir})
+		require.NoError(t, err)
+		require.NoError(t, os.RemoveAll(filepath.Join(dir, "tmp")))
+
+		err = transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "maildir: ")
+		assert.Equal(t, "file", deliveryFailureReason(err))
+		assert.Error(t, transport.Check(t.Context()))
+	})
+}
+
+func TestMaildirTransport_Check(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	transport, err := NewMaildirTransport(Config{EmailMaildir: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, transport.Check(t.Context()))
+
+	tmp, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+}
+
+func TestNewMaildirTransport(t *testing.T) {
+	t.Parallel()
+	_, err := NewMaildirTransport(Config{EmailMaildir: writeFile(t, "maildir", "")})
+	assert.ErrorContains(t, err, "maildir: ")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/jordan-wright/email"
+)
+
+// mailgunURL is the API of the US region; the EU region is at
+// https://api.eu.mailgun.net.
+const mailgunURL = "https://api.mailgun.net"
+
+// MailgunTransport delivers messages with the MIME endpoint of the Mailgun
+// Messages API, so that the message is sent exactly as it was rendered.
+type MailgunTransport struct {
+	api    *apiClient
+	apiKey string
+	domain string
+	dkim   *DKIMSigner
+}
+
+func NewMailgunTransport(cfg Config) (*MailgunTransport, error) {
+	if cfg.EmailAPIKey == "" || cfg.EmailMailgunDomain == "" {
+		return nil, errors.New("mailgun api: missing api key or domain")
+	}
+	api, err := newAPIClient("mailgun", cmp.Or(cfg.EmailAPIURL, mailgunURL))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := NewDKIMSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &MailgunTransport{api: api, apiKey: cfg.EmailAPIKey, domain: cfg.EmailMailgunDomain, dkim: signer}, nil
+}
+
+// Send delivers the message to its To, Cc and Bcc recipients.
+func (t *MailgunTransport) Send(ctx context.Context, emailMsg *email.Email) error {
+	_, to, err := envelope(emailMsg)
+	if err != nil {
+		return fmt.Errorf("mailgun api: %w", err)
+	}
+	msg, err := messageBytes(emailMsg, t.dkim)
+	if err != nil {
+		return fmt.Errorf("mailgun api: %w", err)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, addr := range to {
+		if err := w.WriteField("to", addr); err != nil {
+			return fmt.Errorf("mailgun api: %w", err)
+		}
+	}
+	part, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return fmt.Errorf("mailgun api: %w", err)
+	}
+	if _, err := part.Write(msg); err != nil {
+		return fmt.Errorf("mailgun api: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mailgun api: %w", err)
+	}
+
+	req, err := t.api.newRequest(ctx, http.MethodPost, "/v3/"+url.PathEscape(t.domain)+"/messages.mime", body.Bytes())
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", t.apiKey)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	_, err = t.api.do(req, mailgunError)
+	return err
+}
+
+// Check verifies that the API key has access to the sending domain and that
+// the domain is active.
+func (t *MailgunTransport) Check(ctx context.Context) error {
+	req, err := t.api.newRequest(ctx, http.MethodGet, "/v3/domains/"+url.PathEscape(t.domain), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", t.apiKey)
+	body, err := t.api.do(req, mailgunError)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Domain struct {
+			State string `json:"state"`
+		} `json:"domain"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("mailgun api: %w", err)
+	}
+	if resp.Domain.State != "active" {
+		return fmt.Errorf("mailgun api: domain %s is %s", t.domain, cmp.Or(resp.Domain.State, "not active"))
+	}
+	return nil
+}
+
+func (t *MailgunTransport) Close() {}
+
+// mailgunError classifies the bad requests, such as invalid recipients, and
+// messages that are too large as permanent.
+func mailgunError(resp *http.Response, body []byte) *apiError {
+	apiErr := &apiError{permanent: resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge}
+	var errResp struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &errResp) == nil {
+		apiErr.message = errResp.Message
+	}
+	return apiErr
+}
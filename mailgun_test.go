@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mailgunRequest is a message received by the Mailgun API stand-in.
+type mailgunRequest struct {
+	To      []string
+	Message *mail.Message
+}
+
+// startMailgunAPI starts a stand-in of the Mailgun Messages API for the
+// domain mg.example.com that accepts the API key "key-test" and rejects
+// recipients in the invalid domain.
+func startMailgunAPI(t *testing.T) *apiServer {
+	t.Helper()
+	return startAPIServer(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if user, key, _ := r.BasicAuth(); user != "api" || key != "key-test" {
+			http.Error(w, "Forbidden", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v3/domains/mg.example.com":
+			writeJSON(w, http.StatusOK, `{"domain":{"name":"mg.example.com","state":"active"}}`)
+		case "POST /v3/mg.example.com/messages.mime":
+			req, err := parseMailgunRequest(r.Header.Get("Content-Type"), body)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, `{"message":"`+err.Error()+`"}`)
+				return
+			}
+			if slices.ContainsFunc(req.To, func(to string) bool { return strings.HasSuffix(to, "@invalid") }) {
+				writeJSON(w, http.StatusBadRequest, `{"message":"to parameter is not a valid address. please check documentation"}`)
+				return
+			}
+			writeJSON(w, http.StatusOK, `{"id":"<20240501120000.1@mg.example.com>","message":"Queued. Thank you."}`)
+		default:
+			writeJSON(w, http.StatusNotFound, `{"message":"Domain not found: `+strings.TrimPrefix(r.URL.Path, "/v3/domains/")+`"}`)
+		}
+	})
+}
+
+func parseMailgunRequest(contentType string, body []byte) (*mailgunRequest, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		return nil, err
+	}
+	files := form.File["message"]
+	if len(files) != 1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+	return &mailgunRequest{To: form.Value["to"], Message: msg}, nil
+}
+
+func newMailgunTransport(t *testing.T, api *apiServer) *MailgunTransport {
+	t.Helper()
+	transport, err := NewMailgunTransport(Config{EmailAPIKey: "key-test", EmailMailgunDomain: "mg.example.com", EmailAPIURL: api.URL})
+	require.NoError(t, err)
+	return transport
+}
+
+func TestMailgunTransport_Send(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		api := startMailgunAPI(t)
+		transport := newMailgunTransport(t, api)
+
+		require.NoError(t, transport.Send(t.Context(), testAPIEmail()))
+
+		requests := api.Requests()
+		require.Len(t, requests, 1)
+		req, err := parseMailgunRequest(requests[0].Header.Get("Content-Type"), requests[0].Body)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"alice@example.com", "team@example.com", "audit@example.com"}, req.To)
+		assert.Equal(t, "Build #1 failed", req.Message.Header.Get("Subject"))
+		assert.Equal(t, "<build-1@example.com>", req.Message.Header.Get("Message-Id"))
+		assert.Equal(t, "octocat/hello-world", req.Message.Header.Get("X-Drone-Repo"))
+		assert.Empty(t, req.Message.Header.Get("Bcc"))
+		assert.True(t, strings.HasPrefix(req.Message.Header.Get("Content-Type"), "multipart/mixed"))
+	})
+
+	t.Run("invalid recipient", func(t *testing.T) {
+		t.Parallel()
+		transport := newMailgunTransport(t, startMailgunAPI(t))
+
+		err := transport.Send(t.Context(), rejectedEmail())
+
+		require.EqualError(t, err, "mailgun api: 400: to parameter is not a valid address. please check documentation")
+		assert.True(t, isPermanent(err))
+	})
+
+	t.Run("unknown domain", func(t *testing.T) {
+		t.Parallel()
+		api := startMailgunAPI(t)
+		transport, err := NewMailgunTransport(Config{EmailAPIKey: "key-test", EmailMailgunDomain: "mg.example.org", EmailAPIURL: api.URL})
+		require.NoError(t, err)
+
+		err = transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "mailgun api: 404")
+		assert.False(t, isPermanent(err))
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			writeJSON(w, http.StatusTooManyRequests, `{"message":"Too many requests"}`)
+		})
+		transport := newMailgunTransport(t, api)
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.EqualError(t, err, "mailgun api: 429: Too many requests")
+		assert.False(t, isPermanent(err))
+	})
+}
+
+func TestMailgunTransport_Check(t *testing.T) {
+	t.Run("active domain", func(t *testing.T) {
+		t.Parallel()
+		assert.NoError(t, newMailgunTransport(t, startMailgunAPI(t)).Check(t.Context()))
+	})
+
+	t.Run("unverified domain", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			writeJSON(w, http.StatusOK, `{"domain":{"name":"mg.example.com","state":"unverified"}}`)
+		})
+
+		err := newMailgunTransport(t, api).Check(t.Context())
+
+		assert.EqualError(t, err, "mailgun api: domain mg.example.com is unverified")
+	})
+
+	t.Run("invalid api key", func(t *testing.T) {
+		t.Parallel()
+		api := startMailgunAPI(t)
+		transport, err := NewMailgunTransport(Config{EmailAPIKey: "wrong", EmailMailgunDomain: "mg.example.com", EmailAPIURL: api.URL})
+		require.NoError(t, err)
+
+		assert.ErrorContains(t, transport.Check(t.Context()), "mailgun api: 401")
+	})
+}
+
+func TestNewMailgunTransport(t *testing.T) {
+	t.Parallel()
+	_, err := NewMailgunTransport(Config{EmailAPIKey: "key-test"})
+	assert.ErrorContains(t, err, "missing api key or domain")
+}
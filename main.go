@@ -13,7 +13,7 @@ func main() {
 }
 
 func run() int {
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	slog.SetDefault(slog.New(NewContextHandler(slog.NewJSONHandler(os.Stdout, nil))))
 
 	ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancelCtx()
@@ -23,9 +23,54 @@ func run() int {
 		slog.Error("failed to load config", "err", err)
 		return 1
 	}
-	emailSender := NewEmailSender(cfg)
+	shutdownTracing, err := SetupTracing(ctx)
+	if err != nil {
+		slog.Error("failed to set up tracing", "err", err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to shut down tracing", "err", err)
+		}
+	}()
+	store, err := OpenStore(cfg.DataDir)
+	if err != nil {
+		slog.Error("failed to open store", "err", err)
+		return 1
+	}
+	defer store.Close()
+	queue, err := NewQueue(store)
+	if err != nil {
+		slog.Error("failed to open queue", "err", err)
+		return 1
+	}
+	tracker, err := NewStatusTracker(store)
+	if err != nil {
+		slog.Error("failed to open status tracker", "err", err)
+		return 1
+	}
+	threads, err := NewThreadTracker(store)
+	if err != nil {
+		slog.Error("failed to open thread tracker", "err", err)
+		return 1
+	}
+	dedup, err := NewDeduplicator(cfg, store)
+	if err != nil {
+		slog.Error("failed to open deduplicator", "err", err)
+		return 1
+	}
+	if dedup != nil {
+		defer dedup.Close()
+	}
+	emailSender, err := NewEmailSender(cfg, queue, threads)
+	if err != nil {
+		slog.Error("failed to start email sender", "err", err)
+		return 1
+	}
 	defer emailSender.Shutdown()
-	h := NewHandler(cfg, emailSender)
+	h := NewHandler(cfg, tracker, dedup, emailSender)
 	srv := NewServer(cfg, h)
 	if err := srv.Start(); err != nil {
 		slog.Error("server failed to start", "err", err)
@@ -33,6 +78,16 @@ func run() int {
 	}
 	defer srv.Stop()
 
-	<-ctx.Done()
-	return 0
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-hup:
+			slog.Info("received SIGHUP, reloading templates")
+			emailSender.ReloadTemplates()
+		}
+	}
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "drone_email_webhook"
+
+// Set at build time by the release pipeline.
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+var (
+	webhooksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhooks_received_total",
+		Help:      "Webhooks received with a valid signature, by event, action and build status.",
+	}, []string{"event", "action", "status"})
+	webhookSignatureFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_signature_failures_total",
+		Help:      "Webhooks rejected by signature verification, by reason.",
+	}, []string{"reason"})
+	webhookDecodeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_decode_failures_total",
+		Help:      "Webhooks whose body cannot be read or decoded.",
+	})
+	emailsRendered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "emails_rendered_total",
+		Help:      "Emails rendered, by notification kind.",
+	}, []string{"kind"})
+	emailsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "emails_sent_total",
+		Help:      "Emails delivered to the SMTP server.",
+	})
+	emailsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "emails_failed_total",
+		Help:      "Emails that failed to render, enqueue or deliver, by reason. Failed delivery attempts are counted each time.",
+	}, []string{"reason"})
+	smtpConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "smtp_connections_total",
+		Help:      "Connections opened to the SMTP relay for deliveries.",
+	})
+	smtpRelayFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "smtp_relay_failures_total",
+		Help:      "Delivery attempts that failed because of the SMTP relay, by relay, which fail over to the next relay when there is one.",
+	}, []string{"relay"})
+	smtpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "smtp_send_duration_seconds",
+		Help:      "Duration of SMTP deliveries, by result.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+
+	queuePendingDesc  = prometheus.NewDesc(metricsNamespace+"_queue_pending", "Messages persisted in the queue, including the ones waiting for a retry.", nil, nil)
+	queueBufferedDesc = prometheus.NewDesc(metricsNamespace+"_queue_buffered", "Messages waiting in the buffer in front of the workers.", nil, nil)
+	queueCapacityDesc = prometheus.NewDesc(metricsNamespace+"_queue_capacity", "Capacity of the buffer in front of the workers.", nil, nil)
+	inFlightDesc      = prometheus.NewDesc(metricsNamespace+"_emails_in_flight", "Emails being delivered by the workers.", nil, nil)
+	workersDesc       = prometheus.NewDesc(metricsNamespace+"_workers", "Email workers.", nil, nil)
+)
+
+// Reasons of emailsFailed.
+const (
+	failureRender    = "render"
+	failureEnqueue   = "enqueue"
+	failureQueueFull = "queue_full"
+	failureDropped   = "dropped"
+	failureGaveUp    = "gave_up"
+)
+
+// queueCollector reports the queue statistics of the email sender at scrape
+// time.
+type queueCollector struct {
+	emailSender AsyncEmailSender
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queuePendingDesc
+	ch <- queueBufferedDesc
+	ch <- queueCapacityDesc
+	ch <- inFlightDesc
+	ch <- workersDesc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.emailSender.QueueStats()
+	ch <- prometheus.MustNewConstMetric(queuePendingDesc, prometheus.GaugeValue, float64(stats.Pending))
+	ch <- prometheus.MustNewConstMetric(queueBufferedDesc, prometheus.GaugeValue, float64(stats.Buffered))
+	ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(stats.Capacity))
+	ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(stats.InFlight))
+	ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue, float64(stats.Workers))
+}
+
+// newMetricsRegistry returns a registry with the service metrics, the queue
+// statistics of the email sender, build info, and the Go runtime and process
+// metrics.
+func newMetricsRegistry(emailSender AsyncEmailSender) *prometheus.Registry {
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "build_info",
+		Help:        "Build information of the running binary.",
+		ConstLabels: prometheus.Labels{"version": version, "commit": commit, "go_version": runtime.Version()},
+	})
+	buildInfo.Set(1)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		buildInfo,
+		queueCollector{emailSender: emailSender},
+		webhooksReceived,
+		webhookSignatureFailures,
+		webhookDecodeFailures,
+		emailsRendered,
+		emailsSent,
+		emailsFailed,
+		smtpConnections,
+		smtpRelayFailures,
+		smtpDuration,
+	)
+	return reg
+}
+
+func metricsHandler(emailSender AsyncEmailSender) http.Handler {
+	return promhttp.HandlerFor(newMetricsRegistry(emailSender), promhttp.HandlerOpts{})
+}
+
+// signatureFailureReason returns the reason label of a webhook verification
+// error.
+func signatureFailureReason(err error) string {
+	switch {
+	case errors.Is(err, errMissingSignature):
+		return "missing"
+	case errors.Is(err, errStaleRequest):
+		return "stale"
+	case errors.Is(err, errDigestMismatch):
+		return "digest"
+	case errors.Is(err, errReplayedRequest):
+		return "replayed"
+	default:
+		return "invalid"
+	}
+}
+
+// deliveryFailureReason classifies a delivery error as a timeout, a connection
+// failure, a rejection by the SMTP server or the email API with its reply or
+// status code class, such as smtp_4xx, or a failure of the sendmail binary or
+// of a file write.
+func deliveryFailureReason(err error) string {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return "smtp_" + strconv.Itoa(protoErr.Code/100) + "xx"
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return "api_" + strconv.Itoa(apiErr.status/100) + "xx"
+	}
+	var sendmailErr *sendmailError
+	if errors.As(err, &sendmailErr) {
+		return "sendmail"
+	}
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return "file"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	return "smtp"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	t.Parallel()
+	emailSender := NewMockEmailSender()
+	emailSender.On("QueueStats").Return(QueueStats{Pending: 3, Buffered: 2, Capacity: 10, InFlight: 1, Workers: 4})
+	defer emailSender.AssertExpectations(t)
+
+	handler := metricsHandler(emailSender).ServeHTTP
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "drone_email_webhook_queue_pending 3\n")
+	assert.Contains(t, body, "drone_email_webhook_queue_buffered 2\n")
+	assert.Contains(t, body, "drone_email_webhook_queue_capacity 10\n")
+	assert.Contains(t, body, "drone_email_webhook_emails_in_flight 1\n")
+	assert.Contains(t, body, "drone_email_webhook_workers 4\n")
+	assert.Contains(t, body, `drone_email_webhook_build_info{commit="unknown",go_version=`)
+	assert.Contains(t, body, "go_goroutines ")
+}
+
+func TestWebhookMetrics(t *testing.T) {
+	t.Parallel()
+	emailSender := NewMockEmailSender()
+	emailSender.On("SendAsync", mock.Anything).Return(nil)
+
+	handler := webhookHandler(NewWebhookVerifier(webhookConfig), newStatusTracker(t), nil, emailSender).ServeHTTP
+
+	received := webhooksReceived.WithLabelValues(webhook.EventBuild, webhook.ActionUpdated, drone.StatusKilled)
+	before := testutil.ToFloat64(received)
+	killed := &webhook.Request{
+		Event:  webhook.EventBuild,
+		Action: webhook.ActionUpdated,
+		Build:  &drone.Build{Status: drone.StatusKilled},
+		Repo:   &drone.Repo{Slug: "test/repo"},
+	}
+	assertHTTPStatusCode(t, handler, http.MethodPost, "/", killed, http.StatusNoContent)
+	assert.InDelta(t, before+1, testutil.ToFloat64(received), 0)
+}
+
+func TestSignatureFailureReason(t *testing.T) {
+	assert.Equal(t, "missing", signatureFailureReason(fmt.Errorf("%w: no header", errMissingSignature)))
+	assert.Equal(t, "invalid", signatureFailureReason(errInvalidSignature))
+	assert.Equal(t, "stale", signatureFailureReason(fmt.Errorf("%w: 1h0m0s", errStaleRequest)))
+	assert.Equal(t, "digest", signatureFailureReason(errDigestMismatch))
+	assert.Equal(t, "replayed", signatureFailureReason(errReplayedRequest))
+}
+
+func TestDeliveryFailureReason(t *testing.T) {
+	assert.Equal(t, "smtp_5xx", deliveryFailureReason(&textproto.Error{Code: 550, Msg: "mailbox unavailable"}))
+	assert.Equal(t, "smtp_4xx", deliveryFailureReason(fmt.Errorf("send: %w", &textproto.Error{Code: 421, Msg: "try again later"})))
+	assert.Equal(t, "timeout", deliveryFailureReason(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}))
+	assert.Equal(t, "timeout", deliveryFailureReason(context.DeadlineExceeded))
+	assert.Equal(t, "connection", deliveryFailureReason(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.Equal(t, "smtp", deliveryFailureReason(errors.New("smtp: server doesn't support AUTH")))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/jordan-wright/email"
+)
+
+const postmarkURL = "https://api.postmarkapp.com"
+
+// postmarkPermanentErrors are the Postmark error codes that reject the message
+// itself: invalid request, invalid or incompatible JSON, inactive recipient and
+// forbidden attachment type. The other ones, such as an unconfirmed sender
+// signature or a suspended account, are fixed on the Postmark side.
+var postmarkPermanentErrors = []int{300, 402, 403, 406, 409, 411}
+
+// PostmarkTransport delivers messages with the Postmark Email API.
+type PostmarkTransport struct {
+	api   *apiClient
+	token string
+}
+
+func NewPostmarkTransport(cfg Config) (*PostmarkTransport, error) {
+	if cfg.EmailAPIKey == "" {
+		return nil, errors.New("postmark api: missing server token")
+	}
+	api, err := newAPIClient("postmark", cmp.Or(cfg.EmailAPIURL, postmarkURL))
+	if err != nil {
+		return nil, err
+	}
+	return &PostmarkTransport{api: api, token: cfg.EmailAPIKey}, nil
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+type postmarkMessage struct {
+	From        string               `json:"From"`
+	To          string               `json:"To,omitempty"`
+	Cc          string               `json:"Cc,omitempty"`
+	Bcc         string               `json:"Bcc,omitempty"`
+	ReplyTo     string               `json:"ReplyTo,omitempty"`
+	Subject     string               `json:"Subject"`
+	TextBody    string               `json:"TextBody,omitempty"`
+	HTMLBody    string               `json:"HtmlBody,omitempty"`
+	Headers     []postmarkHeader     `json:"Headers,omitempty"`
+	Attachments []postmarkAttachment `json:"Attachments,omitempty"`
+}
+
+type postmarkResponse struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+}
+
+// Send delivers the message to its To, Cc and Bcc recipients.
+func (t *PostmarkTransport) Send(ctx context.Context, emailMsg *email.Email) error {
+	msg, err := newAPIMessage(emailMsg)
+	if err != nil {
+		return fmt.Errorf("postmark api: %w", err)
+	}
+
+	body := postmarkMessage{
+		From:     msg.From.String(),
+		To:       formatAddresses(msg.To),
+		Cc:       formatAddresses(msg.Cc),
+		Bcc:      formatAddresses(msg.Bcc),
+		ReplyTo:  formatAddresses(msg.ReplyTo),
+		Subject:  msg.Subject,
+		TextBody: msg.Text,
+		HTMLBody: msg.HTML,
+	}
+	for _, header := range msg.Headers {
+		body.Headers = append(body.Headers, postmarkHeader{Name: header[0], Value: header[1]})
+	}
+	for _, a := range msg.Attachments {
+		attachment := postmarkAttachment{Name: a.Filename, Content: a.Content, ContentType: a.ContentType}
+		if a.ContentID != "" {
+			attachment.ContentID = "cid:" + a.ContentID
+		}
+		body.Attachments = append(body.Attachments, attachment)
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("postmark api: %w", err)
+	}
+	req, err := t.api.newRequest(ctx, http.MethodPost, "/email", payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", t.token)
+	_, err = t.api.do(req, postmarkError)
+	return err
+}
+
+// Check verifies that the server token is valid.
+func (t *PostmarkTransport) Check(ctx context.Context) error {
+	req, err := t.api.newRequest(ctx, http.MethodGet, "/server", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", t.token)
+	_, err = t.api.do(req, postmarkError)
+	return err
+}
+
+func (t *PostmarkTransport) Close() {}
+
+// postmarkError classifies the errors by their Postmark error code, which is
+// returned along with 422 Unprocessable Entity.
+func postmarkError(_ *http.Response, body []byte) *apiError {
+	apiErr := &apiError{}
+	var errResp postmarkResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.ErrorCode != 0 {
+		apiErr.code = strconv.Itoa(errResp.ErrorCode)
+		apiErr.message = errResp.Message
+		apiErr.permanent = slices.Contains(postmarkPermanentErrors, errResp.ErrorCode)
+	}
+	return apiErr
+}
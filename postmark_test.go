@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startPostmarkAPI starts a stand-in of the Postmark Email API that accepts
+// the server token "server-token" and reports recipients in the invalid
+// domain as inactive.
+func startPostmarkAPI(t *testing.T) *apiServer {
+	t.Helper()
+	return startAPIServer(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if r.Header.Get("X-Postmark-Server-Token") != "server-token" {
+			writeJSON(w, http.StatusUnauthorized, `{"ErrorCode":10,"Message":"The Server Token you provided in the X-Postmark-Server-Token request header was invalid."}`)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /server":
+			writeJSON(w, http.StatusOK, `{"ID":1,"Name":"Drone"}`)
+		case "POST /email":
+			var msg postmarkMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				writeJSON(w, http.StatusUnprocessableEntity, `{"ErrorCode":402,"Message":"Received invalid JSON input."}`)
+				return
+			}
+			if strings.Contains(msg.To, "@invalid") {
+				writeJSON(w, http.StatusUnprocessableEntity, `{"ErrorCode":406,"Message":"You tried to send to recipient(s) that have been marked as inactive."}`)
+				return
+			}
+			writeJSON(w, http.StatusOK, `{"To":"`+msg.To+`","ErrorCode":0,"Message":"OK"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func newPostmarkTransport(t *testing.T, api *apiServer) *PostmarkTransport {
+	t.Helper()
+	transport, err := NewPostmarkTransport(Config{EmailAPIKey: "server-token", EmailAPIURL: api.URL})
+	require.NoError(t, err)
+	return transport
+}
+
+func TestPostmarkTransport_Send(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		api := startPostmarkAPI(t)
+		transport := newPostmarkTransport(t, api)
+
+		require.NoError(t, transport.Send(t.Context(), testAPIEmail()))
+
+		requests := api.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "application/json", requests[0].Header.Get("Content-Type"))
+		var msg postmarkMessage
+		require.NoError(t, json.Unmarshal(requests[0].Body, &msg))
+		assert.Equal(t, postmarkMessage{
+			From:     `"Drone CI" <ci@example.com>`,
+			To:       `"Alice" <alice@example.com>`,
+			Cc:       "<team@example.com>",
+			Bcc:      "<audit@example.com>",
+			ReplyTo:  "<noreply@example.com>",
+			Subject:  "Build #1 failed",
+			TextBody: "Build #1 failed",
+			HTMLBody: `<p>Build #1 failed</p><img src="cid:logo.png">`,
+			Headers: []postmarkHeader{
+				{Name: "Message-Id", Value: "<build-1@example.com>"},
+				{Name: "X-Drone-Repo", Value: "octocat/hello-world"},
+			},
+			Attachments: []postmarkAttachment{
+				{Name: "logo.png", Content: "cG5n", ContentType: "image/png", ContentID: "cid:logo.png"},
+				{Name: "build.log", Content: "bWFrZTogKioqIFt0ZXN0XSBFcnJvciAx", ContentType: "text/plain; charset=utf-8"},
+			},
+		}, msg)
+	})
+
+	t.Run("inactive recipient", func(t *testing.T) {
+		t.Parallel()
+		transport := newPostmarkTransport(t, startPostmarkAPI(t))
+
+		err := transport.Send(t.Context(), rejectedEmail())
+
+		require.EqualError(t, err, "postmark api: 422 406: You tried to send to recipient(s) that have been marked as inactive.")
+		assert.True(t, isPermanent(err))
+		assert.Equal(t, "api_4xx", deliveryFailureReason(err))
+	})
+
+	t.Run("invalid server token", func(t *testing.T) {
+		t.Parallel()
+		api := startPostmarkAPI(t)
+		transport, err := NewPostmarkTransport(Config{EmailAPIKey: "wrong", EmailAPIURL: api.URL})
+		require.NoError(t, err)
+
+		err = transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "postmark api: 401 10:")
+		assert.False(t, isPermanent(err), "credentials can be fixed before the next attempt")
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+		transport := newPostmarkTransport(t, api)
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.EqualError(t, err, "postmark api: 429: Too Many Requests")
+		assert.False(t, isPermanent(err))
+	})
+}
+
+func TestPostmarkTransport_Check(t *testing.T) {
+	t.Parallel()
+	api := startPostmarkAPI(t)
+
+	require.NoError(t, newPostmarkTransport(t, api).Check(t.Context()))
+
+	transport, err := NewPostmarkTransport(Config{EmailAPIKey: "wrong", EmailAPIURL: api.URL})
+	require.NoError(t, err)
+	assert.ErrorContains(t, transport.Check(t.Context()), "401")
+}
+
+func TestNewPostmarkTransport(t *testing.T) {
+	t.Parallel()
+	_, err := NewPostmarkTransport(Config{})
+	assert.ErrorContains(t, err, "missing server token")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"go.etcd.io/bbolt"
+)
+
+var queueBucket = []byte("queue")
+
+type QueueItem struct {
+	ID            uint64            `json:"id"`
+	BuildNumber   int64             `json:"build_number"`
+	BuildID       int64             `json:"build_id,omitempty"`
+	RepoSlug      string            `json:"repo_slug,omitempty"`
+	Email         *email.Email      `json:"email"`
+	Attempts      int               `json:"attempts"`
+	CreatedAt     time.Time         `json:"created_at"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+	LastError     string            `json:"last_error,omitempty"`
+	TraceContext  map[string]string `json:"trace_context,omitempty"`
+}
+
+type Queue struct {
+	store *Store
+}
+
+func NewQueue(store *Store) (*Queue, error) {
+	if err := store.createBucket(queueBucket); err != nil {
+		return nil, err
+	}
+	return &Queue{store: store}, nil
+}
+
+func (q *Queue) Push(item *QueueItem) error {
+	err := q.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(queueBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err //nolint:wrapcheck // wrapped below
+		}
+		item.ID = id
+		return putQueueItem(b, item)
+	})
+	if err != nil {
+		return fmt.Errorf("queue: push: %w", err)
+	}
+	return nil
+}
+
+func (q *Queue) Update(item *QueueItem) error {
+	err := q.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(queueBucket)
+		if b.Get(queueKey(item.ID)) == nil {
+			return errQueueItemNotFound
+		}
+		return putQueueItem(b, item)
+	})
+	if err != nil {
+		return fmt.Errorf("queue: update item %d: %w", item.ID, err)
+	}
+	return nil
+}
+
+func (q *Queue) Remove(id uint64) error {
+	err := q.store.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(queueBucket).Delete(queueKey(id)) //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return fmt.Errorf("queue: remove item %d: %w", id, err)
+	}
+	return nil
+}
+
+func (q *Queue) Pending() ([]*QueueItem, error) {
+	var items []*QueueItem
+	err := q.store.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(queueBucket).ForEach(func(_, v []byte) error {
+			var item QueueItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err //nolint:wrapcheck // wrapped below
+			}
+			items = append(items, &item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("queue: list pending items: %w", err)
+	}
+	return items, nil
+}
+
+func (q *Queue) Len() int {
+	var n int
+	_ = q.store.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(queueBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+var errQueueItemNotFound = errors.New("item not found")
+
+func putQueueItem(b *bbolt.Bucket, item *QueueItem) error {
+	v, err := json.Marshal(item)
+	if err != nil {
+		return err //nolint:wrapcheck // wrapped by caller
+	}
+	return b.Put(queueKey(item.ID), v) //nolint:wrapcheck // wrapped by caller
+}
+
+func queueKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
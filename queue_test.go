@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newQueue(t *testing.T) *Queue {
+	t.Helper()
+	queue, err := NewQueue(newStore(t))
+	require.NoError(t, err)
+	return queue
+}
+
+func TestQueue(t *testing.T) {
+	t.Run("push and pending", func(t *testing.T) {
+		t.Parallel()
+		queue := newQueue(t)
+		first := &QueueItem{BuildNumber: 1, Email: &email.Email{Subject: "first"}}
+		second := &QueueItem{BuildNumber: 2, Email: &email.Email{Subject: "second"}}
+
+		require.NoError(t, queue.Push(first))
+		require.NoError(t, queue.Push(second))
+
+		items, err := queue.Pending()
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		assert.Less(t, first.ID, second.ID)
+		assert.Equal(t, first.ID, items[0].ID)
+		assert.Equal(t, "first", items[0].Email.Subject)
+		assert.Equal(t, second.ID, items[1].ID)
+		assert.Equal(t, "second", items[1].Email.Subject)
+		assert.Equal(t, 2, queue.Len())
+	})
+
+	t.Run("update", func(t *testing.T) {
+		t.Parallel()
+		queue := newQueue(t)
+		item := &QueueItem{BuildNumber: 1, Email: &email.Email{}}
+		require.NoError(t, queue.Push(item))
+
+		item.Attempts = 3
+		item.LastError = "connection refused"
+		item.NextAttemptAt = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		require.NoError(t, queue.Update(item))
+
+		items, err := queue.Pending()
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, 3, items[0].Attempts)
+		assert.Equal(t, "connection refused", items[0].LastError)
+		assert.True(t, item.NextAttemptAt.Equal(items[0].NextAttemptAt))
+	})
+
+	t.Run("update removed item", func(t *testing.T) {
+		t.Parallel()
+		queue := newQueue(t)
+		item := &QueueItem{BuildNumber: 1, Email: &email.Email{}}
+		require.NoError(t, queue.Push(item))
+		require.NoError(t, queue.Remove(item.ID))
+
+		err := queue.Update(item)
+		require.ErrorIs(t, err, errQueueItemNotFound)
+		assert.Equal(t, 0, queue.Len())
+	})
+
+	t.Run("persists across reopen", func(t *testing.T) {
+		t.Parallel()
+		dataDir := t.TempDir()
+		store, err := OpenStore(dataDir)
+		require.NoError(t, err)
+		queue, err := NewQueue(store)
+		require.NoError(t, err)
+		require.NoError(t, queue.Push(&QueueItem{BuildNumber: 42, Email: &email.Email{}}))
+		store.Close()
+
+		store, err = OpenStore(dataDir)
+		require.NoError(t, err)
+		defer store.Close()
+		queue, err = NewQueue(store)
+		require.NoError(t, err)
+
+		items, err := queue.Pending()
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, int64(42), items[0].BuildNumber)
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	transportCheckTimeout  = 10 * time.Second
+	transportCheckCacheTTL = 30 * time.Second
+)
+
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "ok"
+	CheckFail CheckStatus = "fail"
+)
+
+// Readiness is the body of the readiness endpoint.
+type Readiness struct {
+	Status CheckStatus     `json:"status"`
+	Checks ReadinessChecks `json:"checks"`
+}
+
+type ReadinessChecks struct {
+	Transport TransportCheck `json:"transport"`
+	Queue     QueueCheck     `json:"queue"`
+}
+
+type TransportCheck struct {
+	Status    CheckStatus `json:"status"`
+	CheckedAt time.Time   `json:"checked_at"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type QueueCheck struct {
+	Status CheckStatus `json:"status"`
+	QueueStats
+}
+
+// TransportChecker verifies that the transport can deliver messages without
+// sending any, such as with the handshake of the SMTP relays. Results are
+// cached so that frequent probes do not hammer the relay or the API, and
+// concurrent checks share the probe in progress.
+type TransportChecker struct {
+	check   func(context.Context) error
+	timeout time.Duration
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	last  TransportCheck
+	probe *transportProbe
+}
+
+// transportProbe is a check in progress, whose result is set before done is
+// closed.
+type transportProbe struct {
+	done   chan struct{}
+	result TransportCheck
+}
+
+func NewTransportChecker(check func(context.Context) error) *TransportChecker {
+	return &TransportChecker{
+		check:   check,
+		timeout: transportCheckTimeout,
+		ttl:     transportCheckCacheTTL,
+		now:     time.Now,
+	}
+}
+
+// Check returns the result of the last probe, performing a new one when it is
+// older than the cache TTL. The probe is not cancelled along with ctx, so that
+// its result is cached for the next checks even when the caller gives up
+// waiting for it.
+func (c *TransportChecker) Check(ctx context.Context) TransportCheck {
+	c.mu.Lock()
+	now := c.now()
+	if !c.last.CheckedAt.IsZero() && now.Sub(c.last.CheckedAt) < c.ttl {
+		last := c.last
+		c.mu.Unlock()
+		return last
+	}
+	p := c.probe
+	if p == nil {
+		p = &transportProbe{done: make(chan struct{})}
+		c.probe = p
+		go c.run(context.WithoutCancel(ctx), now, p)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.result
+	case <-ctx.Done():
+		return TransportCheck{Status: CheckFail, CheckedAt: now, Error: context.Cause(ctx).Error()}
+	}
+}
+
+// run performs a probe and caches its result, unless it failed with a context
+// error, which says nothing about the transport.
+func (c *TransportChecker) run(ctx context.Context, now time.Time, p *transportProbe) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	result := TransportCheck{Status: CheckOK, CheckedAt: now}
+	err := c.check(ctx)
+	if err != nil {
+		result.Status = CheckFail
+		result.Error = err.Error()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		c.last = result
+	}
+	c.probe = nil
+	p.result = result
+	close(p.done)
+}
+
+// readyHandler reports whether the service can deliver notifications: the
+// transport check must pass, and the buffer in front of the workers must not be
+// full. It answers 503 Service Unavailable otherwise.
+func readyHandler(checker *TransportChecker, emailSender AsyncEmailSender) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := emailSender.QueueStats()
+		readiness := Readiness{
+			Status: CheckOK,
+			Checks: ReadinessChecks{
+				Transport: checker.Check(r.Context()),
+				Queue:     QueueCheck{Status: CheckOK, QueueStats: stats},
+			},
+		}
+		if stats.Capacity > 0 && stats.Buffered >= stats.Capacity {
+			readiness.Checks.Queue.Status = CheckFail
+		}
+		statusCode := http.StatusOK
+		if readiness.Checks.Transport.Status != CheckOK || readiness.Checks.Queue.Status != CheckOK {
+			readiness.Status = CheckFail
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		_ = json.NewEncoder(w).Encode(&readiness)
+	})
+}
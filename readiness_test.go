@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportChecker_Check(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+
+		check := NewTransportChecker(newSMTPRelays(t, server.config()).Check).Check(t.Context())
+
+		assert.Equal(t, CheckOK, check.Status)
+		assert.Empty(t, check.Error)
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123"))
+
+		check := NewTransportChecker(newSMTPRelays(t, server.config()).Check).Check(t.Context())
+
+		assert.Equal(t, CheckOK, check.Status)
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123"))
+
+		check := NewTransportChecker(newSMTPRelays(t, server.config(func(cfg *Config) { cfg.EmailSMTPPassword = "wrong" })).Check).Check(t.Context())
+
+		assert.Equal(t, CheckFail, check.Status)
+		assert.Contains(t, check.Error, "smtp relay: auth: PLAIN: 535")
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS)
+
+		check := NewTransportChecker(newSMTPRelays(t, server.config()).Check).Check(t.Context())
+
+		assert.Equal(t, CheckFail, check.Status)
+		assert.Contains(t, check.Error, "smtp relay: starttls")
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+
+		check := NewTransportChecker(newSMTPRelays(t, Config{EmailSMTPHost: host, EmailSMTPPort: port}).Check).Check(t.Context())
+
+		assert.Equal(t, CheckFail, check.Status)
+		assert.Contains(t, check.Error, "connection refused")
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		now := time.Now()
+		checker := NewTransportChecker(newSMTPRelays(t, server.config()).Check)
+		checker.now = func() time.Time { return now }
+
+		first := checker.Check(t.Context())
+		second := checker.Check(t.Context())
+		assert.Equal(t, first, second)
+		assert.Equal(t, 1, server.Sessions())
+
+		now = now.Add(transportCheckCacheTTL)
+		third := checker.Check(t.Context())
+		assert.Equal(t, now, third.CheckedAt)
+		assert.Equal(t, 2, server.Sessions())
+	})
+
+	t.Run("shared probe", func(t *testing.T) {
+		t.Parallel()
+		var probes atomic.Int32
+		release := make(chan struct{})
+		checker := NewTransportChecker(func(context.Context) error {
+			probes.Add(1)
+			<-release
+			return nil
+		})
+
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Go(func() {
+				assert.Equal(t, CheckOK, checker.Check(t.Context()).Status)
+			})
+		}
+		assert.Eventually(t, func() bool { return probes.Load() == 1 }, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), probes.Load())
+	})
+
+	t.Run("cancelled request", func(t *testing.T) {
+		t.Parallel()
+		release := make(chan struct{})
+		checker := NewTransportChecker(func(ctx context.Context) error {
+			<-release
+			return ctx.Err()
+		})
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		check := checker.Check(ctx)
+		assert.Equal(t, CheckFail, check.Status)
+		assert.Equal(t, context.Canceled.Error(), check.Error)
+
+		close(release)
+		assert.Equal(t, CheckOK, checker.Check(t.Context()).Status, "the probe is not cancelled with the request")
+	})
+
+	t.Run("context errors are not cached", func(t *testing.T) {
+		t.Parallel()
+		var probes atomic.Int32
+		checker := NewTransportChecker(func(context.Context) error {
+			if probes.Add(1) == 1 {
+				return fmt.Errorf("smtp relay: %w", context.DeadlineExceeded)
+			}
+			return nil
+		})
+
+		assert.Equal(t, CheckFail, checker.Check(t.Context()).Status)
+		assert.Equal(t, CheckOK, checker.Check(t.Context()).Status)
+		assert.Equal(t, CheckOK, checker.Check(t.Context()).Status)
+		assert.Equal(t, int32(2), probes.Load())
+	})
+}
+
+func TestReadyHandler(t *testing.T) {
+	ready := func(t *testing.T, checker *TransportChecker, stats QueueStats) (int, Readiness) {
+		t.Helper()
+		emailSender := NewMockEmailSender()
+		emailSender.On("QueueStats").Return(stats)
+		defer emailSender.AssertExpectations(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/ready", http.NoBody)
+		w := httptest.NewRecorder()
+		readyHandler(checker, emailSender).ServeHTTP(w, req)
+
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var readiness Readiness
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &readiness))
+		return w.Code, readiness
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+
+		code, readiness := ready(t, NewTransportChecker(newSMTPRelays(t, server.config()).Check), QueueStats{Pending: 3, Buffered: 2, Capacity: 10, InFlight: 1, Workers: 4})
+
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, CheckOK, readiness.Status)
+		assert.Equal(t, CheckOK, readiness.Checks.Transport.Status)
+		assert.Equal(t, QueueCheck{Status: CheckOK, QueueStats: QueueStats{Pending: 3, Buffered: 2, Capacity: 10, InFlight: 1, Workers: 4}}, readiness.Checks.Queue)
+	})
+
+	t.Run("transport down", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+
+		code, readiness := ready(t, NewTransportChecker(newSMTPRelays(t, Config{EmailSMTPHost: host, EmailSMTPPort: port}).Check), QueueStats{Capacity: 10, Workers: 4})
+
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, CheckFail, readiness.Status)
+		assert.Equal(t, CheckFail, readiness.Checks.Transport.Status)
+		assert.NotEmpty(t, readiness.Checks.Transport.Error)
+		assert.Equal(t, CheckOK, readiness.Checks.Queue.Status)
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+
+		code, readiness := ready(t, NewTransportChecker(newSMTPRelays(t, server.config()).Check), QueueStats{Pending: 12, Buffered: 10, Capacity: 10, InFlight: 4, Workers: 4})
+
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, CheckFail, readiness.Status)
+		assert.Equal(t, CheckOK, readiness.Checks.Transport.Status)
+		assert.Equal(t, CheckFail, readiness.Checks.Queue.Status)
+	})
+}
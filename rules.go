@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"gopkg.in/yaml.v3"
+)
+
+// RulesMode defines how routing rules are combined when several of them match.
+type RulesMode string
+
+const (
+	// RulesFirstMatch applies only the first matching rule.
+	RulesFirstMatch RulesMode = "first-match"
+	// RulesMergeAll applies every matching rule in order.
+	RulesMergeAll RulesMode = "merge-all"
+)
+
+var (
+	knownEvents   = []string{drone.EventPush, drone.EventPullRequest, drone.EventTag, drone.EventPromote, drone.EventRollback, "cron", "custom"}
+	knownStatuses = []string{drone.StatusPassing, drone.StatusFailing, drone.StatusError}
+)
+
+type RoutingRules struct {
+	Mode  RulesMode     `yaml:"mode"`
+	Rules []RoutingRule `yaml:"rules"`
+}
+
+type RoutingRule struct {
+	Name     string    `yaml:"name"`
+	Match    RuleMatch `yaml:"match"`
+	To       []string  `yaml:"to"`
+	Cc       []string  `yaml:"cc"`
+	Bcc      []string  `yaml:"bcc"`
+	Replace  bool      `yaml:"replace"`
+	Suppress bool      `yaml:"suppress"`
+}
+
+// RuleMatch selects builds by glob patterns (see path.Match) and exact values.
+// Empty lists match everything; a build matches when every non-empty list has
+// at least one matching entry.
+type RuleMatch struct {
+	Repos      []string `yaml:"repos"`
+	Namespaces []string `yaml:"namespaces"`
+	Refs       []string `yaml:"refs"`
+	Branches   []string `yaml:"branches"`
+	Events     []string `yaml:"events"`
+	Statuses   []string `yaml:"statuses"`
+}
+
+type Recipients struct {
+	To  []string
+	Cc  []string
+	Bcc []string
+}
+
+func LoadRoutingRules(filename string) (*RoutingRules, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("routing rules: %w", err)
+	}
+	defer f.Close()
+
+	var rules RoutingRules
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("routing rules: parse %s: %w", filename, err)
+	}
+	if rules.Mode == "" {
+		rules.Mode = RulesFirstMatch
+	}
+	if err := rules.validate(); err != nil {
+		return nil, fmt.Errorf("routing rules: %s: %w", filename, err)
+	}
+	return &rules, nil
+}
+
+func (r *RoutingRules) validate() error {
+	if r.Mode != RulesFirstMatch && r.Mode != RulesMergeAll {
+		return fmt.Errorf("unknown mode %q", r.Mode)
+	}
+	var errs []error
+	for i, rule := range r.Rules {
+		if err := rule.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule #%d %q: %w", i+1, rule.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *RoutingRule) validate() error {
+	var errs []error
+	for _, patterns := range [][]string{r.Match.Repos, r.Match.Namespaces, r.Match.Refs, r.Match.Branches} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("invalid pattern %q: %w", pattern, err))
+			}
+		}
+	}
+	for _, event := range r.Match.Events {
+		if !slices.Contains(knownEvents, event) {
+			errs = append(errs, fmt.Errorf("unknown event %q", event))
+		}
+	}
+	for _, status := range r.Match.Statuses {
+		if !slices.Contains(knownStatuses, status) {
+			errs = append(errs, fmt.Errorf("unknown status %q", status))
+		}
+	}
+	for _, addrs := range [][]string{r.To, r.Cc, r.Bcc} {
+		for _, addr := range addrs {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				errs = append(errs, fmt.Errorf("invalid address %q: %w", addr, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Apply evaluates the rules against the request and returns the resulting
+// recipients, or false when a matching rule suppresses the notification.
+func (r *RoutingRules) Apply(req *webhook.Request, rcpt Recipients) (Recipients, bool) {
+	for _, rule := range r.Rules {
+		if !rule.Match.matches(req) {
+			continue
+		}
+		if rule.Suppress {
+			return Recipients{}, false
+		}
+		if rule.Replace {
+			rcpt = Recipients{}
+		}
+		for _, addr := range rule.To {
+			rcpt.To = appendAddress(rcpt.To, addr)
+		}
+		for _, addr := range rule.Cc {
+			rcpt.Cc = appendAddress(rcpt.Cc, addr)
+		}
+		for _, addr := range rule.Bcc {
+			rcpt.Bcc = appendAddress(rcpt.Bcc, addr)
+		}
+		if r.Mode == RulesFirstMatch {
+			break
+		}
+	}
+	return rcpt, true
+}
+
+func (m *RuleMatch) matches(req *webhook.Request) bool {
+	return matchesAny(m.Repos, req.Repo.Slug) &&
+		matchesAny(m.Namespaces, req.Repo.Namespace) &&
+		matchesAny(m.Refs, req.Build.Ref) &&
+		matchesAny(m.Branches, req.Build.Target) &&
+		(len(m.Events) == 0 || slices.Contains(m.Events, req.Build.Event)) &&
+		(len(m.Statuses) == 0 || slices.Contains(m.Statuses, req.Build.Status))
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
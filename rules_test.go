@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(filename, []byte(content), 0o600)
+	require.NoError(t, err)
+	return filename
+}
+
+func buildRulesRequest(slug, ref, target, event, status string) *webhook.Request {
+	namespace, _, _ := strings.Cut(slug, "/")
+	return &webhook.Request{
+		Repo:  &drone.Repo{Slug: slug, Namespace: namespace},
+		Build: &drone.Build{Ref: ref, Target: target, Event: event, Status: status},
+	}
+}
+
+func TestLoadRoutingRules(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		filename := writeFile(t, "rules.yml", `
+mode: merge-all
+rules:
+  - name: platform
+    match:
+      repos: ["platform/*"]
+      refs: ["refs/heads/main", "refs/heads/release/*"]
+      events: [push, cron]
+      statuses: [failure]
+    cc: [platform@example.com]
+  - name: sandbox
+    match:
+      namespaces: [sandbox]
+    suppress: true
+`)
+
+		rules, err := LoadRoutingRules(filename)
+
+		require.NoError(t, err)
+		assert.Equal(t, &RoutingRules{
+			Mode: RulesMergeAll,
+			Rules: []RoutingRule{
+				{
+					Name: "platform",
+					Match: RuleMatch{
+						Repos:    []string{"platform/*"},
+						Refs:     []string{"refs/heads/main", "refs/heads/release/*"},
+						Events:   []string{"push", "cron"},
+						Statuses: []string{"failure"},
+					},
+					Cc: []string{"platform@example.com"},
+				},
+				{
+					Name:     "sandbox",
+					Match:    RuleMatch{Namespaces: []string{"sandbox"}},
+					Suppress: true,
+				},
+			},
+		}, rules)
+	})
+
+	t.Run("default mode", func(t *testing.T) {
+		t.Parallel()
+		filename := writeFile(t, "rules.yml", "rules: []\n")
+
+		rules, err := LoadRoutingRules(filename)
+
+		require.NoError(t, err)
+		assert.Equal(t, RulesFirstMatch, rules.Mode)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		for name, content := range map[string]string{
+			"unknown mode":    "mode: any\n",
+			"unknown field":   "rules:\n  - name: a\n    recipients: [a@example.com]\n",
+			"invalid pattern": "rules:\n  - match:\n      repos: [\"[\"]\n",
+			"unknown event":   "rules:\n  - match:\n      events: [merge]\n",
+			"unknown status":  "rules:\n  - match:\n      statuses: [running]\n",
+			"invalid address": "rules:\n  - to: [not an address]\n",
+			"invalid yaml":    "rules: [\n",
+		} {
+			_, err := LoadRoutingRules(writeFile(t, "rules.yml", content))
+			assert.Error(t, err, name)
+		}
+
+		_, err := LoadRoutingRules(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestRoutingRules_Apply(t *testing.T) {
+	author := Recipients{
+		To: []string{"Test User <test@example.com>"},
+		Cc: []string{"admin@example.com"},
+	}
+	rules := []RoutingRule{
+		{
+			Name:  "platform main",
+			Match: RuleMatch{Repos: []string{"platform/*"}, Branches: []string{"main"}, Statuses: []string{"failure"}},
+			Cc:    []string{"platform@example.com"},
+		},
+		{
+			Name:    "platform",
+			Match:   RuleMatch{Namespaces: []string{"platform"}},
+			To:      []string{"oncall@example.com"},
+			Replace: true,
+		},
+		{
+			Name:     "pull requests",
+			Match:    RuleMatch{Events: []string{"pull_request"}},
+			Suppress: true,
+		},
+		{
+			Name:  "releases",
+			Match: RuleMatch{Refs: []string{"refs/tags/*"}},
+			Bcc:   []string{"release@example.com"},
+		},
+	}
+
+	t.Run("first match", func(t *testing.T) {
+		t.Parallel()
+		r := &RoutingRules{Mode: RulesFirstMatch, Rules: rules}
+
+		rcpt, ok := r.Apply(buildRulesRequest("platform/api", "refs/heads/main", "main", "push", "failure"), author)
+
+		assert.True(t, ok)
+		assert.Equal(t, Recipients{
+			To: []string{"Test User <test@example.com>"},
+			Cc: []string{"admin@example.com", "platform@example.com"},
+		}, rcpt)
+	})
+
+	t.Run("merge all", func(t *testing.T) {
+		t.Parallel()
+		r := &RoutingRules{Mode: RulesMergeAll, Rules: rules}
+
+		rcpt, ok := r.Apply(buildRulesRequest("platform/api", "refs/heads/main", "main", "push", "failure"), author)
+
+		assert.True(t, ok)
+		assert.Equal(t, Recipients{To: []string{"oncall@example.com"}}, rcpt)
+	})
+
+	t.Run("suppress", func(t *testing.T) {
+		t.Parallel()
+		r := &RoutingRules{Mode: RulesMergeAll, Rules: rules}
+
+		_, ok := r.Apply(buildRulesRequest("team/web", "refs/pull/1/head", "main", "pull_request", "failure"), author)
+
+		assert.False(t, ok)
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		t.Parallel()
+		r := &RoutingRules{Mode: RulesFirstMatch, Rules: rules}
+
+		rcpt, ok := r.Apply(buildRulesRequest("team/web", "refs/heads/main", "main", "push", "failure"), author)
+
+		assert.True(t, ok)
+		assert.Equal(t, author, rcpt)
+	})
+
+	t.Run("glob on refs", func(t *testing.T) {
+		t.Parallel()
+		r := &RoutingRules{Mode: RulesFirstMatch, Rules: rules}
+
+		rcpt, ok := r.Apply(buildRulesRequest("team/web", "refs/tags/v1.0.0", "", "tag", "failure"), author)
+
+		assert.True(t, ok)
+		assert.Equal(t, []string{"release@example.com"}, rcpt.Bcc)
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/jordan-wright/email"
+)
+
+const sendGridURL = "https://api.sendgrid.com"
+
+// sendGridReservedHeaders cannot be set as custom headers of the SendGrid API.
+var sendGridReservedHeaders = []string{"Dkim-Signature", "Received", "X-Sg-Eid", "X-Sg-Id"}
+
+// SendGridTransport delivers messages with the SendGrid v3 Mail Send API.
+type SendGridTransport struct {
+	api    *apiClient
+	apiKey string
+}
+
+func NewSendGridTransport(cfg Config) (*SendGridTransport, error) {
+	if cfg.EmailAPIKey == "" {
+		return nil, errors.New("sendgrid api: missing api key")
+	}
+	api, err := newAPIClient("sendgrid", cmp.Or(cfg.EmailAPIURL, sendGridURL))
+	if err != nil {
+		return nil, err
+	}
+	return &SendGridTransport{api: api, apiKey: cfg.EmailAPIKey}, nil
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to,omitempty"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+type sendGridErrors struct {
+	Errors []struct {
+		Message string `json:"message"`
+		Field   string `json:"field"`
+	} `json:"errors"`
+}
+
+func sendGridAddresses(addrs []*mail.Address) []sendGridAddress {
+	list := make([]sendGridAddress, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, sendGridAddress{Email: addr.Address, Name: addr.Name})
+	}
+	return list
+}
+
+// sendGridRecipients returns the personalization of the To, Cc and Bcc
+// recipients, in which SendGrid rejects addresses that appear more than once,
+// even across lists. Each address is only kept in the first list it appears in.
+func sendGridRecipients(msg *apiMessage) sendGridPersonalization {
+	seen := map[string]bool{}
+	unique := func(addrs []*mail.Address) []sendGridAddress {
+		var list []*mail.Address
+		for _, addr := range addrs {
+			key := strings.ToLower(addr.Address)
+			if !seen[key] {
+				seen[key] = true
+				list = append(list, addr)
+			}
+		}
+		return sendGridAddresses(list)
+	}
+	return sendGridPersonalization{To: unique(msg.To), Cc: unique(msg.Cc), Bcc: unique(msg.Bcc)}
+}
+
+// Send delivers the message to its To, Cc and Bcc recipients.
+func (t *SendGridTransport) Send(ctx context.Context, emailMsg *email.Email) error {
+	msg, err := newAPIMessage(emailMsg)
+	if err != nil {
+		return fmt.Errorf("sendgrid api: %w", err)
+	}
+
+	body := sendGridMessage{
+		Personalizations: []sendGridPersonalization{sendGridRecipients(msg)},
+		From:             sendGridAddress{Email: msg.From.Address, Name: msg.From.Name},
+		ReplyToList:      sendGridAddresses(msg.ReplyTo),
+		Subject:          msg.Subject,
+	}
+	// The text part must come before the HTML part.
+	if msg.Text != "" {
+		body.Content = append(body.Content, sendGridContent{Type: "text/plain", Value: msg.Text})
+	}
+	if msg.HTML != "" {
+		body.Content = append(body.Content, sendGridContent{Type: "text/html", Value: msg.HTML})
+	}
+	for _, header := range msg.Headers {
+		if slices.Contains(sendGridReservedHeaders, header[0]) {
+			continue
+		}
+		if body.Headers == nil {
+			body.Headers = map[string]string{}
+		}
+		body.Headers[header[0]] = header[1]
+	}
+	for _, a := range msg.Attachments {
+		attachment := sendGridAttachment{Content: a.Content, Type: a.ContentType, Filename: a.Filename, Disposition: "attachment"}
+		if a.ContentID != "" {
+			attachment.Disposition, attachment.ContentID = "inline", a.ContentID
+		}
+		body.Attachments = append(body.Attachments, attachment)
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("sendgrid api: %w", err)
+	}
+	req, err := t.api.newRequest(ctx, http.MethodPost, "/v3/mail/send", payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = t.api.do(req, sendGridError)
+	return err
+}
+
+// Check verifies that the API key is allowed to send mail.
+func (t *SendGridTransport) Check(ctx context.Context) error {
+	req, err := t.api.newRequest(ctx, http.MethodGet, "/v3/scopes", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	body, err := t.api.do(req, sendGridError)
+	if err != nil {
+		return err
+	}
+	var scopes struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.Unmarshal(body, &scopes); err != nil {
+		return fmt.Errorf("sendgrid api: %w", err)
+	}
+	if !slices.Contains(scopes.Scopes, "mail.send") {
+		return errors.New("sendgrid api: api key is not allowed to send mail")
+	}
+	return nil
+}
+
+func (t *SendGridTransport) Close() {}
+
+// sendGridError classifies the bad requests and payloads that are too large
+// as permanent.
+func sendGridError(resp *http.Response, body []byte) *apiError {
+	apiErr := &apiError{permanent: resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge}
+	var errs sendGridErrors
+	if json.Unmarshal(body, &errs) == nil {
+		var messages []string
+		for _, e := range errs.Errors {
+			messages = append(messages, e.Message)
+		}
+		apiErr.message = strings.Join(messages, "; ")
+	}
+	return apiErr
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSendGridAPI starts a stand-in of the SendGrid v3 API that accepts the
+// API key "SG.test" and rejects recipients in the invalid domain, as well as
+// personalizations that list an address more than once.
+func startSendGridAPI(t *testing.T) *apiServer {
+	t.Helper()
+	return startAPIServer(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if r.Header.Get("Authorization") != "Bearer SG.test" {
+			writeJSON(w, http.StatusUnauthorized, `{"errors":[{"message":"The provided authorization grant is invalid, expired, or revoked"}]}`)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v3/scopes":
+			writeJSON(w, http.StatusOK, `{"scopes":["mail.send","user.profile.read"]}`)
+		case "POST /v3/mail/send":
+			if strings.Contains(string(body), "@invalid") {
+				writeJSON(w, http.StatusBadRequest, `{"errors":[{"message":"Does not contain a valid address.","field":"personalizations.0.to.0.email"}]}`)
+				return
+			}
+			var msg sendGridMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			seen := map[string]bool{}
+			for _, p := range msg.Personalizations {
+				for _, addr := range slices.Concat(p.To, p.Cc, p.Bcc) {
+					if seen[strings.ToLower(addr.Email)] {
+						writeJSON(w, http.StatusBadRequest, `{"errors":[{"message":"Each email address in the personalization block should be unique between to, cc, and bcc. We found the first duplicate instance of [`+addr.Email+`] in the personalizations.0.cc field.","field":"personalizations.0"}]}`)
+						return
+					}
+					seen[strings.ToLower(addr.Email)] = true
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func newSendGridTransport(t *testing.T, api *apiServer) *SendGridTransport {
+	t.Helper()
+	transport, err := NewSendGridTransport(Config{EmailAPIKey: "SG.test", EmailAPIURL: api.URL})
+	require.NoError(t, err)
+	return transport
+}
+
+func TestSendGridTransport_Send(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		api := startSendGridAPI(t)
+		transport := newSendGridTransport(t, api)
+
+		require.NoError(t, transport.Send(t.Context(), testAPIEmail()))
+
+		requests := api.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "application/json", requests[0].Header.Get("Content-Type"))
+		var msg sendGridMessage
+		require.NoError(t, json.Unmarshal(requests[0].Body, &msg))
+		assert.Equal(t, sendGridMessage{
+			Personalizations: []sendGridPersonalization{{
+				To:  []sendGridAddress{{Email: "alice@example.com", Name: "Alice"}},
+				Cc:  []sendGridAddress{{Email: "team@example.com"}},
+				Bcc: []sendGridAddress{{Email: "audit@example.com"}},
+			}},
+			From:        sendGridAddress{Email: "ci@example.com", Name: "Drone CI"},
+			ReplyToList: []sendGridAddress{{Email: "noreply@example.com"}},
+			Subject:     "Build #1 failed",
+			Content: []sendGridContent{
+				{Type: "text/plain", Value: "Build #1 failed"},
+				{Type: "text/html", Value: `<p>Build #1 failed</p><img src="cid:logo.png">`},
+			},
+			Headers: map[string]string{"Message-Id": "<build-1@example.com>", "X-Drone-Repo": "octocat/hello-world"},
+			Attachments: []sendGridAttachment{
+				{Content: "cG5n", Type: "image/png", Filename: "logo.png", Disposition: "inline", ContentID: "logo.png"},
+				{Content: "bWFrZTogKioqIFt0ZXN0XSBFcnJvciAx", Type: "text/plain; charset=utf-8", Filename: "build.log", Disposition: "attachment"},
+			},
+		}, msg)
+	})
+
+	t.Run("duplicate recipients", func(t *testing.T) {
+		t.Parallel()
+		api := startSendGridAPI(t)
+		transport := newSendGridTransport(t, api)
+		emailMsg := testAPIEmail()
+		emailMsg.Cc = append(emailMsg.Cc, "ALICE@example.com", "team@example.com")
+		emailMsg.Bcc = append(emailMsg.Bcc, "Alice <alice@example.com>")
+
+		require.NoError(t, transport.Send(t.Context(), emailMsg))
+
+		requests := api.Requests()
+		require.Len(t, requests, 1)
+		var msg sendGridMessage
+		require.NoError(t, json.Unmarshal(requests[0].Body, &msg))
+		assert.Equal(t, []sendGridPersonalization{{
+			To:  []sendGridAddress{{Email: "alice@example.com", Name: "Alice"}},
+			Cc:  []sendGridAddress{{Email: "team@example.com"}},
+			Bcc: []sendGridAddress{{Email: "audit@example.com"}},
+		}}, msg.Personalizations)
+	})
+
+	t.Run("invalid recipient", func(t *testing.T) {
+		t.Parallel()
+		transport := newSendGridTransport(t, startSendGridAPI(t))
+
+		err := transport.Send(t.Context(), rejectedEmail())
+
+		require.EqualError(t, err, "sendgrid api: 400: Does not contain a valid address.")
+		assert.True(t, isPermanent(err))
+	})
+
+	t.Run("invalid api key", func(t *testing.T) {
+		t.Parallel()
+		api := startSendGridAPI(t)
+		transport, err := NewSendGridTransport(Config{EmailAPIKey: "SG.wrong", EmailAPIURL: api.URL})
+		require.NoError(t, err)
+
+		err = transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "sendgrid api: 401")
+		assert.False(t, isPermanent(err))
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		transport := newSendGridTransport(t, api)
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.EqualError(t, err, "sendgrid api: 500: Internal Server Error")
+		assert.False(t, isPermanent(err))
+		assert.Equal(t, "api_5xx", deliveryFailureReason(err))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		t.Parallel()
+		api := startSendGridAPI(t)
+		transport := newSendGridTransport(t, api)
+		api.Close()
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "sendgrid api: Post")
+		assert.False(t, isPermanent(err))
+		assert.Equal(t, "connection", deliveryFailureReason(err))
+	})
+}
+
+func TestSendGridTransport_Check(t *testing.T) {
+	t.Run("mail send scope", func(t *testing.T) {
+		t.Parallel()
+		assert.NoError(t, newSendGridTransport(t, startSendGridAPI(t)).Check(t.Context()))
+	})
+
+	t.Run("missing scope", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			writeJSON(w, http.StatusOK, `{"scopes":["user.profile.read"]}`)
+		})
+
+		err := newSendGridTransport(t, api).Check(t.Context())
+
+		assert.EqualError(t, err, "sendgrid api: api key is not allowed to send mail")
+	})
+}
+
+func TestNewSendGridTransport(t *testing.T) {
+	t.Parallel()
+	_, err := NewSendGridTransport(Config{})
+	assert.ErrorContains(t, err, "missing api key")
+}
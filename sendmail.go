@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+const (
+	sendmailTimeout   = 30 * time.Second
+	sendmailMaxOutput = 4 << 10
+)
+
+// sendmailPermanentExitCodes are the sysexits(3) codes of a message that
+// cannot be delivered as is: EX_DATAERR, EX_NOUSER and EX_NOHOST. The other
+// ones, such as EX_TEMPFAIL or a missing binary, are retried.
+var sendmailPermanentExitCodes = []int{65, 67, 68}
+
+// SendmailTransport delivers messages by piping them to a sendmail compatible
+// binary, such as the one of a local MTA.
+type SendmailTransport struct {
+	path    string
+	args    []string
+	timeout time.Duration
+	dkim    *DKIMSigner
+}
+
+func NewSendmailTransport(cfg Config) (*SendmailTransport, error) {
+	if cfg.EmailSendmailPath == "" {
+		return nil, errors.New("sendmail: missing path")
+	}
+	signer, err := NewDKIMSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("sendmail: %w", err)
+	}
+	return &SendmailTransport{path: cfg.EmailSendmailPath, args: cfg.EmailSendmailArgs, timeout: sendmailTimeout, dkim: signer}, nil
+}
+
+// sendmailError is a failed run of the sendmail binary, with what it printed.
+type sendmailError struct {
+	err       error
+	output    string
+	permanent bool
+}
+
+func (e *sendmailError) Error() string {
+	if e.output == "" {
+		return "sendmail: " + e.err.Error()
+	}
+	return "sendmail: " + e.err.Error() + ": " + e.output
+}
+
+func (e *sendmailError) Unwrap() error {
+	return e.err
+}
+
+// Send delivers the message to its To, Cc and Bcc recipients, which are passed
+// as arguments after the configured ones along with the envelope sender, since
+// the message has no Bcc header.
+func (t *SendmailTransport) Send(ctx context.Context, emailMsg *email.Email) error {
+	from, to, err := envelope(emailMsg)
+	if err != nil {
+		return fmt.Errorf("sendmail: %w", err)
+	}
+	msg, err := messageBytes(emailMsg, t.dkim)
+	if err != nil {
+		return fmt.Errorf("sendmail: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	args := append(slices.Clone(t.args), "-f", from, "--")
+	cmd := exec.CommandContext(ctx, t.path, append(args, to...)...)
+	cmd.Stdin = bytes.NewReader(msg)
+	var output limitedBuffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		permanent := errors.As(err, &exitErr) && slices.Contains(sendmailPermanentExitCodes, exitErr.ExitCode())
+		return &sendmailError{err: err, output: strings.TrimSpace(output.String()), permanent: permanent}
+	}
+	return nil
+}
+
+// Check verifies that the sendmail binary exists and is executable.
+func (t *SendmailTransport) Check(context.Context) error {
+	if _, err := exec.LookPath(t.path); err != nil {
+		return &sendmailError{err: err}
+	}
+	return nil
+}
+
+func (t *SendmailTransport) Close() {}
+
+// limitedBuffer keeps the first sendmailMaxOutput bytes written to it, so that
+// a chatty binary cannot fill the memory or the logs. The buffer is not
+// embedded, since io.Copy would bypass Write with its ReadFrom method.
+type limitedBuffer struct {
+	buf bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := sendmailMaxOutput - b.buf.Len(); n > 0 {
+		b.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSendmail writes an executable shell script standing in for the
+// sendmail binary and returns its path. The script records its arguments and
+// the message it reads in the args and message files next to it.
+func writeSendmail(t *testing.T, body string) string {
+	t.Helper()
+	path := writeFile(t, "sendmail", "#!/bin/sh\n"+
+		`dir=$(dirname "$0")`+"\n"+
+		`printf '%s\n' "$@" > "$dir/args"`+"\n"+
+		`cat > "$dir/message"`+"\n"+
+		body)
+	require.NoError(t, os.Chmod(path, 0o700))
+	return path
+}
+
+func newSendmailTransport(t *testing.T, path string, args ...string) *SendmailTransport {
+	t.Helper()
+	transport, err := NewSendmailTransport(Config{EmailSendmailPath: path, EmailSendmailArgs: args})
+	require.NoError(t, err)
+	return transport
+}
+
+func TestSendmailTransport_Send(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		path := writeSendmail(t, "")
+		transport := newSendmailTransport(t, path, "-i", "-C", "/etc/msmtprc")
+
+		require.NoError(t, transport.Send(t.Context(), testAPIEmail()))
+
+		args, err := os.ReadFile(filepath.Join(filepath.Dir(path), "args"))
+		require.NoError(t, err)
+		assert.Equal(t, "-i\n-C\n/etc/msmtprc\n-f\nci@example.com\n--\nalice@example.com\nteam@example.com\naudit@example.com\n", string(args))
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), "message"))
+		require.NoError(t, err)
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, "Build #1 failed", msg.Header.Get("Subject"))
+		assert.Equal(t, "<build-1@example.com>", msg.Header.Get("Message-Id"))
+		assert.Empty(t, msg.Header.Get("Bcc"))
+	})
+
+	t.Run("permanent failure", func(t *testing.T) {
+		t.Parallel()
+		transport := newSendmailTransport(t, writeSendmail(t, "echo 'unknown@invalid... User unknown' >&2\nexit 67\n"))
+
+		err := transport.Send(t.Context(), rejectedEmail())
+
+		require.EqualError(t, err, "sendmail: exit status 67: unknown@invalid... User unknown")
+		assert.True(t, isPermanent(err))
+		assert.Equal(t, "sendmail", deliveryFailureReason(err))
+	})
+
+	t.Run("temporary failure", func(t *testing.T) {
+		t.Parallel()
+		transport := newSendmailTransport(t, writeSendmail(t, "echo 'queue directory is not writable' >&2\nexit 75\n"))
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.EqualError(t, err, "sendmail: exit status 75: queue directory is not writable")
+		assert.False(t, isPermanent(err))
+	})
+
+	t.Run("long output", func(t *testing.T) {
+		t.Parallel()
+		transport := newSendmailTransport(t, writeSendmail(t, "yes error | head -c 100000 >&2\nexit 1\n"))
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "sendmail: exit status 1: error\nerror\n")
+		assert.LessOrEqual(t, len(err.Error()), len("sendmail: exit status 1: ")+sendmailMaxOutput)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		transport := newSendmailTransport(t, writeSendmail(t, "exec sleep 10\n"))
+		transport.timeout = 100 * time.Millisecond
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.False(t, isPermanent(err))
+	})
+
+	t.Run("missing binary", func(t *testing.T) {
+		t.Parallel()
+		transport := newSendmailTransport(t, filepath.Join(t.TempDir(), "sendmail"))
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "sendmail: ")
+		assert.False(t, isPermanent(err))
+	})
+}
+
+func TestSendmailTransport_Check(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, newSendmailTransport(t, writeSendmail(t, "")).Check(t.Context()))
+
+	err := newSendmailTransport(t, writeFile(t, "sendmail", "")).Check(t.Context())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "sendmail: "))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// sesPermanentErrors are the SES error types that reject the message itself.
+// The other ones, such as an unverified sender, paused sending or throttling,
+// are fixed on the AWS side or over time.
+var sesPermanentErrors = []string{"BadRequestException", "MessageRejected"}
+
+// SESTransport delivers raw messages with the Amazon SES v2 API, so that the
+// message is sent exactly as it was rendered. Requests are signed with AWS
+// Signature Version 4 and static credentials, which default to the standard
+// AWS_* variables.
+type SESTransport struct {
+	api    *apiClient
+	region string
+	creds  awsCredentials
+	dkim   *DKIMSigner
+	now    func() time.Time
+}
+
+type awsCredentials struct {
+	accessKeyID  string
+	secretKey    string
+	sessionToken string
+}
+
+func NewSESTransport(cfg Config) (*SESTransport, error) {
+	t := &SESTransport{
+		region: cmp.Or(cfg.EmailSESRegion, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+		creds: awsCredentials{
+			accessKeyID:  cmp.Or(cfg.EmailSESAccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+			secretKey:    cmp.Or(cfg.EmailSESSecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			sessionToken: cmp.Or(cfg.EmailSESSessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+		},
+		now: time.Now,
+	}
+	if t.region == "" {
+		return nil, errors.New("ses api: missing region")
+	}
+	if t.creds.accessKeyID == "" || t.creds.secretKey == "" {
+		return nil, errors.New("ses api: missing access key id or secret access key")
+	}
+	api, err := newAPIClient("ses", cmp.Or(cfg.EmailAPIURL, "https://email."+t.region+".amazonaws.com"))
+	if err != nil {
+		return nil, err
+	}
+	t.api = api
+	if t.dkim, err = NewDKIMSigner(cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type sesDestination struct {
+	ToAddresses []string `json:"ToAddresses"`
+}
+
+type sesMessage struct {
+	FromEmailAddress string         `json:"FromEmailAddress"`
+	Destination      sesDestination `json:"Destination"`
+	Content          struct {
+		Raw struct {
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+}
+
+// Send delivers the message to its To, Cc and Bcc recipients.
+func (t *SESTransport) Send(ctx context.Context, emailMsg *email.Email) error {
+	from, to, err := envelope(emailMsg)
+	if err != nil {
+		return fmt.Errorf("ses api: %w", err)
+	}
+	msg, err := messageBytes(emailMsg, t.dkim)
+	if err != nil {
+		return fmt.Errorf("ses api: %w", err)
+	}
+
+	body := sesMessage{FromEmailAddress: from, Destination: sesDestination{ToAddresses: to}}
+	body.Content.Raw.Data = msg
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("ses api: %w", err)
+	}
+	req, err := t.api.newRequest(ctx, http.MethodPost, "/v2/email/outbound-emails", payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.sign(req, payload)
+	_, err = t.api.do(req, sesError)
+	return err
+}
+
+// Check verifies that the credentials are valid and that sending is enabled
+// for the account.
+func (t *SESTransport) Check(ctx context.Context) error {
+	req, err := t.api.newRequest(ctx, http.MethodGet, "/v2/email/account", nil)
+	if err != nil {
+		return err
+	}
+	t.sign(req, nil)
+	body, err := t.api.do(req, sesError)
+	if err != nil {
+		return err
+	}
+	var account struct {
+		SendingEnabled bool `json:"SendingEnabled"`
+	}
+	if err := json.Unmarshal(body, &account); err != nil {
+		return fmt.Errorf("ses api: %w", err)
+	}
+	if !account.SendingEnabled {
+		return errors.New("ses api: sending is disabled for the account")
+	}
+	return nil
+}
+
+func (t *SESTransport) Close() {}
+
+func (t *SESTransport) sign(req *http.Request, payload []byte) {
+	signAWSv4(req, payload, t.creds, t.region, "ses", t.now())
+}
+
+// signAWSv4 adds the AWS Signature Version 4 of the request, signing the host
+// and every header already set.
+func signAWSv4(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{req.Method, path, query, canonicalHeaders.String(), signedHeaders, sha256Hex(payload)}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sesError classifies the errors by their type, which SES returns in the
+// X-Amzn-Errortype header, such as "MessageRejected:http://...".
+func sesError(resp *http.Response, body []byte) *apiError {
+	errorType, _, _ := strings.Cut(resp.Header.Get("X-Amzn-Errortype"), ":")
+	apiErr := &apiError{code: errorType, permanent: slices.Contains(sesPermanentErrors, errorType)}
+	var errResp struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &errResp) == nil {
+		apiErr.message = errResp.Message
+	}
+	return apiErr
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSESAPI starts a stand-in of the Amazon SES v2 API that checks the
+// credential scope of the signature and rejects recipients in the invalid
+// domain.
+func startSESAPI(t *testing.T) *apiServer {
+	t.Helper()
+	return startAPIServer(t, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/eu-west-1/ses/aws4_request, ") {
+			w.Header().Set("X-Amzn-Errortype", "UnrecognizedClientException:http://internal.amazon.com/coral/com.amazon.coral.service/")
+			writeJSON(w, http.StatusForbidden, `{"message":"The security token included in the request is invalid."}`)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v2/email/account":
+			writeJSON(w, http.StatusOK, `{"SendingEnabled":true,"ProductionAccessEnabled":true}`)
+		case "POST /v2/email/outbound-emails":
+			var msg sesMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				w.Header().Set("X-Amzn-Errortype", "BadRequestException:")
+				writeJSON(w, http.StatusBadRequest, `{"message":"Invalid JSON"}`)
+				return
+			}
+			if slices.ContainsFunc(msg.Destination.ToAddresses, func(to string) bool { return strings.HasSuffix(to, "@invalid") }) {
+				w.Header().Set("X-Amzn-Errortype", "MessageRejected:")
+				writeJSON(w, http.StatusBadRequest, `{"message":"Email address is not verified."}`)
+				return
+			}
+			writeJSON(w, http.StatusOK, `{"MessageId":"0100018f3a3c8a1b-1"}`)
+		default:
+			w.Header().Set("X-Amzn-Errortype", "NotFoundException:")
+			writeJSON(w, http.StatusNotFound, `{"message":"Not found"}`)
+		}
+	})
+}
+
+func newSESTransport(t *testing.T, api *apiServer) *SESTransport {
+	t.Helper()
+	transport, err := NewSESTransport(Config{
+		EmailSESRegion:          "eu-west-1",
+		EmailSESAccessKeyID:     "AKIDEXAMPLE",
+		EmailSESSecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		EmailAPIURL:             api.URL,
+	})
+	require.NoError(t, err)
+	transport.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return transport
+}
+
+func TestSESTransport_Send(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		api := startSESAPI(t)
+		transport := newSESTransport(t, api)
+
+		require.NoError(t, transport.Send(t.Context(), testAPIEmail()))
+
+		requests := api.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "20240501T120000Z", requests[0].Header.Get("X-Amz-Date"))
+		assert.Contains(t, requests[0].Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date, ")
+		var msg sesMessage
+		require.NoError(t, json.Unmarshal(requests[0].Body, &msg))
+		assert.Equal(t, "ci@example.com", msg.FromEmailAddress)
+		assert.Equal(t, []string{"alice@example.com", "team@example.com", "audit@example.com"}, msg.Destination.ToAddresses)
+		raw, err := mail.ReadMessage(bytes.NewReader(msg.Content.Raw.Data))
+		require.NoError(t, err)
+		assert.Equal(t, "Build #1 failed", raw.Header.Get("Subject"))
+		assert.Equal(t, "<build-1@example.com>", raw.Header.Get("Message-Id"))
+		assert.Empty(t, raw.Header.Get("Bcc"))
+	})
+
+	t.Run("message rejected", func(t *testing.T) {
+		t.Parallel()
+		transport := newSESTransport(t, startSESAPI(t))
+
+		err := transport.Send(t.Context(), rejectedEmail())
+
+		require.EqualError(t, err, "ses api: 400 MessageRejected: Email address is not verified.")
+		assert.True(t, isPermanent(err))
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		t.Parallel()
+		api := startSESAPI(t)
+		transport := newSESTransport(t, api)
+		transport.creds.accessKeyID = "AKIDOTHER"
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "ses api: 403 UnrecognizedClientException")
+		assert.False(t, isPermanent(err))
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			w.Header().Set("X-Amzn-Errortype", "TooManyRequestsException:")
+			writeJSON(w, http.StatusTooManyRequests, `{"message":"Maximum sending rate exceeded."}`)
+		})
+		transport := newSESTransport(t, api)
+
+		err := transport.Send(t.Context(), testEmail())
+
+		require.EqualError(t, err, "ses api: 429 TooManyRequestsException: Maximum sending rate exceeded.")
+		assert.False(t, isPermanent(err))
+	})
+}
+
+func TestSESTransport_Check(t *testing.T) {
+	t.Run("sending enabled", func(t *testing.T) {
+		t.Parallel()
+		assert.NoError(t, newSESTransport(t, startSESAPI(t)).Check(t.Context()))
+	})
+
+	t.Run("sending paused", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			writeJSON(w, http.StatusOK, `{"SendingEnabled":false}`)
+		})
+
+		err := newSESTransport(t, api).Check(t.Context())
+
+		assert.EqualError(t, err, "ses api: sending is disabled for the account")
+	})
+}
+
+func TestSignAWSv4(t *testing.T) {
+	t.Run("get vanilla", func(t *testing.T) {
+		t.Parallel()
+		// The get-vanilla case of the AWS Signature Version 4 test suite.
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		require.NoError(t, err)
+		creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+		signAWSv4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+		assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+	})
+
+	t.Run("session token", func(t *testing.T) {
+		t.Parallel()
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		require.NoError(t, err)
+		creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretKey: "secret", sessionToken: "token"}
+
+		signAWSv4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+		assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+		assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token, ")
+	})
+}
+
+func TestNewSESTransport(t *testing.T) {
+	t.Run("aws environment", func(t *testing.T) {
+		t.Setenv("AWS_REGION", "us-east-2")
+		t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		t.Setenv("AWS_SESSION_TOKEN", "token")
+
+		transport, err := NewSESTransport(Config{})
+
+		require.NoError(t, err)
+		assert.Equal(t, "us-east-2", transport.region)
+		assert.Equal(t, awsCredentials{accessKeyID: "AKIDEXAMPLE", secretKey: "secret", sessionToken: "token"}, transport.creds)
+		assert.Equal(t, "https://email.us-east-2.amazonaws.com", transport.api.baseURL.String())
+	})
+
+	t.Run("missing settings", func(t *testing.T) {
+		t.Setenv("AWS_REGION", "")
+		t.Setenv("AWS_DEFAULT_REGION", "")
+		t.Setenv("AWS_ACCESS_KEY_ID", "")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+		_, err := NewSESTransport(Config{})
+		require.ErrorContains(t, err, "missing region")
+
+		_, err = NewSESTransport(Config{EmailSESRegion: "eu-west-1"})
+		require.ErrorContains(t, err, "missing access key id or secret access key")
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/httpsignatures-go"
+)
+
+// replayCacheSize bounds the number of recently seen requests that are
+// remembered to reject replays. The oldest ones are forgotten first.
+const replayCacheSize = 10000
+
+var (
+	errMissingSignature = errors.New("invalid or missing signature")
+	errInvalidSignature = errors.New("invalid signature")
+	errStaleRequest     = errors.New("request date outside of the allowed clock skew")
+	errDigestMismatch   = errors.New("request digest does not match the body")
+	errReplayedRequest  = errors.New("request has already been received")
+
+	digestAlgorithms = map[string]func() hash.Hash{
+		"SHA-256": sha256.New,
+		"SHA-512": sha512.New,
+	}
+)
+
+// WebhookVerifier authenticates webhook requests by their HTTP signature,
+// accepting any of the configured secrets, and rejects requests that are too
+// old, whose body does not match their signed digest, or that were already
+// received. The signature must cover the Digest header, and the Date header
+// unless the clock skew check is disabled.
+type WebhookVerifier struct {
+	secrets []string
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	seen  map[[sha256.Size]byte]time.Time
+	order [][sha256.Size]byte
+}
+
+func NewWebhookVerifier(cfg Config) *WebhookVerifier {
+	return &WebhookVerifier{
+		secrets: append([]string{cfg.Secret}, cfg.PreviousSecrets...),
+		maxSkew: cfg.SignatureMaxSkew,
+		now:     time.Now,
+		seen:    make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// Verify checks the signature of the request and its body, and records it so
+// that it cannot be replayed. A request that could not be handled is
+// forgotten with Forget, so that Drone can retry it.
+func (v *WebhookVerifier) Verify(r *http.Request, body []byte) error {
+	signature, err := httpsignatures.FromRequest(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errMissingSignature, err)
+	}
+	// The date bounds the time a signature can be replayed after the replay
+	// cache forgot it, and the digest ties the signature to the body, without
+	// which a signed request could be replayed with another body.
+	if v.maxSkew > 0 && !slices.Contains(signature.Headers, "date") {
+		return fmt.Errorf("%w: date is not signed", errStaleRequest)
+	}
+	if !slices.Contains(signature.Headers, "digest") {
+		return fmt.Errorf("%w: digest is not signed", errDigestMismatch)
+	}
+	if !slices.ContainsFunc(v.secrets, func(secret string) bool { return secret != "" && signature.IsValid(secret, r) }) {
+		return errInvalidSignature
+	}
+
+	now := v.now()
+	if v.maxSkew > 0 {
+		date, err := parseDate(r.Header.Get("Date"))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errStaleRequest, err)
+		}
+		if skew := now.Sub(date); skew > v.maxSkew || skew < -v.maxSkew {
+			return fmt.Errorf("%w: %s", errStaleRequest, skew.Round(time.Second))
+		}
+	}
+
+	if err := verifyDigest(r.Header.Get("Digest"), body); err != nil {
+		return err
+	}
+
+	if !v.remember(replayKey(signature, body), now) {
+		return errReplayedRequest
+	}
+	return nil
+}
+
+// remember records a request and returns false if it was already seen. Entries
+// are kept for twice the allowed skew, after which the date check rejects the
+// request anyway.
+func (v *WebhookVerifier) remember(key [sha256.Size]byte, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for len(v.order) > 0 {
+		oldest := v.order[0]
+		if len(v.order) < replayCacheSize && (v.maxSkew <= 0 || now.Before(v.seen[oldest])) {
+			break
+		}
+		delete(v.seen, oldest)
+		v.order = v.order[1:]
+	}
+
+	if _, ok := v.seen[key]; ok {
+		return false
+	}
+	v.seen[key] = now.Add(2 * v.maxSkew)
+	v.order = append(v.order, key)
+	return true
+}
+
+// Forget removes a verified request from the ones already received, once its
+// handling failed with a server error that Drone retries.
+func (v *WebhookVerifier) Forget(r *http.Request, body []byte) {
+	signature, err := httpsignatures.FromRequest(r)
+	if err != nil {
+		return
+	}
+	key := replayKey(signature, body)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.seen[key]; ok {
+		delete(v.seen, key)
+		v.order = slices.DeleteFunc(v.order, func(k [sha256.Size]byte) bool { return k == key })
+	}
+}
+
+func replayKey(signature *httpsignatures.Signature, body []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(signature.Signature+"\x00"), body...))
+}
+
+// parseDate parses the Date header, which httpsignatures-go fills in as RFC 1123
+// in the local time zone of the sender rather than in GMT.
+func parseDate(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return http.ParseTime(value) //nolint:wrapcheck // wrapped by the caller
+}
+
+// verifyDigest checks an RFC 3230 Digest header, such as SHA-256=<base64>,
+// against the body.
+func verifyDigest(header string, body []byte) error {
+	for digest := range strings.SplitSeq(header, ",") {
+		algorithm, value, ok := strings.Cut(strings.TrimSpace(digest), "=")
+		if !ok {
+			continue
+		}
+		newHash, ok := digestAlgorithms[strings.ToUpper(algorithm)]
+		if !ok {
+			continue
+		}
+		h := newHash()
+		h.Write(body)
+		expected := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if subtle.ConstantTimeCompare([]byte(value), []byte(expected)) != 1 {
+			return errDigestMismatch
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unsupported digest %q", errDigestMismatch, header)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/99designs/httpsignatures-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var digestSigner = httpsignatures.NewSigner(httpsignatures.AlgorithmHmacSha256, httpsignatures.RequestTarget, "date", "digest")
+
+func signedRequest(t *testing.T, signer *httpsignatures.Signer, secret string, date time.Time, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(body)))
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	sum := sha256.Sum256([]byte(body))
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	require.NoError(t, signer.SignRequest("test-key-id", secret, req))
+	return req
+}
+
+func TestWebhookVerifier_Verify(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	newVerifier := func() *WebhookVerifier {
+		verifier := NewWebhookVerifier(Config{Secret: "test-secret", PreviousSecrets: []string{"old-secret"}, SignatureMaxSkew: 5 * time.Minute})
+		verifier.now = func() time.Time { return now }
+		return verifier
+	}
+
+	t.Run("secrets", func(t *testing.T) {
+		t.Parallel()
+		verifier := newVerifier()
+
+		assert.NoError(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now, "{}"), []byte("{}")))
+		assert.NoError(t, verifier.Verify(signedRequest(t, digestSigner, "old-secret", now, "{}"), []byte("{}")))
+		assert.ErrorIs(t, verifier.Verify(signedRequest(t, digestSigner, "invalid-secret", now, "{}"), []byte("{}")), errInvalidSignature)
+	})
+
+	t.Run("empty previous secret", func(t *testing.T) {
+		t.Parallel()
+		verifier := NewWebhookVerifier(Config{Secret: "test-secret", PreviousSecrets: []string{""}})
+
+		assert.ErrorIs(t, verifier.Verify(signedRequest(t, digestSigner, "", time.Now(), "{}"), []byte("{}")), errInvalidSignature)
+	})
+
+	t.Run("missing signature", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+
+		assert.ErrorIs(t, newVerifier().Verify(req, nil), errMissingSignature)
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		t.Parallel()
+		verifier := newVerifier()
+
+		assert.NoError(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now.Add(-5*time.Minute), "{}"), []byte("{}")))
+		assert.NoError(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now.Add(5*time.Minute), "{}"), []byte("{}")))
+		assert.ErrorIs(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now.Add(-6*time.Minute), "{}"), []byte("{}")), errStaleRequest)
+		assert.ErrorIs(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now.Add(6*time.Minute), "{}"), []byte("{}")), errStaleRequest)
+	})
+
+	t.Run("local time zone", func(t *testing.T) {
+		t.Parallel()
+		req := signedRequest(t, digestSigner, "test-secret", now, "{}")
+		req.Header.Set("Date", now.In(time.FixedZone("CEST", 2*60*60)).Format(time.RFC1123Z))
+		req.Header.Del("Signature")
+		require.NoError(t, digestSigner.SignRequest("test-key-id", "test-secret", req))
+
+		assert.NoError(t, newVerifier().Verify(req, []byte("{}")))
+	})
+
+	t.Run("skew disabled", func(t *testing.T) {
+		t.Parallel()
+		verifier := NewWebhookVerifier(Config{Secret: "test-secret"})
+
+		assert.NoError(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now, "{}"), []byte("{}")))
+	})
+
+	t.Run("digest", func(t *testing.T) {
+		t.Parallel()
+		verifier := newVerifier()
+
+		assert.NoError(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now, `{"a":1}`), []byte(`{"a":1}`)))
+		assert.ErrorIs(t, verifier.Verify(signedRequest(t, digestSigner, "test-secret", now, `{"a":2}`), []byte(`{"a":3}`)), errDigestMismatch)
+
+		req := signedRequest(t, digestSigner, "test-secret", now, "{}")
+		req.Header.Set("Digest", "MD5=mZFLkyvTelC5g8XnyQrpOw==")
+		req.Header.Del("Signature")
+		require.NoError(t, digestSigner.SignRequest("test-key-id", "test-secret", req))
+		assert.ErrorIs(t, verifier.Verify(req, []byte("{}")), errDigestMismatch)
+	})
+
+	t.Run("unsigned headers", func(t *testing.T) {
+		t.Parallel()
+		targetSigner := httpsignatures.NewSigner(httpsignatures.AlgorithmHmacSha256, httpsignatures.RequestTarget)
+		dateSigner := httpsignatures.NewSigner(httpsignatures.AlgorithmHmacSha256, httpsignatures.RequestTarget, "date")
+		digestOnlySigner := httpsignatures.NewSigner(httpsignatures.AlgorithmHmacSha256, httpsignatures.RequestTarget, "digest")
+		skewDisabled := NewWebhookVerifier(Config{Secret: "test-secret"})
+
+		assert.ErrorIs(t, newVerifier().Verify(signedRequest(t, targetSigner, "test-secret", now, "{}"), []byte("{}")), errStaleRequest)
+		assert.ErrorIs(t, newVerifier().Verify(signedRequest(t, digestOnlySigner, "test-secret", now, "{}"), []byte("{}")), errStaleRequest)
+		assert.ErrorIs(t, newVerifier().Verify(signedRequest(t, dateSigner, "test-secret", now, "{}"), []byte("{}")), errDigestMismatch)
+		assert.ErrorIs(t, skewDisabled.Verify(signedRequest(t, targetSigner, "test-secret", now, "{}"), []byte("{}")), errDigestMismatch)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		t.Parallel()
+		verifier := newVerifier()
+		req := signedRequest(t, digestSigner, "test-secret", now, "{}")
+
+		require.NoError(t, verifier.Verify(req, []byte("{}")))
+		assert.ErrorIs(t, verifier.Verify(req, []byte("{}")), errReplayedRequest)
+		assert.ErrorIs(t, verifier.Verify(req, []byte(`{"a":1}`)), errDigestMismatch)
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		t.Parallel()
+		verifier := newVerifier()
+		req := signedRequest(t, digestSigner, "test-secret", now, "{}")
+		require.NoError(t, verifier.Verify(req, []byte("{}")))
+
+		verifier.Forget(req, []byte("{}"))
+
+		assert.Empty(t, verifier.order)
+		require.NoError(t, verifier.Verify(req, []byte("{}")))
+		assert.ErrorIs(t, verifier.Verify(req, []byte("{}")), errReplayedRequest)
+	})
+
+	t.Run("replay cache", func(t *testing.T) {
+		t.Parallel()
+		verifier := newVerifier()
+		for i := range replayCacheSize + 1 {
+			verifier.remember(sha256.Sum256([]byte{byte(i), byte(i >> 8)}), now)
+		}
+		assert.Len(t, verifier.seen, replayCacheSize)
+
+		verifier.remember(sha256.Sum256([]byte("new")), now.Add(10*time.Minute))
+		assert.Len(t, verifier.seen, 1)
+	})
+}
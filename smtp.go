@@ -0,0 +1,226 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"golang.org/x/oauth2"
+)
+
+const smtpTimeout = 30 * time.Second
+
+var errSTARTTLSUnsupported = errors.New("server does not support STARTTLS")
+
+// SMTPRelay delivers messages to an SMTP relay, securing the connection as
+// configured by the TLS mode, over a pool of connections shared by all
+// deliveries.
+type SMTPRelay struct {
+	host      string
+	addr      string
+	username  string
+	password  string
+	auth      SMTPAuthMechanism
+	tokens    oauth2.TokenSource
+	tlsMode   SMTPTLSMode
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	pool      *smtpPool
+}
+
+func NewSMTPRelay(cfg Config) (*SMTPRelay, error) {
+	if err := validateSMTPAuth(cfg); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := smtpTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &SMTPRelay{
+		host:      cfg.EmailSMTPHost,
+		addr:      net.JoinHostPort(cfg.EmailSMTPHost, strconv.Itoa(int(cfg.EmailSMTPPort))),
+		username:  cfg.EmailSMTPUsername,
+		password:  cfg.EmailSMTPPassword,
+		auth:      cmp.Or(cfg.EmailSMTPAuth, SMTPAuthAuto),
+		tokens:    oauthTokenSource(cfg),
+		tlsMode:   cmp.Or(cfg.EmailSMTPTLS, SMTPTLSStartTLSOptional),
+		tlsConfig: tlsConfig,
+		timeout:   smtpTimeout,
+	}
+	r.pool = newSMTPPool(r.connect, int(cfg.EmailSMTPMaxConnections), cfg.EmailSMTPIdleTimeout, int(cfg.EmailSMTPMaxMessages), r.timeout)
+	return r, nil
+}
+
+// smtpTLSConfig returns the TLS config of the SMTP relay: the server name to
+// verify, the CA certificates to trust instead of the system ones, and the
+// client certificate to present, if any.
+func smtpTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cmp.Or(cfg.EmailSMTPServerName, cfg.EmailSMTPHost),
+		InsecureSkipVerify: cfg.EmailSMTPInsecureSkipVerify, //nolint:gosec // explicitly enabled by the operator
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.EmailSMTPCAFile != "" {
+		pem, err := os.ReadFile(cfg.EmailSMTPCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("smtp relay: read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("smtp relay: no certificates found in ca file %s", cfg.EmailSMTPCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.EmailSMTPClientCertFile != "" || cfg.EmailSMTPClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.EmailSMTPClientCertFile, cfg.EmailSMTPClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("smtp relay: load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// send delivers a message whose envelope has already been checked.
+func (r *SMTPRelay) send(ctx context.Context, from string, to []string, msg []byte) error {
+	c, err := r.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = transmit(c.client, from, to, msg)
+	r.pool.put(c, err)
+	return err
+}
+
+// transmit runs a mail transaction on an established session.
+func transmit(client *smtp.Client, from string, to []string, msg []byte) error {
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("smtp relay: mail from: %w", err)
+	}
+	for _, addr := range to {
+		if err := client.Rcpt(addr); err != nil {
+			return fmt.Errorf("smtp relay: rcpt to %s: %w", addr, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp relay: data: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp relay: data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp relay: data: %w", err)
+	}
+	return nil
+}
+
+// Check performs the handshake of a delivery on a new connection, without
+// sending any message.
+func (r *SMTPRelay) Check(ctx context.Context) error {
+	c, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.client.Quit(); err != nil {
+		_ = c.client.Close()
+		return fmt.Errorf("smtp relay: quit: %w", err)
+	}
+	return nil
+}
+
+// Close closes the idle connections to the relay.
+func (r *SMTPRelay) Close() {
+	r.pool.close()
+}
+
+// connect dials the relay and returns a client that has greeted the server,
+// secured the connection and authenticated as configured.
+func (r *SMTPRelay) connect(ctx context.Context) (*smtpConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if r.tlsMode == SMTPTLSImplicit {
+		dialer := &tls.Dialer{Config: r.tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("smtp relay: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, r.host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("smtp relay: %w", err)
+	}
+	if err := r.handshake(client); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	// The deadline only bounds the handshake; the rest of the session is
+	// bounded by the relay timeout from now on.
+	_ = conn.SetDeadline(time.Now().Add(r.timeout))
+	return &smtpConn{client: client, conn: conn}, nil
+}
+
+func (r *SMTPRelay) handshake(client *smtp.Client) error {
+	if err := client.Hello("localhost"); err != nil {
+		return fmt.Errorf("smtp relay: ehlo: %w", err)
+	}
+	if r.tlsMode == SMTPTLSStartTLSOptional || r.tlsMode == SMTPTLSStartTLSRequired {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(r.tlsConfig); err != nil {
+				return fmt.Errorf("smtp relay: starttls: %w", err)
+			}
+		} else if r.tlsMode == SMTPTLSStartTLSRequired {
+			return fmt.Errorf("smtp relay: %w", errSTARTTLSUnsupported)
+		}
+	}
+	return r.authenticate(client)
+}
+
+// envelope returns the envelope sender and recipients of the message.
+func envelope(emailMsg *email.Email) (string, []string, error) {
+	sender := emailMsg.Sender
+	if sender == "" {
+		sender = emailMsg.From
+	}
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return "", nil, &envelopeError{fmt.Errorf("invalid sender %q: %w", sender, err)}
+	}
+	var to []string
+	for _, list := range [][]string{emailMsg.To, emailMsg.Cc, emailMsg.Bcc} {
+		for _, rcpt := range list {
+			addr, err := mail.ParseAddress(rcpt)
+			if err != nil {
+				return "", nil, &envelopeError{fmt.Errorf("invalid recipient %q: %w", rcpt, err)}
+			}
+			to = append(to, addr.Address)
+		}
+	}
+	if len(to) == 0 {
+		return "", nil, &envelopeError{errors.New("no recipients")}
+	}
+	return from.Address, to, nil
+}
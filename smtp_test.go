@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trustTestCertificate makes the relay trust the test server certificate.
+func trustTestCertificate(t testing.TB) func(*Config) {
+	t.Helper()
+	caFile, _ := testCertificate().files(t)
+	return func(cfg *Config) {
+		cfg.EmailSMTPCAFile = caFile
+	}
+}
+
+func withTLSMode(mode SMTPTLSMode) func(*Config) {
+	return func(cfg *Config) {
+		cfg.EmailSMTPTLS = mode
+	}
+}
+
+func testEmail() *email.Email {
+	return &email.Email{
+		From:    "Drone CI <ci@example.com>",
+		To:      []string{"Alice <alice@example.com>"},
+		Cc:      []string{"team@example.com"},
+		Bcc:     []string{"audit@example.com"},
+		Subject: "Build #1 failed",
+		Text:    []byte("Build #1 failed"),
+	}
+}
+
+func TestSMTPRelay_Send(t *testing.T) {
+	t.Run("plain", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSNone)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.False(t, messages[0].TLS)
+		assert.Equal(t, "ci@example.com", messages[0].From)
+		assert.Equal(t, []string{"alice@example.com", "team@example.com", "audit@example.com"}, messages[0].To)
+		assert.Contains(t, messages[0].Data, "Subject: Build #1 failed")
+		assert.NotContains(t, messages[0].Data, "audit@example.com")
+	})
+
+	t.Run("starttls optional without starttls", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSOptional)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.False(t, messages[0].TLS)
+	})
+
+	t.Run("starttls optional", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSOptional), trustTestCertificate(t)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.True(t, messages[0].TLS)
+	})
+
+	t.Run("starttls required", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSRequired), trustTestCertificate(t)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.True(t, messages[0].TLS)
+		assert.Equal(t, "drone", messages[0].Auth)
+	})
+
+	t.Run("starttls required without starttls", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSRequired)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorIs(t, err, errSTARTTLSUnsupported)
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("implicit", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withImplicitTLS, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSImplicit), trustTestCertificate(t)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.True(t, messages[0].TLS)
+		assert.Equal(t, "drone", messages[0].Auth)
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withImplicitTLS)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSImplicit)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "certificate")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withImplicitTLS)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSImplicit), func(cfg *Config) {
+			cfg.EmailSMTPInsecureSkipVerify = true
+		}))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, server.Messages(), 1)
+	})
+
+	t.Run("server name", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSRequired), trustTestCertificate(t), func(cfg *Config) {
+			cfg.EmailSMTPServerName = "localhost"
+		}))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, server.Messages(), 1)
+	})
+
+	t.Run("server name mismatch", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSRequired), trustTestCertificate(t), func(cfg *Config) {
+			cfg.EmailSMTPServerName = "relay.example.com"
+		}))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "relay.example.com")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withImplicitTLS, withClientCertificate(testClientCertificate()))
+		certFile, keyFile := testClientCertificate().files(t)
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSImplicit), trustTestCertificate(t), func(cfg *Config) {
+			cfg.EmailSMTPClientCertFile = certFile
+			cfg.EmailSMTPClientKeyFile = keyFile
+		}))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "drone", messages[0].ClientCert)
+	})
+
+	t.Run("missing client certificate", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS, withClientCertificate(testClientCertificate()))
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSStartTLSRequired), trustTestCertificate(t)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.Error(t, err)
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("no recipients", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config())
+
+		err := relays.Send(t.Context(), &email.Email{From: "ci@example.com", Subject: "Build #1 failed"})
+
+		require.ErrorContains(t, err, "no recipients")
+		assert.Zero(t, server.Sessions())
+	})
+}
+
+func TestNewSMTPRelay(t *testing.T) {
+	t.Run("missing ca file", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewSMTPRelay(Config{EmailSMTPCAFile: filepath.Join(t.TempDir(), "ca.pem")})
+		assert.ErrorContains(t, err, "read ca file")
+	})
+
+	t.Run("invalid ca file", func(t *testing.T) {
+		t.Parallel()
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+
+		_, err := NewSMTPRelay(Config{EmailSMTPCAFile: caFile})
+
+		assert.ErrorContains(t, err, "no certificates found")
+	})
+
+	t.Run("client certificate without key", func(t *testing.T) {
+		t.Parallel()
+		certFile, _ := testClientCertificate().files(t)
+
+		_, err := NewSMTPRelay(Config{EmailSMTPClientCertFile: certFile})
+
+		assert.ErrorContains(t, err, "load client certificate")
+	})
+}
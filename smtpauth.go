@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+var (
+	errNoAuthMechanism     = errors.New("no usable auth mechanism")
+	errUnencryptedAuth     = errors.New("unencrypted connection")
+	errUnexpectedChallenge = errors.New("unexpected server challenge")
+)
+
+// saslName returns the name of the mechanism in the AUTH extension.
+func saslName(mechanism SMTPAuthMechanism) string {
+	return strings.ToUpper(string(mechanism))
+}
+
+// validateSMTPAuth checks that the credentials required by the configured
+// mechanism are set.
+func validateSMTPAuth(cfg Config) error {
+	if cfg.EmailSMTPOAuthTokenURL != "" && cfg.EmailSMTPOAuthClientID == "" {
+		return errors.New("smtp relay: oauth requires a client id")
+	}
+	switch cfg.EmailSMTPAuth {
+	case SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5:
+		if cfg.EmailSMTPUsername == "" || cfg.EmailSMTPPassword == "" {
+			return fmt.Errorf("smtp relay: %s auth requires a username and a password", cfg.EmailSMTPAuth)
+		}
+	case SMTPAuthXOAuth2, SMTPAuthOAuthBearer:
+		if cfg.EmailSMTPUsername == "" || cfg.EmailSMTPOAuthTokenURL == "" {
+			return fmt.Errorf("smtp relay: %s auth requires a username and an oauth token url", cfg.EmailSMTPAuth)
+		}
+	case SMTPAuthAuto, SMTPAuthNone:
+	}
+	return nil
+}
+
+// oauthTokenSource returns the source of the access tokens for XOAUTH2 and
+// OAUTHBEARER, or nil when OAuth is not configured. Tokens are obtained with
+// the refresh token when one is set, and with the client credentials
+// otherwise, and are reused until they expire.
+func oauthTokenSource(cfg Config) oauth2.TokenSource {
+	if cfg.EmailSMTPOAuthTokenURL == "" {
+		return nil
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: smtpTimeout})
+	if cfg.EmailSMTPOAuthRefreshToken != "" {
+		config := &oauth2.Config{
+			ClientID:     cfg.EmailSMTPOAuthClientID,
+			ClientSecret: cfg.EmailSMTPOAuthClientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: cfg.EmailSMTPOAuthTokenURL},
+			Scopes:       cfg.EmailSMTPOAuthScopes,
+		}
+		return config.TokenSource(ctx, &oauth2.Token{RefreshToken: cfg.EmailSMTPOAuthRefreshToken})
+	}
+	config := &clientcredentials.Config{
+		ClientID:     cfg.EmailSMTPOAuthClientID,
+		ClientSecret: cfg.EmailSMTPOAuthClientSecret,
+		TokenURL:     cfg.EmailSMTPOAuthTokenURL,
+		Scopes:       cfg.EmailSMTPOAuthScopes,
+	}
+	return config.TokenSource(ctx)
+}
+
+// authenticate authenticates with the configured mechanism, or with the first
+// one offered by the relay that fits the credentials when it is auto. With auto,
+// relays that do not offer AUTH are used without authentication.
+func (r *SMTPRelay) authenticate(client *smtp.Client) error {
+	if r.auth == SMTPAuthNone || r.username == "" {
+		return nil
+	}
+	supported, offered := client.Extension("AUTH")
+	mechanisms := strings.Fields(strings.ToUpper(offered))
+
+	mechanism := r.auth
+	switch {
+	case mechanism == SMTPAuthAuto:
+		if !supported || (r.password == "" && r.tokens == nil) {
+			return nil
+		}
+		var ok bool
+		if mechanism, ok = r.negotiate(client, mechanisms); !ok {
+			return fmt.Errorf("smtp relay: auth: %w, server offers %s", errNoAuthMechanism, offered)
+		}
+	case !supported:
+		return fmt.Errorf("smtp relay: auth: server does not support AUTH, %s is configured", saslName(mechanism))
+	case !slices.Contains(mechanisms, saslName(mechanism)):
+		return fmt.Errorf("smtp relay: auth: server does not support %s, it offers %s", saslName(mechanism), offered)
+	}
+
+	auth, err := r.smtpAuth(mechanism)
+	if err != nil {
+		return fmt.Errorf("smtp relay: auth: %s: %w", saslName(mechanism), err)
+	}
+	if err := client.Auth(auth); err != nil {
+		return fmt.Errorf("smtp relay: auth: %s: %w", saslName(mechanism), err)
+	}
+	return nil
+}
+
+// negotiate returns the preferred mechanism offered by the relay for the
+// credentials. Bearer tokens and passwords are only sent over TLS or to
+// localhost, so CRAM-MD5 is the only candidate on other plain connections.
+func (r *SMTPRelay) negotiate(client *smtp.Client, mechanisms []string) (SMTPAuthMechanism, bool) {
+	_, isTLS := client.TLSConnectionState()
+	secure := isTLS || isLocalhost(r.host)
+
+	var candidates []SMTPAuthMechanism
+	switch {
+	case r.tokens != nil && secure:
+		candidates = []SMTPAuthMechanism{SMTPAuthXOAuth2, SMTPAuthOAuthBearer}
+	case r.tokens != nil:
+	case secure:
+		candidates = []SMTPAuthMechanism{SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5}
+	default:
+		candidates = []SMTPAuthMechanism{SMTPAuthCRAMMD5}
+	}
+	for _, candidate := range candidates {
+		if slices.Contains(mechanisms, saslName(candidate)) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func (r *SMTPRelay) smtpAuth(mechanism SMTPAuthMechanism) (smtp.Auth, error) {
+	switch mechanism {
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", r.username, r.password, r.host), nil
+	case SMTPAuthLogin:
+		return &loginAuth{username: r.username, password: r.password}, nil
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(r.username, r.password), nil
+	case SMTPAuthXOAuth2, SMTPAuthOAuthBearer:
+		token, err := r.tokens.Token()
+		if err != nil {
+			return nil, fmt.Errorf("fetch oauth token: %w", err)
+		}
+		if mechanism == SMTPAuthXOAuth2 {
+			return &xoauth2Auth{username: r.username, token: token.AccessToken}, nil
+		}
+		host, port, _ := net.SplitHostPort(r.addr)
+		return &oauthBearerAuth{username: r.username, host: host, port: port, token: token.AccessToken}, nil
+	case SMTPAuthAuto, SMTPAuthNone:
+	}
+	return nil, fmt.Errorf("unsupported mechanism %q", mechanism)
+}
+
+// loginAuth implements the LOGIN mechanism, which sends the username and the
+// password in answer to the prompts of the server.
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencryptedAuth
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(string(fromServer)); {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnexpectedChallenge, fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism of Google and Microsoft.
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencryptedAuth
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the error challenge of a rejected token with an empty response,
+// after which the server fails the exchange.
+func (a *xoauth2Auth) Next(_ []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return []byte{}, nil
+}
+
+// gs2Escaper escapes the commas and equal signs of a saslname in a GS2 header,
+// see RFC 5801.
+var gs2Escaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+// oauthBearerAuth implements the OAUTHBEARER mechanism of RFC 7628.
+type oauthBearerAuth struct {
+	username string
+	host     string
+	port     string
+	token    string
+}
+
+func (a *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errUnencryptedAuth
+	}
+	resp := "n,a=" + gs2Escaper.Replace(a.username) + ",\x01host=" + a.host + "\x01port=" + a.port + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+// Next answers the error challenge of a rejected token with the dummy response
+// of RFC 7628, after which the server fails the exchange.
+func (a *oauthBearerAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return []byte("\x01"), nil
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
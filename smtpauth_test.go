@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tokenServer is a local OAuth2 token endpoint that issues a fixed access
+// token and records the grants it receives.
+type tokenServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	grants []string
+}
+
+func startTokenServer(t *testing.T, accessToken string) *tokenServer {
+	t.Helper()
+	s := &tokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.grants = append(s.grants, r.PostForm.Get("grant_type"))
+		s.mu.Unlock()
+		if clientID, _, _ := r.BasicAuth(); clientID != "drone" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) Grants() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.grants...)
+}
+
+// withOAuth points the relay at the token endpoint.
+func withOAuth(tokens *tokenServer, refreshToken string) func(*Config) {
+	return func(cfg *Config) {
+		cfg.EmailSMTPPassword = ""
+		cfg.EmailSMTPOAuthTokenURL = tokens.URL
+		cfg.EmailSMTPOAuthClientID = "drone"
+		cfg.EmailSMTPOAuthClientSecret = "client-secret"
+		cfg.EmailSMTPOAuthRefreshToken = refreshToken
+	}
+}
+
+func withAuthMechanism(mechanism SMTPAuthMechanism) func(*Config) {
+	return func(cfg *Config) {
+		cfg.EmailSMTPAuth = mechanism
+	}
+}
+
+func TestSMTPRelay_Auth(t *testing.T) {
+	t.Run("auto plain", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, server.config())
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "drone", messages[0].Auth)
+		assert.Equal(t, "PLAIN", messages[0].Mechanism)
+	})
+
+	t.Run("auto login", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS, withSMTPAuth("drone", "password123", "LOGIN", "CRAM-MD5"))
+		relays := newSMTPRelays(t, server.config(trustTestCertificate(t)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.True(t, messages[0].TLS)
+		assert.Equal(t, "LOGIN", messages[0].Mechanism)
+	})
+
+	t.Run("auto cram-md5", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123", "CRAM-MD5"))
+		relays := newSMTPRelays(t, server.config())
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "CRAM-MD5", messages[0].Mechanism)
+	})
+
+	t.Run("auto without auth", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(func(cfg *Config) {
+			cfg.EmailSMTPUsername = "drone"
+			cfg.EmailSMTPPassword = "password123"
+		}))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Empty(t, messages[0].Auth)
+	})
+
+	t.Run("auto without usable mechanism", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123", "GSSAPI"))
+		relays := newSMTPRelays(t, server.config())
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorIs(t, err, errNoAuthMechanism)
+		assert.ErrorContains(t, err, "server offers GSSAPI")
+	})
+
+	t.Run("login", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, server.config(withAuthMechanism(SMTPAuthLogin)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "LOGIN", messages[0].Mechanism)
+	})
+
+	t.Run("cram-md5 wrong password", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123", "CRAM-MD5"))
+		relays := newSMTPRelays(t, server.config(withAuthMechanism(SMTPAuthCRAMMD5), func(cfg *Config) {
+			cfg.EmailSMTPPassword = "wrong"
+		}))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "smtp relay: auth: CRAM-MD5: 535")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("mechanism not offered", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123", "PLAIN"))
+		relays := newSMTPRelays(t, server.config(withAuthMechanism(SMTPAuthLogin)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "server does not support LOGIN, it offers PLAIN")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("auth not offered", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withAuthMechanism(SMTPAuthPlain), func(cfg *Config) {
+			cfg.EmailSMTPUsername = "drone"
+			cfg.EmailSMTPPassword = "password123"
+		}))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "server does not support AUTH, PLAIN is configured")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("none", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, server.config(withAuthMechanism(SMTPAuthNone)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "530")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("xoauth2 client credentials", func(t *testing.T) {
+		t.Parallel()
+		tokens := startTokenServer(t, "access-token")
+		server := startSMTPServer(t, withSTARTTLS, withSMTPAuth("drone@example.com", "access-token", "PLAIN", "XOAUTH2"))
+		relays := newSMTPRelays(t, server.config(trustTestCertificate(t), withOAuth(tokens, "")))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 2)
+		assert.Equal(t, "drone@example.com", messages[0].Auth)
+		assert.Equal(t, "XOAUTH2", messages[0].Mechanism)
+		assert.Equal(t, []string{"client_credentials"}, tokens.Grants(), "tokens are reused until they expire")
+	})
+
+	t.Run("oauthbearer refresh token", func(t *testing.T) {
+		t.Parallel()
+		tokens := startTokenServer(t, "access-token")
+		server := startSMTPServer(t, withImplicitTLS, withSMTPAuth("drone@example.com", "access-token", "OAUTHBEARER"))
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSImplicit), trustTestCertificate(t), withOAuth(tokens, "refresh-token"), withAuthMechanism(SMTPAuthOAuthBearer)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "drone@example.com", messages[0].Auth)
+		assert.Equal(t, "OAUTHBEARER", messages[0].Mechanism)
+		assert.Equal(t, []string{"refresh_token"}, tokens.Grants())
+	})
+
+	t.Run("oauthbearer escaped username", func(t *testing.T) {
+		t.Parallel()
+		tokens := startTokenServer(t, "access-token")
+		server := startSMTPServer(t, withImplicitTLS, withSMTPAuth("ci,bot=1@example.com", "access-token", "OAUTHBEARER"))
+		relays := newSMTPRelays(t, server.config(withTLSMode(SMTPTLSImplicit), trustTestCertificate(t), withOAuth(tokens, "refresh-token"), withAuthMechanism(SMTPAuthOAuthBearer)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := server.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "ci,bot=1@example.com", messages[0].Auth)
+	})
+
+	t.Run("rejected token", func(t *testing.T) {
+		t.Parallel()
+		tokens := startTokenServer(t, "expired-token")
+		server := startSMTPServer(t, withSMTPAuth("drone@example.com", "access-token", "XOAUTH2"))
+		relays := newSMTPRelays(t, server.config(withOAuth(tokens, "")))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "smtp relay: auth: XOAUTH2: 535")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("token endpoint failure", func(t *testing.T) {
+		t.Parallel()
+		tokens := startTokenServer(t, "access-token")
+		server := startSMTPServer(t, withSMTPAuth("drone@example.com", "access-token", "XOAUTH2"))
+		relays := newSMTPRelays(t, server.config(withOAuth(tokens, ""), func(cfg *Config) {
+			cfg.EmailSMTPOAuthClientID = "unknown"
+		}))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "fetch oauth token")
+		assert.Empty(t, server.Messages())
+	})
+}
+
+func TestOAuthBearerAuth_Start(t *testing.T) {
+	auth := &oauthBearerAuth{username: "ci,bot=1@example.com", host: "smtp.example.com", port: "465", token: "access-token"}
+
+	mechanism, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+
+	require.NoError(t, err)
+	assert.Equal(t, "OAUTHBEARER", mechanism)
+	assert.Equal(t, "n,a=ci=2Cbot=3D1@example.com,\x01host=smtp.example.com\x01port=465\x01auth=Bearer access-token\x01\x01", string(resp))
+}
+
+func TestNewSMTPRelay_Auth(t *testing.T) {
+	t.Run("password mechanism without password", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewSMTPRelay(Config{EmailSMTPUsername: "drone", EmailSMTPAuth: SMTPAuthLogin})
+		assert.ErrorContains(t, err, "login auth requires a username and a password")
+	})
+
+	t.Run("oauth mechanism without token url", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewSMTPRelay(Config{EmailSMTPUsername: "drone", EmailSMTPAuth: SMTPAuthXOAuth2})
+		assert.ErrorContains(t, err, "xoauth2 auth requires a username and an oauth token url")
+	})
+
+	t.Run("oauth without client id", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewSMTPRelay(Config{EmailSMTPUsername: "drone", EmailSMTPOAuthTokenURL: "http://127.0.0.1/token"})
+		assert.ErrorContains(t, err, "oauth requires a client id")
+	})
+}
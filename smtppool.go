@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+const smtpQuitTimeout = 5 * time.Second
+
+// smtpConn is a connection to the SMTP relay that has completed the handshake.
+type smtpConn struct {
+	client    *smtp.Client
+	conn      net.Conn
+	messages  int
+	idleSince time.Time
+}
+
+// close says goodbye to the relay, or drops the connection when it does not
+// answer.
+func (c *smtpConn) close() {
+	_ = c.conn.SetDeadline(time.Now().Add(smtpQuitTimeout))
+	if err := c.client.Quit(); err != nil {
+		_ = c.client.Close()
+	}
+}
+
+// smtpPool shares connections to the SMTP relay between the email workers.
+// Idle connections are reused, most recent first, after an RSET confirms that
+// the relay still answers; they are closed once they have been idle for
+// idleTimeout or have carried maxMessages messages. At most maxConns
+// connections are open at once, and an idle timeout of zero disables reuse.
+type smtpPool struct {
+	dial        func(context.Context) (*smtpConn, error)
+	timeout     time.Duration
+	idleTimeout time.Duration
+	maxMessages int
+	now         func() time.Time
+
+	slots  chan struct{}
+	mu     sync.Mutex
+	idle   []*smtpConn
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSMTPPool(dial func(context.Context) (*smtpConn, error), maxConns int, idleTimeout time.Duration, maxMessages int, timeout time.Duration) *smtpPool {
+	p := &smtpPool{
+		dial:        dial,
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		maxMessages: maxMessages,
+		now:         time.Now,
+		slots:       make(chan struct{}, max(maxConns, 1)),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		p.wg.Go(p.reap)
+	}
+	return p
+}
+
+// get returns an idle connection or dials a new one, waiting for a free slot
+// when maxConns connections are in use.
+func (p *smtpPool) get(ctx context.Context) (*smtpConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("smtp relay: %w", ctx.Err())
+	}
+
+	for {
+		c := p.popIdle()
+		if c == nil {
+			break
+		}
+		_ = c.conn.SetDeadline(time.Now().Add(p.timeout))
+		if err := c.client.Reset(); err != nil {
+			_ = c.client.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	smtpConnections.Inc()
+	return c, nil
+}
+
+// put returns a connection to the pool after a delivery. Connections are kept
+// after rejections by the relay, which leave the session usable, but not after
+// network errors.
+func (p *smtpPool) put(c *smtpConn, err error) {
+	defer func() { <-p.slots }()
+	c.messages++
+
+	var protoErr *textproto.Error
+	reusable := err == nil || errors.As(err, &protoErr)
+	p.mu.Lock()
+	if reusable && !p.closed && p.idleTimeout > 0 && (p.maxMessages <= 0 || c.messages < p.maxMessages) {
+		c.idleSince = p.now()
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	c.close()
+}
+
+// popIdle returns the most recently used idle connection, if any, after
+// closing the expired ones.
+func (p *smtpPool) popIdle() *smtpConn {
+	p.mu.Lock()
+	expired := p.expire()
+	var c *smtpConn
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		c.close()
+	}
+	return c
+}
+
+// expire removes the connections that have been idle for too long, which are
+// at the front of the idle list, and returns them.
+func (p *smtpPool) expire() []*smtpConn {
+	now := p.now()
+	n := 0
+	for n < len(p.idle) && now.Sub(p.idle[n].idleSince) >= p.idleTimeout {
+		n++
+	}
+	expired := append([]*smtpConn(nil), p.idle[:n]...)
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	return expired
+}
+
+// reap closes idle connections once they expire, so that they are not kept
+// open while there is nothing to deliver.
+func (p *smtpPool) reap() {
+	ticker := time.NewTicker(max(p.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			expired := p.expire()
+			p.mu.Unlock()
+			for _, c := range expired {
+				c.close()
+			}
+		}
+	}
+}
+
+// close closes the idle connections. Connections in use are closed when they
+// are returned.
+func (p *smtpPool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	p.wg.Wait()
+	for _, c := range idle {
+		c.close()
+	}
+}
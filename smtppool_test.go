@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withPool(maxConns uint16, idleTimeout time.Duration, maxMessages uint16) func(*Config) {
+	return func(cfg *Config) {
+		cfg.EmailSMTPMaxConnections = maxConns
+		cfg.EmailSMTPIdleTimeout = idleTimeout
+		cfg.EmailSMTPMaxMessages = maxMessages
+	}
+}
+
+func TestSMTPPool(t *testing.T) {
+	t.Run("reuse", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withSTARTTLS, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, server.config(trustTestCertificate(t), withPool(4, time.Minute, 100)))
+
+		for range 3 {
+			require.NoError(t, relays.Send(t.Context(), testEmail()))
+		}
+
+		messages := server.Messages()
+		require.Len(t, messages, 3)
+		assert.Equal(t, 1, server.Sessions())
+		for _, msg := range messages {
+			assert.True(t, msg.TLS)
+			assert.Equal(t, "drone", msg.Auth)
+		}
+	})
+
+	t.Run("max messages", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(4, time.Minute, 2)))
+
+		for range 5 {
+			require.NoError(t, relays.Send(t.Context(), testEmail()))
+		}
+
+		assert.Len(t, server.Messages(), 5)
+		assert.Equal(t, 3, server.Sessions())
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(4, time.Minute, 100)))
+		now := time.Now()
+		relays.relays[0].pool.now = func() time.Time { return now }
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+		now = now.Add(time.Minute)
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, server.Messages(), 2)
+		assert.Equal(t, 2, server.Sessions())
+	})
+
+	t.Run("reuse disabled", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(4, 0, 100)))
+
+		for range 3 {
+			require.NoError(t, relays.Send(t.Context(), testEmail()))
+		}
+
+		assert.Len(t, server.Messages(), 3)
+		assert.Equal(t, 3, server.Sessions())
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(4, time.Minute, 100)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+		server.CloseSessions()
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, server.Messages(), 2)
+		assert.Equal(t, 2, server.Sessions())
+	})
+
+	t.Run("max connections", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(2, time.Minute, 100)))
+
+		var wg sync.WaitGroup
+		for range 16 {
+			wg.Go(func() {
+				assert.NoError(t, relays.Send(t.Context(), testEmail()))
+			})
+		}
+		wg.Wait()
+
+		assert.Len(t, server.Messages(), 16)
+		assert.LessOrEqual(t, server.Peak(), 2)
+	})
+
+	t.Run("rejection keeps the connection", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(4, time.Minute, 100)))
+		rejected := testEmail()
+		rejected.To = []string{"Unknown <unknown@invalid>"}
+
+		require.ErrorContains(t, relays.Send(t.Context(), rejected), "550")
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, server.Messages(), 1)
+		assert.Equal(t, 1, server.Sessions())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config(withPool(4, time.Minute, 100)))
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		relays.Close()
+
+		assert.Empty(t, relays.relays[0].pool.idle)
+		assert.Eventually(t, func() bool { return server.Active() == 0 }, time.Second, 10*time.Millisecond)
+	})
+}
+
+// BenchmarkSMTPRelay_Send compares the throughput of dialing a connection with
+// STARTTLS and AUTH for every message with reusing pooled connections.
+func BenchmarkSMTPRelay_Send(b *testing.B) {
+	for _, bm := range []struct {
+		name        string
+		idleTimeout time.Duration
+	}{
+		{name: "dial per message", idleTimeout: 0},
+		{name: "pooled", idleTimeout: time.Minute},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			server := startSMTPServer(b, withSTARTTLS, withSMTPAuth("drone", "password123"))
+			relays := newSMTPRelays(b, server.config(trustTestCertificate(b), withPool(4, bm.idleTimeout, 0)))
+			b.SetParallelism(1)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := relays.Send(b.Context(), testEmail()); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(server.Sessions()), "connections")
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// SMTPRelaySelection defines the order in which the relays are tried.
+type SMTPRelaySelection string
+
+const (
+	// SMTPRelayFailover tries the relays in the order they are listed.
+	SMTPRelayFailover SMTPRelaySelection = "failover"
+	// SMTPRelayWeighted spreads deliveries over the relays with a weighted
+	// round-robin, and fails over to the others in the order they are listed.
+	SMTPRelayWeighted SMTPRelaySelection = "weighted"
+)
+
+const defaultSMTPPort = 25
+
+type SMTPRelaysFile struct {
+	Selection SMTPRelaySelection `yaml:"selection"`
+	Relays    []SMTPRelayConfig  `yaml:"relays"`
+}
+
+// SMTPRelayConfig is a relay of the relays file. Its settings have the same
+// meaning and defaults as the DRONE_EMAIL_SMTP_* variables, which they
+// replace. The connection pool settings are taken from the variables and apply
+// to each relay separately, which gets its own pool of up to
+// DRONE_EMAIL_SMTP_MAX_CONNECTIONS connections.
+type SMTPRelayConfig struct {
+	Host               string            `yaml:"host"`
+	Port               uint16            `yaml:"port"`
+	Username           string            `yaml:"username"`
+	Password           string            `yaml:"password"`
+	TLS                SMTPTLSMode       `yaml:"tls"`
+	CAFile             string            `yaml:"ca_file"`
+	ClientCertFile     string            `yaml:"client_cert_file"`
+	ClientKeyFile      string            `yaml:"client_key_file"`
+	ServerName         string            `yaml:"server_name"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	Auth               SMTPAuthMechanism `yaml:"auth"`
+	OAuth              SMTPOAuthConfig   `yaml:"oauth"`
+	Weight             uint16            `yaml:"weight"`
+}
+
+type SMTPOAuthConfig struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RefreshToken string   `yaml:"refresh_token"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+func LoadSMTPRelays(filename string) (*SMTPRelaysFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("smtp relays: %w", err)
+	}
+	defer f.Close()
+
+	var relays SMTPRelaysFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&relays); err != nil {
+		return nil, fmt.Errorf("smtp relays: parse %s: %w", filename, err)
+	}
+	if relays.Selection == "" {
+		relays.Selection = SMTPRelayFailover
+	}
+	if err := relays.validate(); err != nil {
+		return nil, fmt.Errorf("smtp relays: %s: %w", filename, err)
+	}
+	return &relays, nil
+}
+
+func (f *SMTPRelaysFile) validate() error {
+	if f.Selection != SMTPRelayFailover && f.Selection != SMTPRelayWeighted {
+		return fmt.Errorf("unknown selection %q", f.Selection)
+	}
+	if len(f.Relays) == 0 {
+		return errors.New("no relays")
+	}
+	var errs []error
+	for i, relay := range f.Relays {
+		if err := relay.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("relay #%d %q: %w", i+1, relay.Host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *SMTPRelayConfig) validate() error {
+	var errs []error
+	if c.Host == "" {
+		errs = append(errs, errors.New("missing host"))
+	}
+	if c.TLS != "" {
+		errs = append(errs, new(SMTPTLSMode).Decode(string(c.TLS)))
+	}
+	if c.Auth != "" {
+		errs = append(errs, new(SMTPAuthMechanism).Decode(string(c.Auth)))
+	}
+	return errors.Join(errs...)
+}
+
+// config returns cfg with the relay settings replaced by the ones of c.
+func (c *SMTPRelayConfig) config(cfg Config) Config {
+	cfg.EmailSMTPHost = c.Host
+	cfg.EmailSMTPPort = cmp.Or(c.Port, defaultSMTPPort)
+	cfg.EmailSMTPUsername = c.Username
+	cfg.EmailSMTPPassword = c.Password
+	cfg.EmailSMTPTLS = c.TLS
+	cfg.EmailSMTPCAFile = c.CAFile
+	cfg.EmailSMTPClientCertFile = c.ClientCertFile
+	cfg.EmailSMTPClientKeyFile = c.ClientKeyFile
+	cfg.EmailSMTPServerName = c.ServerName
+	cfg.EmailSMTPInsecureSkipVerify = c.InsecureSkipVerify
+	cfg.EmailSMTPAuth = c.Auth
+	cfg.EmailSMTPOAuthTokenURL = c.OAuth.TokenURL
+	cfg.EmailSMTPOAuthClientID = c.OAuth.ClientID
+	cfg.EmailSMTPOAuthClientSecret = c.OAuth.ClientSecret
+	cfg.EmailSMTPOAuthRefreshToken = c.OAuth.RefreshToken
+	cfg.EmailSMTPOAuthScopes = c.OAuth.Scopes
+	return cfg
+}
+
+// smtpRelayState is a relay along with its circuit breaker and its current
+// weight in the smooth weighted round-robin.
+type smtpRelayState struct {
+	*SMTPRelay
+	weight    int
+	current   int
+	failures  int
+	openUntil time.Time
+}
+
+// SMTPRelays delivers messages through the first relay that accepts them.
+// Connection failures and temporary (4xx) rejections fail over to the next
+// relay, while permanent (5xx) rejections are returned as is, since the other
+// relays would most likely reject the message as well. After threshold
+// consecutive failures the circuit of a relay opens for cooldown: it is only
+// tried after all the healthy ones, and it is closed again by its next
+// successful delivery. A threshold of zero disables the circuit breaker.
+type SMTPRelays struct {
+	selection SMTPRelaySelection
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	dkim      *DKIMSigner
+
+	mu     sync.Mutex
+	relays []*smtpRelayState
+}
+
+// NewSMTPRelays configures the relays of the relays file, or the single relay
+// of the DRONE_EMAIL_SMTP_* variables when there is no such file.
+func NewSMTPRelays(cfg Config) (*SMTPRelays, error) {
+	file := &SMTPRelaysFile{Selection: SMTPRelayFailover}
+	if cfg.EmailSMTPRelaysFile != "" {
+		var err error
+		if file, err = LoadSMTPRelays(cfg.EmailSMTPRelaysFile); err != nil {
+			return nil, err
+		}
+	}
+
+	signer, err := NewDKIMSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SMTPRelays{
+		selection: file.Selection,
+		threshold: int(cfg.EmailSMTPBreakerThreshold),
+		cooldown:  cfg.EmailSMTPBreakerCooldown,
+		now:       time.Now,
+		dkim:      signer,
+	}
+	if len(file.Relays) == 0 {
+		relay, err := NewSMTPRelay(cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.relays = []*smtpRelayState{{SMTPRelay: relay, weight: 1}}
+		return r, nil
+	}
+	for i, relayCfg := range file.Relays {
+		relay, err := NewSMTPRelay(relayCfg.config(cfg))
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("smtp relays: relay #%d %q: %w", i+1, relayCfg.Host, err)
+		}
+		r.relays = append(r.relays, &smtpRelayState{SMTPRelay: relay, weight: max(int(relayCfg.Weight), 1)})
+	}
+	return r, nil
+}
+
+// Send delivers the message to its To, Cc and Bcc recipients through the
+// first relay that accepts it. The errors of every relay tried are returned
+// when none does.
+func (r *SMTPRelays) Send(ctx context.Context, emailMsg *email.Email) error {
+	from, to, err := envelope(emailMsg)
+	if err != nil {
+		return fmt.Errorf("smtp relay: %w", err)
+	}
+	msg, err := messageBytes(emailMsg, r.dkim)
+	if err != nil {
+		return fmt.Errorf("smtp relay: %w", err)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	relays := r.order()
+	var errs []error
+	for i, relay := range relays {
+		_, port, _ := net.SplitHostPort(relay.addr)
+		span.SetAttributes(
+			attribute.String("server.address", relay.host),
+			attribute.String("server.port", port),
+		)
+		err := relay.send(ctx, from, to, msg)
+		if err == nil {
+			r.succeeded(relay)
+			return nil
+		}
+		if !isRelayFailure(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			// The delivery was cancelled, such as while waiting for a pooled
+			// connection, which says nothing about the health of the relay.
+			return errors.Join(append(errs, err)...)
+		}
+		r.failed(ctx, relay)
+		smtpRelayFailures.WithLabelValues(relay.addr).Inc()
+		if len(relays) == 1 {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", relay.addr, err))
+		if i == len(relays)-1 || ctx.Err() != nil {
+			break
+		}
+		span.AddEvent("smtp.failover", trace.WithAttributes(
+			attribute.String("server.address", relay.host),
+			attribute.String("server.port", port),
+			attribute.String("error", err.Error()),
+		))
+		slog.WarnContext(ctx, "smtp relay failed, trying the next one", "relay", relay.addr, "error", err)
+	}
+	return errors.Join(errs...)
+}
+
+// isRelayFailure reports whether a delivery error is specific to the relay,
+// such as a connection failure or a temporary rejection, so that another
+// relay may accept the message.
+func isRelayFailure(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code/100 == 4
+	}
+	return true
+}
+
+// order returns the relays in the order they are tried: as listed, or
+// starting with the next relay of the weighted round-robin, with the relays
+// whose circuit is open moved to the end.
+func (r *SMTPRelays) order() []*smtpRelayState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	var healthy, open []*smtpRelayState
+	for _, relay := range r.relays {
+		if now.Before(relay.openUntil) {
+			open = append(open, relay)
+		} else {
+			healthy = append(healthy, relay)
+		}
+	}
+
+	if r.selection == SMTPRelayWeighted && len(healthy) > 1 {
+		// Smooth weighted round-robin, as in nginx: every relay gains its
+		// weight, and the one with the highest current weight is picked and
+		// loses the total, which interleaves the picks evenly.
+		total, next := 0, 0
+		for i, relay := range healthy {
+			relay.current += relay.weight
+			total += relay.weight
+			if relay.current > healthy[next].current {
+				next = i
+			}
+		}
+		healthy[next].current -= total
+		picked := healthy[next]
+		healthy = append([]*smtpRelayState{picked}, slices.Delete(healthy, next, next+1)...)
+	}
+	return append(healthy, open...)
+}
+
+func (r *SMTPRelays) succeeded(relay *smtpRelayState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	relay.failures = 0
+	relay.openUntil = time.Time{}
+}
+
+func (r *SMTPRelays) failed(ctx context.Context, relay *smtpRelayState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	relay.failures++
+	if r.threshold <= 0 || relay.failures < r.threshold {
+		return
+	}
+	relay.openUntil = r.now().Add(r.cooldown)
+	if relay.failures == r.threshold {
+		slog.WarnContext(ctx, "smtp relay marked unhealthy", "relay", relay.addr, "failures", relay.failures, "cooldown", r.cooldown)
+	}
+}
+
+// Check performs the handshake of a delivery with the relays in the order they
+// are listed, and succeeds as soon as one of them does.
+func (r *SMTPRelays) Check(ctx context.Context) error {
+	var errs []error
+	for _, relay := range r.relays {
+		err := relay.Check(ctx)
+		if err == nil {
+			return nil
+		}
+		if len(r.relays) == 1 {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", relay.addr, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the idle connections to the relays.
+func (r *SMTPRelays) Close() {
+	for _, relay := range r.relays {
+		relay.Close()
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relaysFile writes a relays file listing the relays, given as host and port
+// pairs followed by their extra settings.
+func relaysFile(t *testing.T, selection SMTPRelaySelection, relays ...string) func(*Config) {
+	t.Helper()
+	var content strings.Builder
+	fmt.Fprintf(&content, "selection: %s\nrelays:\n", selection)
+	for _, relay := range relays {
+		fmt.Fprintf(&content, "  - %s\n", strings.ReplaceAll(relay, "\n", "\n    "))
+	}
+	filename := writeFile(t, "relays.yml", content.String())
+	return func(cfg *Config) {
+		cfg.EmailSMTPRelaysFile = filename
+	}
+}
+
+func relayEntry(host string, port uint16, settings ...string) string {
+	return strings.Join(append([]string{"host: " + host, fmt.Sprintf("port: %d", port)}, settings...), "\n")
+}
+
+func withBreaker(threshold uint16, cooldown time.Duration) func(*Config) {
+	return func(cfg *Config) {
+		cfg.EmailSMTPBreakerThreshold = threshold
+		cfg.EmailSMTPBreakerCooldown = cooldown
+	}
+}
+
+func newSMTPRelays(t testing.TB, cfg Config) *SMTPRelays {
+	t.Helper()
+	relays, err := NewSMTPRelays(cfg)
+	require.NoError(t, err)
+	t.Cleanup(relays.Close)
+	return relays
+}
+
+func TestSMTPRelays_Send(t *testing.T) {
+	t.Run("single relay", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		relays := newSMTPRelays(t, server.config())
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, server.Messages(), 1)
+	})
+
+	t.Run("primary", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t, withSMTPAuth("primary", "password123"))
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, primary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port, "username: primary", "password: password123"),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := primary.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "primary", messages[0].Auth)
+		assert.Empty(t, secondary.Messages())
+	})
+
+	t.Run("failover on connection error", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, secondary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(host, port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, secondary.Messages(), 1)
+	})
+
+	t.Run("failover on temporary rejection", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t, withRejectMail(451))
+		secondary := startSMTPServer(t, withImplicitTLS)
+		relays := newSMTPRelays(t, primary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port, "tls: none"),
+			relayEntry(secondary.Host, secondary.Port, "tls: implicit", "insecure_skip_verify: true"),
+		)))
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		messages := secondary.Messages()
+		require.Len(t, messages, 1)
+		assert.True(t, messages[0].TLS)
+	})
+
+	t.Run("no failover on permanent rejection", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t, withRejectMail(550))
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, primary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, "550")
+		assert.Zero(t, secondary.Sessions())
+	})
+
+	t.Run("all relays fail", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+		secondary := startSMTPServer(t, withRejectMail(421))
+		relays := newSMTPRelays(t, secondary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(host, port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+
+		err := relays.Send(t.Context(), testEmail())
+
+		require.ErrorContains(t, err, fmt.Sprintf("%s:%d: smtp relay: dial tcp", host, port))
+		require.ErrorContains(t, err, secondary.Addr+": smtp relay: mail from: 421")
+		assert.Equal(t, "smtp_4xx", deliveryFailureReason(err))
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t, withRejectMail(451))
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, primary.config(withBreaker(2, time.Minute), relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+		now := time.Now()
+		relays.now = func() time.Time { return now }
+
+		for range 2 {
+			require.NoError(t, relays.Send(t.Context(), testEmail()))
+		}
+		assert.Equal(t, secondary.Addr, relays.order()[0].addr, "the circuit of the primary is open")
+
+		now = now.Add(time.Minute)
+		assert.Equal(t, primary.Addr, relays.order()[0].addr, "the primary is tried again after the cooldown")
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+		assert.Equal(t, secondary.Addr, relays.order()[0].addr, "a failure after the cooldown opens the circuit again")
+		assert.Len(t, secondary.Messages(), 3)
+	})
+
+	t.Run("circuit closes after success", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t)
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, primary.config(withBreaker(1, time.Minute), relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+		now := time.Now()
+		relays.now = func() time.Time { return now }
+		relays.failed(t.Context(), relays.relays[0])
+		require.Equal(t, secondary.Addr, relays.order()[0].addr)
+
+		now = now.Add(time.Minute)
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, primary.Messages(), 1)
+		assert.Zero(t, relays.relays[0].failures)
+		assert.Equal(t, primary.Addr, relays.order()[0].addr)
+	})
+
+	t.Run("cancelled delivery", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t)
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, primary.config(withBreaker(1, time.Minute), relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		err := relays.Send(ctx, testEmail())
+
+		require.ErrorIs(t, err, context.Canceled)
+		assert.NotContains(t, err.Error(), secondary.Addr, "the other relays are not tried")
+		assert.Zero(t, relays.relays[0].failures, "the relay is not blamed")
+		assert.Equal(t, primary.Addr, relays.order()[0].addr)
+	})
+
+	t.Run("open circuits are tried last", func(t *testing.T) {
+		t.Parallel()
+		primary := startSMTPServer(t)
+		host, port := closedSMTPAddr(t)
+		relays := newSMTPRelays(t, primary.config(withBreaker(1, time.Minute), relaysFile(t, SMTPRelayFailover,
+			relayEntry(primary.Host, primary.Port),
+			relayEntry(host, port),
+		)))
+		relays.failed(t.Context(), relays.relays[0])
+
+		require.NoError(t, relays.Send(t.Context(), testEmail()))
+
+		assert.Len(t, primary.Messages(), 1)
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		t.Parallel()
+		heavy := startSMTPServer(t)
+		light := startSMTPServer(t)
+		relays := newSMTPRelays(t, heavy.config(relaysFile(t, SMTPRelayWeighted,
+			relayEntry(heavy.Host, heavy.Port, "weight: 3"),
+			relayEntry(light.Host, light.Port),
+		)))
+
+		for range 8 {
+			require.NoError(t, relays.Send(t.Context(), testEmail()))
+		}
+
+		assert.Len(t, heavy.Messages(), 6)
+		assert.Len(t, light.Messages(), 2)
+	})
+
+	t.Run("weighted failover", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+		healthy := startSMTPServer(t)
+		relays := newSMTPRelays(t, healthy.config(relaysFile(t, SMTPRelayWeighted,
+			relayEntry(host, port),
+			relayEntry(healthy.Host, healthy.Port),
+		)))
+
+		for range 4 {
+			require.NoError(t, relays.Send(t.Context(), testEmail()))
+		}
+
+		assert.Len(t, healthy.Messages(), 4)
+	})
+}
+
+func TestSMTPRelays_Check(t *testing.T) {
+	t.Run("one relay is up", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+		secondary := startSMTPServer(t)
+		relays := newSMTPRelays(t, secondary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(host, port),
+			relayEntry(secondary.Host, secondary.Port),
+		)))
+
+		assert.NoError(t, relays.Check(t.Context()))
+	})
+
+	t.Run("all relays are down", func(t *testing.T) {
+		t.Parallel()
+		host, port := closedSMTPAddr(t)
+		secondary := startSMTPServer(t, withSMTPAuth("drone", "password123"))
+		relays := newSMTPRelays(t, secondary.config(relaysFile(t, SMTPRelayFailover,
+			relayEntry(host, port),
+			relayEntry(secondary.Host, secondary.Port, "username: drone", "password: wrong"),
+		)))
+
+		err := relays.Check(t.Context())
+
+		require.ErrorContains(t, err, "dial tcp")
+		assert.ErrorContains(t, err, "smtp relay: auth: PLAIN: 535")
+	})
+}
+
+func TestLoadSMTPRelays(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		filename := writeFile(t, "relays.yml", `
+selection: weighted
+relays:
+  - host: smtp.example.com
+    port: 587
+    username: drone
+    password: password123
+    tls: starttls-required
+    ca_file: /etc/ssl/relay.pem
+    server_name: relay.example.com
+    auth: login
+    weight: 3
+  - host: smtp.example.org
+    auth: xoauth2
+    oauth:
+      token_url: https://login.example.org/token
+      client_id: drone
+      client_secret: secret
+      scopes: [smtp]
+`)
+
+		relays, err := LoadSMTPRelays(filename)
+
+		require.NoError(t, err)
+		assert.Equal(t, &SMTPRelaysFile{
+			Selection: SMTPRelayWeighted,
+			Relays: []SMTPRelayConfig{
+				{
+					Host:       "smtp.example.com",
+					Port:       587,
+					Username:   "drone",
+					Password:   "password123",
+					TLS:        SMTPTLSStartTLSRequired,
+					CAFile:     "/etc/ssl/relay.pem",
+					ServerName: "relay.example.com",
+					Auth:       SMTPAuthLogin,
+					Weight:     3,
+				},
+				{
+					Host: "smtp.example.org",
+					Auth: SMTPAuthXOAuth2,
+					OAuth: SMTPOAuthConfig{
+						TokenURL:     "https://login.example.org/token",
+						ClientID:     "drone",
+						ClientSecret: "secret",
+						Scopes:       []string{"smtp"},
+					},
+				},
+			},
+		}, relays)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		t.Parallel()
+		filename := writeFile(t, "relays.yml", "relays:\n  - host: smtp.example.com\n")
+
+		relays, err := LoadSMTPRelays(filename)
+
+		require.NoError(t, err)
+		assert.Equal(t, SMTPRelayFailover, relays.Selection)
+		cfg := relays.Relays[0].config(Config{EmailSMTPMaxConnections: 8})
+		assert.Equal(t, uint16(25), cfg.EmailSMTPPort)
+		assert.Equal(t, uint16(8), cfg.EmailSMTPMaxConnections)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		for name, content := range map[string]string{
+			"unknown selection": "selection: random\nrelays:\n  - host: smtp.example.com\n",
+			"no relays":         "relays: []\n",
+			"missing host":      "relays:\n  - port: 25\n",
+			"unknown tls mode":  "relays:\n  - host: smtp.example.com\n    tls: ssl\n",
+			"unknown auth":      "relays:\n  - host: smtp.example.com\n    auth: ntlm\n",
+			"unknown field":     "relays:\n  - host: smtp.example.com\n    user: drone\n",
+			"invalid weight":    "relays:\n  - host: smtp.example.com\n    weight: -1\n",
+			"invalid yaml":      "relays: [\n",
+		} {
+			_, err := LoadSMTPRelays(writeFile(t, "relays.yml", content))
+			assert.Error(t, err, name)
+		}
+
+		_, err := LoadSMTPRelays(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestNewSMTPRelays(t *testing.T) {
+	t.Parallel()
+	cfg := Config{}
+	relaysFile(t, SMTPRelayFailover,
+		relayEntry("smtp.example.com", 25),
+		relayEntry("smtp.example.org", 25, "ca_file: "+filepath.Join(t.TempDir(), "ca.pem")),
+	)(&cfg)
+
+	_, err := NewSMTPRelays(cfg)
+
+	assert.ErrorContains(t, err, `smtp relays: relay #2 "smtp.example.org": smtp relay: read ca file`)
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a self-signed certificate along with its PEM encoding.
+type testCert struct {
+	tls.Certificate
+
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// testCertificate is a self-signed server certificate for 127.0.0.1 and
+// localhost.
+var testCertificate = sync.OnceValue(func() testCert {
+	return newTestCertificate("localhost", x509.ExtKeyUsageServerAuth)
+})
+
+// testClientCertificate is a self-signed client certificate for "drone".
+var testClientCertificate = sync.OnceValue(func() testCert {
+	return newTestCertificate("drone", x509.ExtKeyUsageClientAuth)
+})
+
+func newTestCertificate(commonName string, usage x509.ExtKeyUsage) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return testCert{
+		Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		CertPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// files writes the certificate and its key to PEM files and returns their
+// paths.
+func (c testCert) files(t testing.TB) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, c.CertPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, c.KeyPEM, 0o600))
+	return certFile, keyFile
+}
+
+// smtpMessage is a message received by smtpServer.
+type smtpMessage struct {
+	From       string
+	To         []string
+	Data       string
+	TLS        bool
+	Auth       string
+	Mechanism  string
+	ClientCert string
+}
+
+// smtpServer is a minimal in-process SMTP server that records the messages it
+// receives and rejects recipients in the invalid domain. It offers STARTTLS
+// when starttls is set, speaks TLS from the start of the connection when
+// implicitTLS is set, requires a client certificate signed by clientCAs when
+// set, requires AUTH with one of mechanisms when username is set, and rejects
+// every MAIL FROM with rejectMail when set.
+type smtpServer struct {
+	Host string
+	Port uint16
+	Addr string
+
+	starttls    bool
+	implicitTLS bool
+	clientCAs   *x509.CertPool
+	username    string
+	password    string
+	mechanisms  []string
+	rejectMail  int
+
+	listener net.Listener
+	mu       sync.Mutex
+	messages []smtpMessage
+	sessions int
+	active   map[net.Conn]struct{}
+	peak     int
+}
+
+func startSMTPServer(t testing.TB, opts ...func(*smtpServer)) *smtpServer {
+	t.Helper()
+	s := &smtpServer{active: map[net.Conn]struct{}{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if s.implicitTLS {
+		listener = tls.NewListener(listener, s.tlsConfig())
+	}
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	host, port, _ := net.SplitHostPort(s.Addr)
+	portNum, _ := strconv.Atoi(port)
+	s.Host, s.Port = host, uint16(portNum)
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = listener.Close()
+		wg.Wait()
+	})
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Go(func() { s.serve(conn) })
+		}
+	})
+	return s
+}
+
+func withSTARTTLS(s *smtpServer) {
+	s.starttls = true
+}
+
+func withImplicitTLS(s *smtpServer) {
+	s.implicitTLS = true
+}
+
+// withClientCertificate requires clients to present the certificate.
+func withClientCertificate(cert testCert) func(*smtpServer) {
+	return func(s *smtpServer) {
+		s.clientCAs = x509.NewCertPool()
+		s.clientCAs.AppendCertsFromPEM(cert.CertPEM)
+	}
+}
+
+// withSMTPAuth requires AUTH PLAIN or LOGIN, unless mechanisms are given.
+func withSMTPAuth(username, password string, mechanisms ...string) func(*smtpServer) {
+	if len(mechanisms) == 0 {
+		mechanisms = []string{"PLAIN", "LOGIN"}
+	}
+	return func(s *smtpServer) {
+		s.username = username
+		s.password = password
+		s.mechanisms = mechanisms
+	}
+}
+
+// withRejectMail rejects every message with the reply code.
+func withRejectMail(code int) func(*smtpServer) {
+	return func(s *smtpServer) {
+		s.rejectMail = code
+	}
+}
+
+// config returns a config that points the email sender at the server.
+func (s *smtpServer) config(fns ...func(*Config)) Config {
+	cfg := Config{
+		EmailSMTPHost:     s.Host,
+		EmailSMTPPort:     s.Port,
+		EmailSMTPUsername: s.username,
+		EmailSMTPPassword: s.password,
+		EmailFrom:         "ci@example.com",
+	}
+	for _, fn := range fns {
+		fn(&cfg)
+	}
+	return cfg
+}
+
+func (s *smtpServer) tlsConfig() *tls.Config {
+	cfg := &tls.Config{Certificates: []tls.Certificate{testCertificate().Certificate}, MinVersion: tls.VersionTLS12}
+	if s.clientCAs != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = s.clientCAs
+	}
+	return cfg
+}
+
+func (s *smtpServer) Messages() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func (s *smtpServer) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+// Active returns the number of open sessions.
+func (s *smtpServer) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
+
+// Peak returns the largest number of sessions open at once.
+func (s *smtpServer) Peak() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// CloseSessions closes the open sessions without saying goodbye, as relays do
+// with idle connections.
+func (s *smtpServer) CloseSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.active {
+		_ = conn.Close()
+	}
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	raw := conn
+	defer func() { _ = raw.Close() }()
+	s.mu.Lock()
+	s.sessions++
+	s.active[raw] = struct{}{}
+	s.peak = max(s.peak, len(s.active))
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.active, raw)
+		s.mu.Unlock()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	tp := textproto.NewConn(conn)
+	reply := func(code int, lines ...string) {
+		for i, line := range lines {
+			sep := " "
+			if i < len(lines)-1 {
+				sep = "-"
+			}
+			_ = tp.PrintfLine("%d%s%s", code, sep, line)
+		}
+	}
+
+	var (
+		msg        smtpMessage
+		isTLS      bool
+		clientCert string
+		authUser   string
+		mechanism  string
+	)
+	handshake := func(tlsConn *tls.Conn) bool {
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			clientCert = certs[0].Subject.CommonName
+		}
+		isTLS = true
+		return true
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok && !handshake(tlsConn) {
+		return
+	}
+	reply(220, "localhost ESMTP test server")
+	for {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			ext := []string{"localhost greets " + arg, "8BITMIME"}
+			if s.starttls && !isTLS {
+				ext = append(ext, "STARTTLS")
+			}
+			if s.username != "" {
+				ext = append(ext, "AUTH "+strings.Join(s.mechanisms, " "))
+			}
+			reply(250, ext...)
+		case "STARTTLS":
+			if !s.starttls || isTLS {
+				reply(502, "STARTTLS not available")
+				continue
+			}
+			reply(220, "ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig())
+			if !handshake(tlsConn) {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			user, ok := s.authenticate(tp, reply, arg)
+			if !ok {
+				reply(535, "authentication failed")
+				continue
+			}
+			authUser = user
+			mechanism, _, _ = strings.Cut(strings.ToUpper(arg), " ")
+			reply(235, "authentication succeeded")
+		case "MAIL":
+			if s.username != "" && authUser == "" {
+				reply(530, "authentication required")
+				continue
+			}
+			if s.rejectMail != 0 {
+				reply(s.rejectMail, "mail rejected")
+				continue
+			}
+			msg = smtpMessage{From: smtpPath(arg), TLS: isTLS, Auth: authUser, Mechanism: mechanism, ClientCert: clientCert}
+			reply(250, "ok")
+		case "RCPT":
+			rcpt := smtpPath(arg)
+			if strings.HasSuffix(rcpt, "@invalid") {
+				reply(550, "no such user")
+				continue
+			}
+			msg.To = append(msg.To, rcpt)
+			reply(250, "ok")
+		case "DATA":
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply(250, "queued")
+		case "RSET":
+			msg = smtpMessage{}
+			reply(250, "ok")
+		case "NOOP":
+			reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+// authenticate runs an AUTH exchange and returns the authenticated username.
+// The password is the bearer token expected by XOAUTH2 and OAUTHBEARER.
+func (s *smtpServer) authenticate(tp *textproto.Conn, reply func(int, ...string), arg string) (string, bool) {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	mechanism = strings.ToUpper(mechanism)
+	if s.username == "" || !slices.Contains(s.mechanisms, mechanism) {
+		return "", false
+	}
+	challenge := func(prompt string) (string, error) {
+		reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		return string(decoded), err
+	}
+	response := func() (string, error) {
+		if initial == "" {
+			return challenge("")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		return string(decoded), err
+	}
+	// bearer parses the key=value pairs of XOAUTH2 and OAUTHBEARER, and fails
+	// the exchange with an error challenge when the token is wrong.
+	bearer := func(resp string) (string, bool) {
+		var username, token string
+		for field := range strings.SplitSeq(resp, "\x01") {
+			switch key, value, _ := strings.Cut(field, "="); key {
+			case "user":
+				username = value
+			case "auth":
+				token = strings.TrimPrefix(value, "Bearer ")
+			}
+		}
+		// The authzid of the GS2 header of OAUTHBEARER ends at the first comma,
+		// with commas and equal signs escaped as =2C and =3D.
+		if header, _, ok := strings.Cut(resp, "\x01"); ok && strings.HasPrefix(header, "n,a=") {
+			authzid, _, _ := strings.Cut(strings.TrimPrefix(header, "n,a="), ",")
+			username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(authzid)
+		}
+		if username != s.username || token != s.password {
+			_, _ = challenge(`{"status":"invalid_token"}`)
+			return "", false
+		}
+		return username, true
+	}
+
+	var username, password string
+	switch mechanism {
+	case "PLAIN":
+		resp, err := response()
+		if err != nil {
+			return "", false
+		}
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 {
+			return "", false
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		var err error
+		if username, err = challenge("Username:"); err != nil {
+			return "", false
+		}
+		if password, err = challenge("Password:"); err != nil {
+			return "", false
+		}
+	case "CRAM-MD5":
+		nonce := "<1896.697170952@localhost>"
+		resp, err := challenge(nonce)
+		if err != nil {
+			return "", false
+		}
+		user, digest, _ := strings.Cut(resp, " ")
+		mac := hmac.New(md5.New, []byte(s.password))
+		mac.Write([]byte(nonce))
+		if user != s.username || digest != hex.EncodeToString(mac.Sum(nil)) {
+			return "", false
+		}
+		return user, true
+	case "XOAUTH2", "OAUTHBEARER":
+		resp, err := response()
+		if err != nil {
+			return "", false
+		}
+		return bearer(resp)
+	default:
+		return "", false
+	}
+	if username != s.username || password != s.password {
+		return "", false
+	}
+	return username, true
+}
+
+// smtpPath extracts the address from a MAIL FROM:<addr> or RCPT TO:<addr>
+// argument.
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path, _, _ = strings.Cut(strings.TrimSpace(path), " ")
+	return strings.Trim(path, "<>")
+}
+
+// closedSMTPAddr returns the address of a listener that has been closed, so
+// that connections to it are refused.
+func closedSMTPAddr(t *testing.T) (string, uint16) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	require.NoError(t, listener.Close())
+	return addr.IP.String(), uint16(addr.Port)
+}
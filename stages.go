@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// StageSummary is the view of a pipeline stage rendered in emails.
+type StageSummary struct {
+	Name   string
+	Status string
+	Link   string
+	Failed bool
+	Steps  []StepSummary
+}
+
+// StepSummary is the view of a pipeline step rendered in emails.
+type StepSummary struct {
+	Name     string
+	Status   string
+	ExitCode int
+	Duration string
+	Link     string
+	Failed   bool
+	// LogTail holds the last lines of the log of a failed step, if fetched.
+	LogTail string
+}
+
+// summarizeStages returns the stages and steps of the build with links to their
+// pages under buildLink, flagging the ones that failed.
+func summarizeStages(build *drone.Build, buildLink string) []StageSummary {
+	stages := make([]StageSummary, 0, len(build.Stages))
+	for _, stage := range build.Stages {
+		stageLink := fmt.Sprintf("%s/%d", buildLink, stage.Number)
+		summary := StageSummary{
+			Name:   stage.Name,
+			Status: stage.Status,
+			Link:   stageLink,
+			Failed: isFailedStatus(stage.Status) && !stage.ErrIgnore,
+			Steps:  make([]StepSummary, 0, len(stage.Steps)),
+		}
+		for _, step := range stage.Steps {
+			summary.Steps = append(summary.Steps, StepSummary{
+				Name:     step.Name,
+				Status:   step.Status,
+				ExitCode: step.ExitCode,
+				Duration: formatDuration(step.Started, step.Stopped),
+				Link:     fmt.Sprintf("%s/%d", stageLink, step.Number),
+				Failed:   isFailedStatus(step.Status) && !step.ErrIgnore,
+			})
+		}
+		stages = append(stages, summary)
+	}
+	return stages
+}
+
+// formatDuration formats the time between two Unix timestamps, or returns an
+// empty string when either of them is unset.
+func formatDuration(started, stopped int64) string {
+	if started == 0 || stopped < started {
+		return ""
+	}
+	return (time.Duration(stopped-started) * time.Second).String()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildStages() []*drone.Stage {
+	return []*drone.Stage{
+		{
+			Number: 1,
+			Name:   "default",
+			Status: drone.StatusFailing,
+			Steps: []*drone.Step{
+				{Number: 1, Name: "clone", Status: drone.StatusPassing, Started: 1700000000, Stopped: 1700000004},
+				{Number: 2, Name: "lint", Status: drone.StatusFailing, ErrIgnore: true, ExitCode: 1, Started: 1700000004, Stopped: 1700000010},
+				{Number: 3, Name: "test", Status: drone.StatusFailing, ExitCode: 2, Started: 1700000004, Stopped: 1700000096},
+				{Number: 4, Name: "publish", Status: drone.StatusSkipped},
+			},
+		},
+		{
+			Number: 2,
+			Name:   "docs",
+			Status: drone.StatusRunning,
+			Steps: []*drone.Step{
+				{Number: 1, Name: "build", Status: drone.StatusRunning, Started: 1700000000},
+			},
+		},
+	}
+}
+
+func TestSummarizeStages(t *testing.T) {
+	actual := summarizeStages(&drone.Build{Stages: buildStages()}, "https://drone.example.com/test/repo/42")
+
+	assert.Equal(t, []StageSummary{
+		{
+			Name:   "default",
+			Status: "failure",
+			Link:   "https://drone.example.com/test/repo/42/1",
+			Failed: true,
+			Steps: []StepSummary{
+				{Name: "clone", Status: "success", Duration: "4s", Link: "https://drone.example.com/test/repo/42/1/1"},
+				{Name: "lint", Status: "failure", ExitCode: 1, Duration: "6s", Link: "https://drone.example.com/test/repo/42/1/2"},
+				{Name: "test", Status: "failure", ExitCode: 2, Duration: "1m32s", Link: "https://drone.example.com/test/repo/42/1/3", Failed: true},
+				{Name: "publish", Status: "skipped", Link: "https://drone.example.com/test/repo/42/1/4"},
+			},
+		},
+		{
+			Name:   "docs",
+			Status: "running",
+			Link:   "https://drone.example.com/test/repo/42/2",
+			Steps: []StepSummary{
+				{Name: "build", Status: "running", Link: "https://drone.example.com/test/repo/42/2/1"},
+			},
+		},
+	}, actual)
+	assert.Empty(t, summarizeStages(&drone.Build{}, "https://drone.example.com/test/repo/42"))
+}
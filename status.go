@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"go.etcd.io/bbolt"
+)
+
+var statusBucket = []byte("status")
+
+type NotificationKind string
+
+const (
+	NotificationFailure  NotificationKind = "failure"
+	NotificationRecovery NotificationKind = "recovery"
+)
+
+type Notification struct {
+	Kind    NotificationKind
+	Request *webhook.Request
+	// FailedAuthors holds the authors of the failing builds that preceded a
+	// recovery, formatted as email addresses.
+	FailedAuthors []string
+
+	// previous is the branch status that Track replaced, restored by Rollback.
+	previous []byte
+}
+
+// BranchStatus is the last terminal status recorded for a repo and ref.
+type BranchStatus struct {
+	Status        string   `json:"status"`
+	BuildNumber   int64    `json:"build_number"`
+	FailedAuthors []string `json:"failed_authors,omitempty"`
+}
+
+type StatusTracker struct {
+	store *Store
+}
+
+func NewStatusTracker(store *Store) (*StatusTracker, error) {
+	if err := store.createBucket(statusBucket); err != nil {
+		return nil, err
+	}
+	return &StatusTracker{store: store}, nil
+}
+
+// Track records the terminal status of a build and decides which notification,
+// if any, it should produce: a failure notification for failed builds, and a
+// recovery notification when a repo and ref goes from failure or error back to
+// success. Builds that finish out of order do not override newer statuses.
+func (t *StatusTracker) Track(req *webhook.Request) (*Notification, error) {
+	build := req.Build
+	if build.Status != drone.StatusFailing && build.Status != drone.StatusError && build.Status != drone.StatusPassing {
+		return nil, nil
+	}
+
+	var n *Notification
+	if build.Status == drone.StatusFailing {
+		n = &Notification{Kind: NotificationFailure, Request: req}
+	}
+
+	key := []byte(req.Repo.Slug + "\x00" + build.Ref)
+	err := t.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(statusBucket)
+		var prev BranchStatus
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &prev); err != nil {
+				return err //nolint:wrapcheck // wrapped below
+			}
+		}
+		if build.Number < prev.BuildNumber {
+			return nil
+		}
+		previous := b.Get(key)
+
+		next := BranchStatus{Status: build.Status, BuildNumber: build.Number}
+		if isFailedStatus(build.Status) {
+			if isFailedStatus(prev.Status) {
+				next.FailedAuthors = prev.FailedAuthors
+			}
+			next.FailedAuthors = appendAddress(next.FailedAuthors, authorAddress(build))
+		} else if isFailedStatus(prev.Status) {
+			n = &Notification{Kind: NotificationRecovery, Request: req, FailedAuthors: prev.FailedAuthors}
+		}
+
+		if n != nil {
+			n.previous = append([]byte(nil), previous...)
+		}
+		v, err := json.Marshal(&next)
+		if err != nil {
+			return err //nolint:wrapcheck // wrapped below
+		}
+		return b.Put(key, v) //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return nil, fmt.Errorf("status tracker: update %s %s: %w", req.Repo.Slug, build.Ref, err)
+	}
+	return n, nil
+}
+
+// Rollback restores the branch status that Track replaced when producing n,
+// so that the notification is produced again when Drone retries a webhook
+// that could not be queued. A status recorded since then by a newer build is
+// kept.
+func (t *StatusTracker) Rollback(n *Notification) error {
+	req, build := n.Request, n.Request.Build
+	key := []byte(req.Repo.Slug + "\x00" + build.Ref)
+	err := t.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(statusBucket)
+		var current BranchStatus
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &current); err != nil {
+				return err //nolint:wrapcheck // wrapped below
+			}
+		}
+		if current.BuildNumber != build.Number || current.Status != build.Status {
+			return nil
+		}
+		if n.previous == nil {
+			return b.Delete(key) //nolint:wrapcheck // wrapped below
+		}
+		return b.Put(key, n.previous) //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return fmt.Errorf("status tracker: rollback %s %s: %w", req.Repo.Slug, build.Ref, err)
+	}
+	return nil
+}
+
+func isFailedStatus(status string) bool {
+	return status == drone.StatusFailing || status == drone.StatusError
+}
+
+// appendAddress appends addr unless a list entry already has the same email address.
+func appendAddress(list []string, addr string) []string {
+	key := addressKey(addr)
+	for _, existing := range list {
+		if addressKey(existing) == key {
+			return list
+		}
+	}
+	return append(list, addr)
+}
+
+func addressKey(addr string) string {
+	if parsed, err := mail.ParseAddress(addr); err == nil {
+		return strings.ToLower(parsed.Address)
+	}
+	return strings.ToLower(addr)
+}
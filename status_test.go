@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildStatusRequest(number int64, status, ref, author string) *webhook.Request {
+	return &webhook.Request{
+		Event:  webhook.EventBuild,
+		Action: webhook.ActionUpdated,
+		Repo:   &drone.Repo{Slug: "test/repo"},
+		Build: &drone.Build{
+			Number:      number,
+			Status:      status,
+			Ref:         ref,
+			AuthorName:  author,
+			AuthorEmail: author + "@example.com",
+		},
+	}
+}
+
+func TestStatusTracker_Track(t *testing.T) {
+	t.Run("failure", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		req := buildStatusRequest(1, "failure", "refs/heads/main", "alice")
+
+		n, err := tracker.Track(req)
+
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, NotificationFailure, n.Kind)
+		assert.Same(t, req, n.Request)
+		assert.Empty(t, n.FailedAuthors)
+	})
+
+	t.Run("success without previous failure", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+
+		n, err := tracker.Track(buildStatusRequest(1, "success", "refs/heads/main", "alice"))
+
+		require.NoError(t, err)
+		assert.Nil(t, n)
+	})
+
+	t.Run("non-terminal status", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		_, err := tracker.Track(buildStatusRequest(1, "failure", "refs/heads/main", "alice"))
+		require.NoError(t, err)
+
+		for _, status := range []string{"pending", "running", "killed", "skipped"} {
+			n, err := tracker.Track(buildStatusRequest(2, status, "refs/heads/main", "bob"))
+			require.NoError(t, err)
+			assert.Nil(t, n)
+		}
+		n, err := tracker.Track(buildStatusRequest(3, "success", "refs/heads/main", "carol"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, NotificationRecovery, n.Kind)
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		for i, step := range []struct{ status, author string }{
+			{"success", "alice"},
+			{"failure", "alice"},
+			{"error", "bob"},
+			{"failure", "alice"},
+		} {
+			_, err := tracker.Track(buildStatusRequest(int64(i+1), step.status, "refs/heads/main", step.author))
+			require.NoError(t, err)
+		}
+		req := buildStatusRequest(5, "success", "refs/heads/main", "carol")
+
+		n, err := tracker.Track(req)
+
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, NotificationRecovery, n.Kind)
+		assert.Same(t, req, n.Request)
+		assert.Equal(t, []string{"\"alice\" <alice@example.com>", "\"bob\" <bob@example.com>"}, n.FailedAuthors)
+
+		n, err = tracker.Track(buildStatusRequest(6, "success", "refs/heads/main", "carol"))
+		require.NoError(t, err)
+		assert.Nil(t, n)
+	})
+
+	t.Run("recovery with quoted author name", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		req := buildStatusRequest(1, "failure", "refs/heads/main", "john")
+		req.Build.AuthorName = "Doe, John"
+		_, err := tracker.Track(req)
+		require.NoError(t, err)
+
+		n, err := tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "carol"))
+
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		require.Len(t, n.FailedAuthors, 1)
+		addr, err := mail.ParseAddress(n.FailedAuthors[0])
+		require.NoError(t, err)
+		assert.Equal(t, &mail.Address{Name: "Doe, John", Address: "john@example.com"}, addr)
+	})
+
+	t.Run("error does not notify", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+
+		n, err := tracker.Track(buildStatusRequest(1, "error", "refs/heads/main", "alice"))
+
+		require.NoError(t, err)
+		assert.Nil(t, n)
+	})
+
+	t.Run("refs are tracked separately", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		_, err := tracker.Track(buildStatusRequest(1, "failure", "refs/heads/feature", "alice"))
+		require.NoError(t, err)
+
+		n, err := tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "bob"))
+
+		require.NoError(t, err)
+		assert.Nil(t, n)
+	})
+
+	t.Run("out of order build", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		_, err := tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+
+		n, err := tracker.Track(buildStatusRequest(1, "failure", "refs/heads/main", "alice"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, NotificationFailure, n.Kind)
+
+		n, err = tracker.Track(buildStatusRequest(3, "success", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+		assert.Nil(t, n)
+	})
+
+	t.Run("persists across reopen", func(t *testing.T) {
+		t.Parallel()
+		dataDir := t.TempDir()
+		store, err := OpenStore(dataDir)
+		require.NoError(t, err)
+		tracker, err := NewStatusTracker(store)
+		require.NoError(t, err)
+		_, err = tracker.Track(buildStatusRequest(1, "failure", "refs/heads/main", "alice"))
+		require.NoError(t, err)
+		store.Close()
+
+		store, err = OpenStore(dataDir)
+		require.NoError(t, err)
+		defer store.Close()
+		tracker, err = NewStatusTracker(store)
+		require.NoError(t, err)
+
+		n, err := tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, []string{"\"alice\" <alice@example.com>"}, n.FailedAuthors)
+	})
+}
+
+func TestStatusTracker_Rollback(t *testing.T) {
+	t.Run("restores previous status", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		_, err := tracker.Track(buildStatusRequest(1, "failure", "refs/heads/main", "alice"))
+		require.NoError(t, err)
+		n, err := tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+
+		require.NoError(t, tracker.Rollback(n))
+
+		n, err = tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, NotificationRecovery, n.Kind)
+		assert.Equal(t, []string{"\"alice\" <alice@example.com>"}, n.FailedAuthors)
+	})
+
+	t.Run("first build", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		n, err := tracker.Track(buildStatusRequest(1, "failure", "refs/heads/main", "alice"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+
+		require.NoError(t, tracker.Rollback(n))
+
+		n, err = tracker.Track(buildStatusRequest(2, "success", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+		assert.Nil(t, n)
+	})
+
+	t.Run("keeps newer status", func(t *testing.T) {
+		t.Parallel()
+		tracker := newStatusTracker(t)
+		n, err := tracker.Track(buildStatusRequest(1, "failure", "refs/heads/main", "alice"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		_, err = tracker.Track(buildStatusRequest(2, "failure", "refs/heads/main", "bob"))
+		require.NoError(t, err)
+
+		require.NoError(t, tracker.Rollback(n))
+
+		n, err = tracker.Track(buildStatusRequest(3, "success", "refs/heads/main", "carol"))
+		require.NoError(t, err)
+		require.NotNil(t, n)
+		assert.Equal(t, []string{"\"alice\" <alice@example.com>", "\"bob\" <bob@example.com>"}, n.FailedAuthors)
+	})
+}
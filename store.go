@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	storeFileName    = "drone-email-webhook.db"
+	storeOpenTimeout = 5 * time.Second
+)
+
+type Store struct {
+	db *bbolt.DB
+}
+
+func OpenStore(dataDir string) (*Store, error) {
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return nil, fmt.Errorf("store: create data dir %s: %w", dataDir, err)
+	}
+	path := filepath.Join(dataDir, storeFileName)
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: storeOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("store: open %s: %w", path, err)
+	}
+	slog.Info("store opened", "path", path)
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() {
+	if err := s.db.Close(); err != nil {
+		slog.Error("store close error", "err", err)
+	}
+}
+
+func (s *Store) createBucket(name []byte) error {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(name)
+		return err //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return fmt.Errorf("store: create bucket %s: %w", name, err)
+	}
+	return nil
+}
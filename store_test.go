@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := OpenStore(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestOpenStore(t *testing.T) {
+	t.Run("creates data dir", func(t *testing.T) {
+		t.Parallel()
+		dataDir := filepath.Join(t.TempDir(), "nested", "data")
+
+		store, err := OpenStore(dataDir)
+		require.NoError(t, err)
+		defer store.Close()
+
+		assert.FileExists(t, filepath.Join(dataDir, storeFileName))
+	})
+
+	t.Run("data dir is a file", func(t *testing.T) {
+		t.Parallel()
+		dataDir := filepath.Join(t.TempDir(), "file")
+		err := os.WriteFile(dataDir, nil, 0o600)
+		require.NoError(t, err)
+
+		_, err = OpenStore(dataDir)
+		assert.Error(t, err)
+	})
+}
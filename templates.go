@@ -0,0 +1,343 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	textTemplate "text/template"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	subjectTemplateFile  = "subject.tmpl"
+	htmlTemplateFile     = "body.html.tmpl"
+	textTemplateFile     = "body.txt.tmpl"
+	templateReloadDelay  = 200 * time.Millisecond
+	failureSubjectTempl  = "[{{.Repository}}] Failed build #{{.BuildNumber}} for {{.Reference}} ({{.CommitHash}})"
+	recoverySubjectTempl = "[{{.Repository}}] Fixed build #{{.BuildNumber}} for {{.Reference}} ({{.CommitHash}})"
+)
+
+var (
+	//go:embed email.html
+	htmlTemplStr string
+	//go:embed email.txt
+	textTemplStr string
+	//go:embed recovery.html
+	recoveryHTMLTemplStr string
+	//go:embed recovery.txt
+	recoveryTextTemplStr string
+
+	defaultTemplates = map[NotificationKind]emailTemplate{
+		NotificationFailure: {
+			subject: textTemplate.Must(textTemplate.New("subject").Parse(failureSubjectTempl)),
+			header:  "Build #%d has failed",
+			html:    htmlTemplate.Must(htmlTemplate.New("html").Parse(htmlTemplStr)),
+			text:    textTemplate.Must(textTemplate.New("text").Parse(textTemplStr)),
+		},
+		NotificationRecovery: {
+			subject: textTemplate.Must(textTemplate.New("recovery-subject").Parse(recoverySubjectTempl)),
+			header:  "Build #%d is back to green",
+			html:    htmlTemplate.Must(htmlTemplate.New("recovery-html").Parse(recoveryHTMLTemplStr)),
+			text:    textTemplate.Must(textTemplate.New("recovery-text").Parse(recoveryTextTemplStr)),
+		},
+	}
+
+	// sampleEmailData is used to validate templates before they replace the
+	// current ones. Every optional section is filled in, so that templates
+	// referring to fields that do not exist fail to execute.
+	sampleEmailData = emailData{
+		Subject:       "[octocat/hello-world] Failed build #42 for refs/heads/main (e92d9f39)",
+		From:          "drone@example.com",
+		To:            "Octocat <octocat@example.com>",
+		Header:        "Build #42 has failed",
+		Repository:    "octocat/hello-world",
+		Reference:     "refs/heads/main",
+		BuildNumber:   42,
+		Event:         "push",
+		Status:        "failure",
+		CommitHash:    "e92d9f39",
+		CommitMessage: "Update README",
+		AuthorAvatar:  "https://example.com/avatar.png",
+		AuthorName:    "Octocat",
+		Participants:  []Participant{{Role: "Co-authored-by", Name: "Hubot", Email: "hubot@example.com"}},
+		Stages: []StageSummary{{
+			Name:   "default",
+			Status: "failure",
+			Link:   "https://drone.example.com/octocat/hello-world/42/1",
+			Failed: true,
+			Steps: []StepSummary{{
+				Name:     "test",
+				Status:   "failure",
+				ExitCode: 1,
+				Duration: "1m32s",
+				Link:     "https://drone.example.com/octocat/hello-world/42/1/1",
+				Failed:   true,
+				LogTail:  "--- FAIL: TestHello",
+			}},
+		}},
+		DroneBuildLink:  "https://drone.example.com/octocat/hello-world/42",
+		DroneServerHost: "drone.example.com",
+		DroneServerLink: "https://drone.example.com",
+	}
+)
+
+type emailTemplate struct {
+	subject *textTemplate.Template
+	header  string
+	html    *htmlTemplate.Template
+	text    *textTemplate.Template
+}
+
+// emailData is the data passed to the subject and body templates.
+type emailData struct {
+	Subject         string
+	From            string
+	To              string
+	Header          string
+	Repository      string
+	Reference       string
+	BuildNumber     int64
+	Event           string
+	Status          string
+	CommitHash      string
+	CommitMessage   string
+	AuthorAvatar    htmlTemplate.URL
+	AuthorName      string
+	Participants    []Participant
+	Stages          []StageSummary
+	DroneBuildLink  string
+	DroneServerHost string
+	DroneServerLink string
+}
+
+// Templates holds the email templates of every notification kind. Templates
+// found in the template directory replace the embedded defaults, files in a
+// subdirectory named after the notification kind taking precedence over the
+// ones at the top level.
+type Templates struct {
+	dir       string
+	current   atomic.Pointer[map[NotificationKind]emailTemplate]
+	mu        sync.Mutex
+	watcher   *fsnotify.Watcher
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// LoadTemplates loads the templates from dir and fails if any of them cannot be
+// parsed or executed against sample data. An empty dir selects the embedded
+// defaults.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{dir: dir, done: make(chan struct{})}
+	templates, err := loadTemplates(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	t.current.Store(&templates)
+	return t, nil
+}
+
+// Get returns the template of the notification kind. A nil Templates returns
+// the embedded defaults.
+func (t *Templates) Get(kind NotificationKind) (emailTemplate, bool) {
+	templates := defaultTemplates
+	if t != nil {
+		templates = *t.current.Load()
+	}
+	templ, ok := templates[kind]
+	return templ, ok
+}
+
+// Reload reloads the templates from the template directory. Templates that
+// cannot be loaded are replaced with the embedded defaults.
+func (t *Templates) Reload() {
+	if t == nil || t.dir == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	templates, err := loadTemplates(t.dir, false)
+	if err != nil {
+		slog.Error("templates cannot be reloaded, using the embedded defaults", "dir", t.dir, "error", err)
+		templates = maps.Clone(defaultTemplates)
+	}
+	t.current.Store(&templates)
+	slog.Info("templates reloaded", "dir", t.dir)
+}
+
+// Watch reloads the templates whenever files in the template directory change,
+// until Close is called.
+func (t *Templates) Watch() error {
+	if t.dir == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("templates cannot create watcher: %w", err)
+	}
+	for _, dir := range t.watchedDirs() {
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("templates cannot watch %s: %w", dir, err)
+		}
+	}
+	t.watcher = watcher
+	go t.watch()
+	return nil
+}
+
+func (t *Templates) Close() {
+	if t == nil {
+		return
+	}
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.watcher != nil {
+			_ = t.watcher.Close()
+		}
+	})
+}
+
+// watch reloads the templates once the events of a burst of changes, such as an
+// editor saving a file, have settled.
+func (t *Templates) watch() {
+	timer := time.NewTimer(templateReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case event, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) && filepath.Dir(event.Name) == t.dir {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					_ = t.watcher.Add(event.Name)
+				}
+			}
+			timer.Reset(templateReloadDelay)
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("templates watcher failed", "dir", t.dir, "error", err)
+		case <-timer.C:
+			t.Reload()
+		}
+	}
+}
+
+func (t *Templates) watchedDirs() []string {
+	dirs := []string{t.dir}
+	for kind := range defaultTemplates {
+		dir := filepath.Join(t.dir, string(kind))
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// loadTemplates loads the templates of every notification kind from dir. In
+// strict mode the errors of all broken templates are returned, otherwise they
+// are logged and the embedded defaults are used instead.
+func loadTemplates(dir string, strict bool) (map[NotificationKind]emailTemplate, error) {
+	templates := make(map[NotificationKind]emailTemplate, len(defaultTemplates))
+	if dir == "" {
+		return maps.Clone(defaultTemplates), nil
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("templates cannot open directory: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("templates cannot open directory: %s is not a directory", dir)
+	}
+
+	var errs []error
+	fail := func(path string, err error) {
+		if strict {
+			errs = append(errs, err)
+			return
+		}
+		slog.Error("templates cannot load template, using the embedded default", "file", path, "error", err)
+	}
+	for kind, defaults := range defaultTemplates {
+		templ := defaults
+		if path, src, ok := readTemplate(dir, kind, subjectTemplateFile, fail); ok {
+			if parsed, err := parseTextTemplate(path, src); err != nil {
+				fail(path, err)
+			} else {
+				templ.subject = parsed
+			}
+		}
+		if path, src, ok := readTemplate(dir, kind, htmlTemplateFile, fail); ok {
+			if parsed, err := parseHTMLTemplate(path, src); err != nil {
+				fail(path, err)
+			} else {
+				templ.html = parsed
+			}
+		}
+		if path, src, ok := readTemplate(dir, kind, textTemplateFile, fail); ok {
+			if parsed, err := parseTextTemplate(path, src); err != nil {
+				fail(path, err)
+			} else {
+				templ.text = parsed
+			}
+		}
+		templates[kind] = templ
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// readTemplate reads the named template of the notification kind, looking in
+// the subdirectory of the kind first. It returns false when there is none.
+func readTemplate(dir string, kind NotificationKind, name string, fail func(string, error)) (string, string, bool) {
+	for _, path := range []string{filepath.Join(dir, string(kind), name), filepath.Join(dir, name)} {
+		src, err := os.ReadFile(path) //nolint:gosec // template paths come from the operator's configuration
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fail(path, fmt.Errorf("templates cannot read %s: %w", path, err))
+			return "", "", false
+		}
+		return path, string(src), true
+	}
+	return "", "", false
+}
+
+func parseTextTemplate(path, src string) (*textTemplate.Template, error) {
+	templ, err := textTemplate.New(filepath.Base(path)).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("templates cannot parse %s: %w", path, err)
+	}
+	if err := templ.Execute(io.Discard, &sampleEmailData); err != nil {
+		return nil, fmt.Errorf("templates cannot execute %s: %w", path, err)
+	}
+	return templ, nil
+}
+
+func parseHTMLTemplate(path, src string) (*htmlTemplate.Template, error) {
+	templ, err := htmlTemplate.New(filepath.Base(path)).Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("templates cannot parse %s: %w", path, err)
+	}
+	if err := templ.Execute(io.Discard, &sampleEmailData); err != nil {
+		return nil, fmt.Errorf("templates cannot execute %s: %w", path, err)
+	}
+	return templ, nil
+}
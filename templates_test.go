@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+}
+
+func executeSubject(t *testing.T, templates *Templates, kind NotificationKind) string {
+	t.Helper()
+	templ, ok := templates.Get(kind)
+	require.True(t, ok)
+	var b bytes.Buffer
+	require.NoError(t, templ.subject.Execute(&b, &sampleEmailData))
+	return b.String()
+}
+
+func TestLoadTemplates(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Parallel()
+		templates, err := LoadTemplates("")
+
+		require.NoError(t, err)
+		for kind, defaults := range defaultTemplates {
+			templ, ok := templates.Get(kind)
+			require.True(t, ok)
+			assert.Same(t, defaults.html, templ.html)
+			assert.Same(t, defaults.text, templ.text)
+			assert.Same(t, defaults.subject, templ.subject)
+		}
+		assert.Equal(t, "[octocat/hello-world] Failed build #42 for refs/heads/main (e92d9f39)", executeSubject(t, templates, NotificationFailure))
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{
+			"subject.tmpl":          "{{.Repository}} #{{.BuildNumber}}: {{.Status}}",
+			"body.txt.tmpl":         "Build {{.BuildNumber}} by {{.AuthorName}}",
+			"recovery/subject.tmpl": "{{.Repository}} is green again",
+		})
+
+		templates, err := LoadTemplates(dir)
+
+		require.NoError(t, err)
+		assert.Equal(t, "octocat/hello-world #42: failure", executeSubject(t, templates, NotificationFailure))
+		assert.Equal(t, "octocat/hello-world is green again", executeSubject(t, templates, NotificationRecovery))
+		for kind, defaults := range defaultTemplates {
+			templ, _ := templates.Get(kind)
+			assert.Same(t, defaults.html, templ.html)
+			assert.NotSame(t, defaults.text, templ.text)
+		}
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		t.Parallel()
+		_, err := LoadTemplates(filepath.Join(t.TempDir(), "missing"))
+
+		assert.Error(t, err)
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		t.Parallel()
+		_, err := LoadTemplates(writeFile(t, "subject.tmpl", "{{.Repository}}"))
+
+		assert.Error(t, err)
+	})
+
+	for name, files := range map[string]map[string]string{
+		"parse error":   {"body.html.tmpl": "{{if .Stages}}"},
+		"unknown field": {"failure/body.txt.tmpl": "{{.Commit}}"},
+		"invalid range": {"subject.tmpl": "{{range .Stages}}{{.Missing}}{{end}}"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			writeTemplates(t, dir, files)
+
+			_, err := LoadTemplates(dir)
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTemplates_Reload(t *testing.T) {
+	t.Run("replaces changed templates", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "before"})
+		templates, err := LoadTemplates(dir)
+		require.NoError(t, err)
+
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "after"})
+		templates.Reload()
+
+		assert.Equal(t, "after", executeSubject(t, templates, NotificationFailure))
+	})
+
+	t.Run("falls back to defaults on errors", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "before", "body.txt.tmpl": "text"})
+		templates, err := LoadTemplates(dir)
+		require.NoError(t, err)
+
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "{{.Unknown}}"})
+		templates.Reload()
+
+		assert.Equal(t, "[octocat/hello-world] Failed build #42 for refs/heads/main (e92d9f39)", executeSubject(t, templates, NotificationFailure))
+		templ, _ := templates.Get(NotificationFailure)
+		assert.NotSame(t, defaultTemplates[NotificationFailure].text, templ.text)
+	})
+
+	t.Run("falls back to defaults when the directory is gone", func(t *testing.T) {
+		t.Parallel()
+		dir := filepath.Join(t.TempDir(), "templates")
+		writeTemplates(t, dir, map[string]string{"subject.tmpl": "before"})
+		templates, err := LoadTemplates(dir)
+		require.NoError(t, err)
+
+		require.NoError(t, os.RemoveAll(dir))
+		templates.Reload()
+
+		templ, _ := templates.Get(NotificationFailure)
+		assert.Same(t, defaultTemplates[NotificationFailure].subject, templ.subject)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		t.Parallel()
+		var templates *Templates
+
+		templates.Reload()
+		templates.Close()
+
+		templ, ok := templates.Get(NotificationRecovery)
+		require.True(t, ok)
+		assert.Same(t, defaultTemplates[NotificationRecovery].html, templ.html)
+	})
+}
+
+func TestTemplates_Watch(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{"subject.tmpl": "before"})
+	templates, err := LoadTemplates(dir)
+	require.NoError(t, err)
+	require.NoError(t, templates.Watch())
+	defer templates.Close()
+
+	writeTemplates(t, dir, map[string]string{"subject.tmpl": "after"})
+	assert.Eventually(t, func() bool {
+		return executeSubject(t, templates, NotificationFailure) == "after"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	writeTemplates(t, dir, map[string]string{"recovery/subject.tmpl": "recovered"})
+	assert.Eventually(t, func() bool {
+		return executeSubject(t, templates, NotificationRecovery) == "recovered"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	writeTemplates(t, dir, map[string]string{"recovery/subject.tmpl": "recovered again"})
+	assert.Eventually(t, func() bool {
+		return executeSubject(t, templates, NotificationRecovery) == "recovered again"
+	}, 5*time.Second, 50*time.Millisecond)
+}
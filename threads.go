@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"go.etcd.io/bbolt"
+)
+
+// threadMaxReferences caps the References header of long threads. The root
+// message is always kept, followed by the most recent ones.
+const threadMaxReferences = 20
+
+var (
+	threadsBucket = []byte("threads")
+
+	pullRequestRefRegexp = regexp.MustCompile(`^refs/(?:pull|pull-requests|merge-requests)/(\d+)/`)
+	messageIDRegexp      = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+)
+
+// Thread holds the Message-IDs of the messages sent so far in the conversation
+// of a repo and ref, or pull request, starting with the root message.
+type Thread struct {
+	References []string `json:"references"`
+}
+
+// ThreadHeaders are the threading headers of a message.
+type ThreadHeaders struct {
+	MessageID  string
+	InReplyTo  string
+	References string
+}
+
+type ThreadTracker struct {
+	store *Store
+}
+
+func NewThreadTracker(store *Store) (*ThreadTracker, error) {
+	if err := store.createBucket(threadsBucket); err != nil {
+		return nil, err
+	}
+	return &ThreadTracker{store: store}, nil
+}
+
+// Next records the message in the thread of its repo and ref, or pull request,
+// and returns its threading headers. A recovery ends the thread, so that the
+// next failure starts a new conversation. Rendering the same notification
+// again yields the same headers.
+func (t *ThreadTracker) Next(n *Notification, domain string) (ThreadHeaders, error) {
+	req := n.Request
+	id := messageID(req, n.Kind, domain)
+	key := []byte(threadKey(req))
+
+	var parents []string
+	err := t.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(threadsBucket)
+		var thread Thread
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &thread); err != nil {
+				return err //nolint:wrapcheck // wrapped below
+			}
+		}
+		if i := slices.Index(thread.References, id); i >= 0 {
+			parents = thread.References[:i]
+			return nil
+		}
+		parents = thread.References
+
+		if n.Kind == NotificationRecovery {
+			return b.Delete(key) //nolint:wrapcheck // wrapped below
+		}
+		thread.References = capReferences(append(slices.Clone(thread.References), id))
+		v, err := json.Marshal(&thread)
+		if err != nil {
+			return err //nolint:wrapcheck // wrapped below
+		}
+		return b.Put(key, v) //nolint:wrapcheck // wrapped below
+	})
+	if err != nil {
+		return ThreadHeaders{}, fmt.Errorf("thread tracker: update %s: %w", strings.ReplaceAll(string(key), "\x00", " "), err)
+	}
+
+	headers := ThreadHeaders{MessageID: id}
+	if len(parents) > 0 {
+		headers.InReplyTo = parents[len(parents)-1]
+		headers.References = strings.Join(parents, " ")
+	}
+	return headers, nil
+}
+
+// threadKey groups the builds of a pull request by its number, and the other
+// builds by their ref.
+func threadKey(req *webhook.Request) string {
+	if req.Build.Event == drone.EventPullRequest {
+		if m := pullRequestRefRegexp.FindStringSubmatch(req.Build.Ref); m != nil {
+			return req.Repo.Slug + "\x00pr/" + m[1]
+		}
+	}
+	return req.Repo.Slug + "\x00" + req.Build.Ref
+}
+
+// messageID returns a Message-ID that is unique to the build and notification
+// kind, so that re-rendering a notification does not produce a new message.
+func messageID(req *webhook.Request, kind NotificationKind, domain string) string {
+	slug := strings.Trim(messageIDRegexp.ReplaceAllString(req.Repo.Slug, "."), ".")
+	return fmt.Sprintf("<%d.%s.%s@%s>", req.Build.Number, kind, slug, domain)
+}
+
+// messageIDDomain returns the domain of the sender address, which is used as
+// the right-hand side of Message-IDs.
+func messageIDDomain(from string) string {
+	addr := from
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		addr = parsed.Address
+	}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 && i < len(addr)-1 {
+		return addr[i+1:]
+	}
+	return "localhost"
+}
+
+func capReferences(refs []string) []string {
+	if len(refs) <= threadMaxReferences {
+		return refs
+	}
+	return append(refs[:1], refs[len(refs)-threadMaxReferences+1:]...)
+}
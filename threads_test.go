@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newThreadTracker(t *testing.T) *ThreadTracker {
+	t.Helper()
+	threads, err := NewThreadTracker(newStore(t))
+	require.NoError(t, err)
+	return threads
+}
+
+func buildThreadNotification(kind NotificationKind, number int64, event, ref string) *Notification {
+	return &Notification{
+		Kind: kind,
+		Request: &webhook.Request{
+			Repo:  &drone.Repo{Slug: "test/repo"},
+			Build: &drone.Build{Number: number, Event: event, Ref: ref},
+		},
+	}
+}
+
+func TestThreadTracker_Next(t *testing.T) {
+	t.Run("thread", func(t *testing.T) {
+		t.Parallel()
+		threads := newThreadTracker(t)
+
+		first, err := threads.Next(buildThreadNotification(NotificationFailure, 1, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+		second, err := threads.Next(buildThreadNotification(NotificationFailure, 2, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+		recovery, err := threads.Next(buildThreadNotification(NotificationRecovery, 3, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+		next, err := threads.Next(buildThreadNotification(NotificationFailure, 4, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+
+		assert.Equal(t, ThreadHeaders{MessageID: "<1.failure.test.repo@example.com>"}, first)
+		assert.Equal(t, ThreadHeaders{
+			MessageID:  "<2.failure.test.repo@example.com>",
+			InReplyTo:  "<1.failure.test.repo@example.com>",
+			References: "<1.failure.test.repo@example.com>",
+		}, second)
+		assert.Equal(t, ThreadHeaders{
+			MessageID:  "<3.recovery.test.repo@example.com>",
+			InReplyTo:  "<2.failure.test.repo@example.com>",
+			References: "<1.failure.test.repo@example.com> <2.failure.test.repo@example.com>",
+		}, recovery)
+		assert.Equal(t, ThreadHeaders{MessageID: "<4.failure.test.repo@example.com>"}, next)
+	})
+
+	t.Run("rendered again", func(t *testing.T) {
+		t.Parallel()
+		threads := newThreadTracker(t)
+		_, err := threads.Next(buildThreadNotification(NotificationFailure, 1, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+		expected, err := threads.Next(buildThreadNotification(NotificationFailure, 2, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+
+		actual, err := threads.Next(buildThreadNotification(NotificationFailure, 2, "push", "refs/heads/main"), "example.com")
+
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("separate refs", func(t *testing.T) {
+		t.Parallel()
+		threads := newThreadTracker(t)
+		_, err := threads.Next(buildThreadNotification(NotificationFailure, 1, "push", "refs/heads/main"), "example.com")
+		require.NoError(t, err)
+
+		actual, err := threads.Next(buildThreadNotification(NotificationFailure, 2, "push", "refs/heads/feature"), "example.com")
+
+		require.NoError(t, err)
+		assert.Empty(t, actual.InReplyTo)
+	})
+
+	t.Run("pull request", func(t *testing.T) {
+		t.Parallel()
+		threads := newThreadTracker(t)
+		_, err := threads.Next(buildThreadNotification(NotificationFailure, 1, "pull_request", "refs/pull/12/head"), "example.com")
+		require.NoError(t, err)
+
+		actual, err := threads.Next(buildThreadNotification(NotificationFailure, 2, "pull_request", "refs/pull/12/merge"), "example.com")
+
+		require.NoError(t, err)
+		assert.Equal(t, "<1.failure.test.repo@example.com>", actual.InReplyTo)
+	})
+
+	t.Run("long thread", func(t *testing.T) {
+		t.Parallel()
+		threads := newThreadTracker(t)
+		var actual ThreadHeaders
+		for i := range threadMaxReferences + 5 {
+			var err error
+			actual, err = threads.Next(buildThreadNotification(NotificationFailure, int64(i+1), "push", "refs/heads/main"), "example.com")
+			require.NoError(t, err)
+		}
+
+		refs := strings.Fields(actual.References)
+		assert.Len(t, refs, threadMaxReferences)
+		assert.Equal(t, "<1.failure.test.repo@example.com>", refs[0])
+		assert.Equal(t, fmt.Sprintf("<%d.failure.test.repo@example.com>", threadMaxReferences+4), refs[len(refs)-1])
+		assert.Equal(t, refs[len(refs)-1], actual.InReplyTo)
+	})
+}
+
+func TestThreadKey(t *testing.T) {
+	for _, tc := range []struct {
+		event    string
+		ref      string
+		expected string
+	}{
+		{event: "push", ref: "refs/heads/main", expected: "test/repo\x00refs/heads/main"},
+		{event: "tag", ref: "refs/tags/v1.0.0", expected: "test/repo\x00refs/tags/v1.0.0"},
+		{event: "pull_request", ref: "refs/pull/12/head", expected: "test/repo\x00pr/12"},
+		{event: "pull_request", ref: "refs/merge-requests/7/head", expected: "test/repo\x00pr/7"},
+		{event: "pull_request", ref: "refs/heads/feature", expected: "test/repo\x00refs/heads/feature"},
+		{event: "push", ref: "refs/pull/12/head", expected: "test/repo\x00refs/pull/12/head"},
+	} {
+		n := buildThreadNotification(NotificationFailure, 1, tc.event, tc.ref)
+		assert.Equal(t, tc.expected, threadKey(n.Request), tc.event+" "+tc.ref)
+	}
+}
+
+func TestMessageIDDomain(t *testing.T) {
+	assert.Equal(t, "example.com", messageIDDomain("ci@example.com"))
+	assert.Equal(t, "example.com", messageIDDomain("Drone CI <ci@example.com>"))
+	assert.Equal(t, "localhost", messageIDDomain("drone"))
+	assert.Equal(t, "localhost", messageIDDomain("drone@"))
+}
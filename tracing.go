@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/drone/drone-go/plugin/webhook"
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName            = "drone-email-webhook"
+	tracerName             = "github.com/yegor-usoltsev/drone-email-webhook"
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// tracingEnvVars enable tracing when one of them is set, so that the service
+// does not export spans to the default OTLP endpoint unless asked to.
+var tracingEnvVars = []string{
+	"OTEL_TRACES_EXPORTER",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+}
+
+var (
+	tracer     = otel.Tracer(tracerName)
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+)
+
+// SetupTracing installs the global tracer provider and propagator, configured
+// by the standard OTEL_* environment variables. It returns a function that
+// flushes and stops the exporter. Tracing stays disabled unless an exporter or
+// an OTLP endpoint is configured, or when OTEL_SDK_DISABLED is true.
+func SetupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	noop := func(context.Context) error { return nil }
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return noop, nil
+	}
+	if !slices.ContainsFunc(tracingEnvVars, func(key string) bool { return os.Getenv(key) != "" }) {
+		return noop, nil
+	}
+
+	exporter, err := autoexport.NewSpanExporter(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: create exporter: %w", err)
+	}
+	if autoexport.IsNoneSpanExporter(exporter) {
+		return noop, nil
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName), semconv.ServiceVersion(version)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: create resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	slog.Info("tracing enabled")
+	return provider.Shutdown, nil
+}
+
+// buildAttributes returns the span attributes that identify the build of a
+// webhook request.
+func buildAttributes(req *webhook.Request) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("drone.build.id", req.Build.ID),
+		attribute.Int64("drone.build.number", req.Build.Number),
+		attribute.String("drone.repo.slug", req.Repo.Slug),
+	}
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log records carry the given attributes,
+// in addition to the ones already attached to ctx.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(slices.Clip(attrs), attr)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// ContextHandler is a slog handler that adds the trace and span IDs of the
+// current span, and the attributes attached with withLogAttrs, to the records
+// logged with a context.
+type ContextHandler struct {
+	slog.Handler
+}
+
+func NewContextHandler(h slog.Handler) *ContextHandler {
+	return &ContextHandler{Handler: h}
+}
+
+func (h *ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanCtx.TraceID().String()), slog.String("span_id", spanCtx.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record) //nolint:wrapcheck // handlers are chained
+}
+
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var testSpanContext = trace.NewSpanContext(trace.SpanContextConfig{
+	TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+	SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	TraceFlags: trace.FlagsSampled,
+	Remote:     true,
+})
+
+func logRecord(t *testing.T, log func(*slog.Logger)) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	log(slog.New(NewContextHandler(slog.NewJSONHandler(&buf, nil))))
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	return record
+}
+
+func TestSetupTracing(t *testing.T) {
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Setenv("OTEL_TRACES_EXPORTER", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+		t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+		shutdown, err := SetupTracing(t.Context())
+
+		require.NoError(t, err)
+		assert.NoError(t, shutdown(t.Context()))
+	})
+
+	t.Run("sdk disabled", func(t *testing.T) {
+		t.Setenv("OTEL_SDK_DISABLED", "true")
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+
+		shutdown, err := SetupTracing(t.Context())
+
+		require.NoError(t, err)
+		assert.NoError(t, shutdown(t.Context()))
+	})
+
+	t.Run("none exporter", func(t *testing.T) {
+		t.Setenv("OTEL_TRACES_EXPORTER", "none")
+
+		shutdown, err := SetupTracing(t.Context())
+
+		require.NoError(t, err)
+		assert.NoError(t, shutdown(t.Context()))
+	})
+
+	t.Run("unknown exporter", func(t *testing.T) {
+		t.Setenv("OTEL_TRACES_EXPORTER", "unknown")
+
+		_, err := SetupTracing(t.Context())
+
+		assert.Error(t, err)
+	})
+}
+
+func TestContextHandler(t *testing.T) {
+	t.Run("trace and attributes", func(t *testing.T) {
+		t.Parallel()
+		ctx := trace.ContextWithSpanContext(t.Context(), testSpanContext)
+		ctx = withLogAttrs(ctx, "build_id", int64(42), "repo_slug", "test/repo")
+		ctx = withLogAttrs(ctx, slog.String("kind", "failure"))
+
+		record := logRecord(t, func(logger *slog.Logger) {
+			logger.InfoContext(ctx, "test message", "build_number", 7)
+		})
+
+		assert.Equal(t, "test message", record["msg"])
+		assert.InDelta(t, 7, record["build_number"], 0)
+		assert.InDelta(t, 42, record["build_id"], 0)
+		assert.Equal(t, "test/repo", record["repo_slug"])
+		assert.Equal(t, "failure", record["kind"])
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", record["trace_id"])
+		assert.Equal(t, "00f067aa0ba902b7", record["span_id"])
+	})
+
+	t.Run("without context", func(t *testing.T) {
+		t.Parallel()
+		record := logRecord(t, func(logger *slog.Logger) {
+			logger.With("component", "test").Info("test message")
+		})
+
+		assert.Equal(t, "test", record["component"])
+		assert.NotContains(t, record, "trace_id")
+		assert.NotContains(t, record, "build_id")
+	})
+
+	t.Run("attributes do not leak", func(t *testing.T) {
+		t.Parallel()
+		parent := withLogAttrs(context.Background(), "build_id", int64(1))
+		_ = withLogAttrs(parent, "repo_slug", "test/repo")
+
+		record := logRecord(t, func(logger *slog.Logger) {
+			logger.InfoContext(parent, "test message")
+		})
+
+		assert.InDelta(t, 1, record["build_id"], 0)
+		assert.NotContains(t, record, "repo_slug")
+	})
+}
+
+func TestEmailSender_TraceContext(t *testing.T) {
+	t.Parallel()
+	queue := newQueue(t)
+	emailSender := &EmailSender{
+		from:     "ci@example.com",
+		overflow: OverflowReject,
+		queue:    queue,
+		jobs:     make(chan *QueueItem, 1),
+		done:     make(chan struct{}),
+	}
+	req := buildWebhookRequest()
+	ctx := trace.ContextWithRemoteSpanContext(t.Context(), testSpanContext)
+
+	require.NoError(t, emailSender.SendAsync(ctx, buildNotification(req)))
+
+	item := <-emailSender.jobs
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", item.TraceContext["traceparent"])
+	assert.Equal(t, req.Build.ID, item.BuildID)
+	assert.Equal(t, req.Repo.Slug, item.RepoSlug)
+
+	items, err := queue.Pending()
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, item.TraceContext, items[0].TraceContext)
+}
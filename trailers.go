@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var trailerRegexp = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)[ \t]*:[ \t]*(.*)$`)
+
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+// Participant is a person named in a commit message trailer, such as
+// "Co-authored-by: Alice <alice@example.com>".
+type Participant struct {
+	Role  string
+	Name  string
+	Email string
+}
+
+// ParseTrailers returns the trailers of a commit message: the lines of its last
+// paragraph, which must not be the subject, when every one of them is either a
+// "Key: value" pair or a whitespace-indented continuation of the previous one.
+func ParseTrailers(message string) []Trailer {
+	paragraphs := strings.Split(strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n")), "\n\n")
+	if len(paragraphs) < 2 {
+		return nil
+	}
+
+	var trailers []Trailer
+	for line := range strings.SplitSeq(strings.TrimSpace(paragraphs[len(paragraphs)-1]), "\n") {
+		if len(trailers) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			trailers[len(trailers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		m := trailerRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil
+		}
+		trailers = append(trailers, Trailer{Key: m[1], Value: strings.TrimSpace(m[2])})
+	}
+	return trailers
+}
+
+// participants returns the people named in the trailers of the commit message
+// whose keys are listed, case-insensitively, in roles. The author and repeated
+// addresses are skipped, and the role is reported as spelled in roles.
+func participants(message, authorEmail string, roles []string) []Participant {
+	var result []Participant
+	seen := []string{strings.ToLower(authorEmail)}
+	for _, trailer := range ParseTrailers(message) {
+		i := slices.IndexFunc(roles, func(role string) bool { return strings.EqualFold(role, trailer.Key) })
+		if i < 0 {
+			continue
+		}
+		addr, err := mail.ParseAddress(trailer.Value)
+		if err != nil {
+			continue
+		}
+		if key := strings.ToLower(addr.Address); !slices.Contains(seen, key) {
+			seen = append(seen, key)
+			result = append(result, Participant{Role: roles[i], Name: addr.Name, Email: addr.Address})
+		}
+	}
+	return result
+}
+
+func (p Participant) Author() Author {
+	return Author{Name: p.Name, Email: p.Email}
+}
+
+// DisplayName returns the name of the participant, or their email address when
+// the trailer has no name.
+func (p Participant) DisplayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Email
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrailers(t *testing.T) {
+	for name, tc := range map[string]struct {
+		message  string
+		expected []Trailer
+	}{
+		"trailers": {
+			message: "feat: pair on the parser\n\nSome details.\n\nCo-authored-by: Alice <alice@example.com>\r\nSigned-off-by : Bob <bob@example.com>\n",
+			expected: []Trailer{
+				{Key: "Co-authored-by", Value: "Alice <alice@example.com>"},
+				{Key: "Signed-off-by", Value: "Bob <bob@example.com>"},
+			},
+		},
+		"continuation line": {
+			message: "fix: typo\n\nReviewed-by: Carol\n  <carol@example.com>\n",
+			expected: []Trailer{
+				{Key: "Reviewed-by", Value: "Carol <carol@example.com>"},
+			},
+		},
+		"subject only": {
+			message: "Co-authored-by: Alice <alice@example.com>",
+		},
+		"last paragraph is not a trailer block": {
+			message: "fix: typo\n\nCo-authored-by: Alice <alice@example.com>\nand some more text\n",
+		},
+		"no trailers": {
+			message: "fix: typo\n\nSome details.\n",
+		},
+	} {
+		assert.Equal(t, tc.expected, ParseTrailers(tc.message), name)
+	}
+}
+
+func TestParticipants(t *testing.T) {
+	message := `feat: pair on the parser
+
+Co-authored-by: Alice <alice@example.com>
+Co-authored-by: Test User <TEST@example.com>
+Signed-off-by: Test User <test@example.com>
+Signed-off-by: Alice <alice@example.com>
+Reviewed-by: bob@example.com
+Reviewed-by: not an address
+Acked-by: Carol <carol@example.com>
+`
+
+	actual := participants(message, "test@example.com", []string{"co-authored-by", "Signed-off-by", "Reviewed-by"})
+
+	assert.Equal(t, []Participant{
+		{Role: "co-authored-by", Name: "Alice", Email: "alice@example.com"},
+		{Role: "Reviewed-by", Email: "bob@example.com"},
+	}, actual)
+	assert.Equal(t, "Alice", actual[0].DisplayName())
+	assert.Equal(t, "bob@example.com", actual[1].DisplayName())
+	assert.Empty(t, participants(message, "test@example.com", nil))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	apiTimeout      = 30 * time.Second
+	apiMaxErrorBody = 64 << 10
+)
+
+// Transport delivers rendered messages to their To, Cc and Bcc recipients.
+type Transport interface {
+	Send(ctx context.Context, emailMsg *email.Email) error
+	// Check verifies that messages can be delivered, without sending any.
+	Check(ctx context.Context) error
+	// Close releases the connections kept open between deliveries.
+	Close()
+}
+
+// NewTransport configures the transport selected by DRONE_EMAIL_TRANSPORT.
+func NewTransport(cfg Config) (Transport, error) {
+	if cfg.EmailDKIMKeyFile != "" && (cfg.EmailTransport == TransportSendGrid || cfg.EmailTransport == TransportPostmark) {
+		slog.Warn("email sender ignores dkim settings, the email api signs messages with the domains of the account", "transport", cfg.EmailTransport)
+	}
+	switch cfg.EmailTransport {
+	case TransportSendGrid:
+		return NewSendGridTransport(cfg)
+	case TransportMailgun:
+		return NewMailgunTransport(cfg)
+	case TransportSES:
+		return NewSESTransport(cfg)
+	case TransportPostmark:
+		return NewPostmarkTransport(cfg)
+	case TransportSendmail:
+		return NewSendmailTransport(cfg)
+	case TransportMaildir:
+		return NewMaildirTransport(cfg)
+	case TransportSMTP, "":
+		relays, err := NewSMTPRelays(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.EmailSMTPRelaysFile != "" {
+			slog.Info("email sender loaded smtp relays", "file", cfg.EmailSMTPRelaysFile, "selection", relays.selection, "relays", len(relays.relays))
+		}
+		return relays, nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %q", cfg.EmailTransport)
+	}
+}
+
+// apiError is an error response of an email API. Permanent errors are
+// rejections of the message itself, such as an invalid or suppressed
+// recipient, which retrying the delivery cannot fix; rate limits, server
+// errors and configuration errors, such as invalid credentials, are not.
+type apiError struct {
+	provider  string
+	status    int
+	code      string
+	message   string
+	permanent bool
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%s api: %d", e.provider, e.status)
+	if e.code != "" {
+		msg += " " + e.code
+	}
+	if e.message != "" {
+		msg += ": " + e.message
+	}
+	return msg
+}
+
+// isPermanent reports whether retrying a failed delivery cannot succeed: the
+// message has an invalid envelope, or it was rejected by the SMTP server with
+// a 5xx reply, by the API or by the sendmail binary.
+func isPermanent(err error) bool {
+	var envelopeErr *envelopeError
+	if errors.As(err, &envelopeErr) {
+		return true
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code/100 == 5
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.permanent
+	}
+	var sendmailErr *sendmailError
+	return errors.As(err, &sendmailErr) && sendmailErr.permanent
+}
+
+// envelopeError is an invalid sender or recipient address of a message.
+type envelopeError struct {
+	err error
+}
+
+func (e *envelopeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *envelopeError) Unwrap() error {
+	return e.err
+}
+
+// apiClient sends requests to the HTTP API of an email provider.
+type apiClient struct {
+	provider   string
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+func newAPIClient(provider, baseURL string) (*apiClient, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s api: invalid url %q", provider, baseURL)
+	}
+	return &apiClient{
+		provider: provider,
+		baseURL:  u,
+		httpClient: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   apiTimeout,
+		},
+	}, nil
+}
+
+// newRequest returns a request to the path of the API.
+func (c *apiClient) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL.String()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s api: %w", c.provider, err)
+	}
+	return req, nil
+}
+
+// do sends the request and returns the body of a successful response, or the
+// error returned by decodeError for the other ones.
+func (c *apiClient) do(req *http.Request, decodeError func(resp *http.Response, body []byte) *apiError) ([]byte, error) {
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(
+		attribute.String("server.address", c.baseURL.Hostname()),
+		attribute.String("server.port", urlPort(c.baseURL)),
+	)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s api: %w", c.provider, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, apiMaxErrorBody))
+	if err != nil {
+		return nil, fmt.Errorf("%s api: %w", c.provider, err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return body, nil
+	}
+	apiErr := decodeError(resp, body)
+	apiErr.provider, apiErr.status = c.provider, resp.StatusCode
+	if apiErr.message == "" {
+		apiErr.message = http.StatusText(resp.StatusCode)
+	}
+	return nil, apiErr
+}
+
+// urlPort returns the port of the URL, or the default port of its scheme.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
+
+// apiMessage is a message split into the parts that the JSON email APIs take
+// separately.
+type apiMessage struct {
+	From        *mail.Address
+	ReplyTo     []*mail.Address
+	To          []*mail.Address
+	Cc          []*mail.Address
+	Bcc         []*mail.Address
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     [][2]string
+	Attachments []apiAttachment
+}
+
+type apiAttachment struct {
+	Filename    string
+	ContentType string
+	// ContentID is set for the inline images referenced by the HTML body.
+	ContentID string
+	Content   string
+}
+
+// apiReservedHeaders are set by the APIs from the message fields, so that they
+// are not passed along with the other headers, which include the threading
+// ones.
+var apiReservedHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Subject", "Date", "Mime-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+func newAPIMessage(emailMsg *email.Email) (*apiMessage, error) {
+	from, err := mail.ParseAddress(emailMsg.From)
+	if err != nil {
+		return nil, &envelopeError{fmt.Errorf("invalid sender %q: %w", emailMsg.From, err)}
+	}
+	msg := &apiMessage{
+		From:    from,
+		Subject: emailMsg.Subject,
+		Text:    string(emailMsg.Text),
+		HTML:    string(emailMsg.HTML),
+	}
+	for _, list := range []struct {
+		dst  *[]*mail.Address
+		addr []string
+	}{
+		{&msg.ReplyTo, emailMsg.ReplyTo},
+		{&msg.To, emailMsg.To},
+		{&msg.Cc, emailMsg.Cc},
+		{&msg.Bcc, emailMsg.Bcc},
+	} {
+		for _, rcpt := range list.addr {
+			addr, err := mail.ParseAddress(rcpt)
+			if err != nil {
+				return nil, &envelopeError{fmt.Errorf("invalid recipient %q: %w", rcpt, err)}
+			}
+			*list.dst = append(*list.dst, addr)
+		}
+	}
+	if len(msg.To)+len(msg.Cc)+len(msg.Bcc) == 0 {
+		return nil, &envelopeError{errors.New("no recipients")}
+	}
+
+	for key, values := range emailMsg.Headers {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		if len(values) == 0 || slices.Contains(apiReservedHeaders, key) {
+			continue
+		}
+		msg.Headers = append(msg.Headers, [2]string{key, values[0]})
+	}
+	slices.SortFunc(msg.Headers, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+
+	for _, a := range emailMsg.Attachments {
+		attachment := apiAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+		}
+		if a.HTMLRelated {
+			attachment.ContentID = a.Filename
+		}
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+	return msg, nil
+}
+
+// recipients returns the envelope recipients of the message.
+func (m *apiMessage) recipients() []*mail.Address {
+	return append(append(append([]*mail.Address(nil), m.To...), m.Cc...), m.Bcc...)
+}
+
+// formatAddresses returns the addresses as a header value.
+func formatAddresses(addrs []*mail.Address) string {
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = addr.String()
+	}
+	return strings.Join(list, ", ")
+}
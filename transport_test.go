@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apiRequest is a request received by an apiServer.
+type apiRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// apiServer is a local stand-in of an email API that records the requests it
+// receives and answers them with handler.
+type apiServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []apiRequest
+}
+
+func startAPIServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body []byte)) *apiServer {
+	t.Helper()
+	s := &apiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, apiRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+		s.mu.Unlock()
+		handler(w, r, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *apiServer) Requests() []apiRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]apiRequest(nil), s.requests...)
+}
+
+// writeJSON answers with the JSON body and the status.
+func writeJSON(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, body)
+}
+
+// testAPIEmail returns a message with the headers and attachments of a
+// rendered notification.
+func testAPIEmail() *email.Email {
+	emailMsg := testEmail()
+	emailMsg.ReplyTo = []string{"noreply@example.com"}
+	emailMsg.HTML = []byte(`<p>Build #1 failed</p><img src="cid:logo.png">`)
+	emailMsg.Headers = textproto.MIMEHeader{
+		"Message-Id":   {"<build-1@example.com>"},
+		"X-Drone-Repo": {"octocat/hello-world"},
+	}
+	emailMsg.Attachments = []*email.Attachment{
+		{Filename: "logo.png", ContentType: "image/png", Header: textproto.MIMEHeader{}, Content: []byte("png"), HTMLRelated: true},
+		{Filename: "build.log", ContentType: "text/plain; charset=utf-8", Header: textproto.MIMEHeader{}, Content: []byte("make: *** [test] Error 1")},
+	}
+	return emailMsg
+}
+
+// rejectedEmail returns a message to a recipient in the invalid domain, which
+// the API stand-ins reject.
+func rejectedEmail() *email.Email {
+	emailMsg := testEmail()
+	emailMsg.To = []string{"Unknown <unknown@invalid>"}
+	return emailMsg
+}
+
+func TestNewAPIMessage(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		msg, err := newAPIMessage(testAPIEmail())
+
+		require.NoError(t, err)
+		assert.Equal(t, &mail.Address{Name: "Drone CI", Address: "ci@example.com"}, msg.From)
+		assert.Equal(t, []*mail.Address{{Address: "noreply@example.com"}}, msg.ReplyTo)
+		assert.Equal(t, `"Alice" <alice@example.com>, <team@example.com>, <audit@example.com>`, formatAddresses(msg.recipients()))
+		assert.Equal(t, "Build #1 failed", msg.Subject)
+		assert.Equal(t, [][2]string{{"Message-Id", "<build-1@example.com>"}, {"X-Drone-Repo", "octocat/hello-world"}}, msg.Headers)
+		assert.Equal(t, []apiAttachment{
+			{Filename: "logo.png", ContentType: "image/png", ContentID: "logo.png", Content: "cG5n"},
+			{Filename: "build.log", ContentType: "text/plain; charset=utf-8", Content: "bWFrZTogKioqIFt0ZXN0XSBFcnJvciAx"},
+		}, msg.Attachments)
+	})
+
+	t.Run("reserved headers", func(t *testing.T) {
+		t.Parallel()
+		emailMsg := testEmail()
+		emailMsg.Headers = textproto.MIMEHeader{"Subject": {"Other"}, "To": {"other@example.com"}, "In-Reply-To": {"<build-0@example.com>"}}
+
+		msg, err := newAPIMessage(emailMsg)
+
+		require.NoError(t, err)
+		assert.Equal(t, [][2]string{{"In-Reply-To", "<build-0@example.com>"}}, msg.Headers)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		_, err := newAPIMessage(&email.Email{From: "not an address", To: []string{"alice@example.com"}})
+		require.ErrorContains(t, err, "invalid sender")
+
+		_, err = newAPIMessage(&email.Email{From: "ci@example.com", Bcc: []string{"not an address"}})
+		require.ErrorContains(t, err, "invalid recipient")
+
+		_, err = newAPIMessage(&email.Email{From: "ci@example.com"})
+		require.ErrorContains(t, err, "no recipients")
+	})
+}
+
+func TestNewTransport(t *testing.T) {
+	for _, tt := range []struct {
+		cfg  Config
+		want Transport
+	}{
+		{cfg: Config{}, want: &SMTPRelays{}},
+		{cfg: Config{EmailTransport: TransportSendGrid, EmailAPIKey: "SG.test"}, want: &SendGridTransport{}},
+		{cfg: Config{EmailTransport: TransportMailgun, EmailAPIKey: "key-test", EmailMailgunDomain: "mg.example.com"}, want: &MailgunTransport{}},
+		{cfg: Config{EmailTransport: TransportSES, EmailSESRegion: "eu-west-1", EmailSESAccessKeyID: "AKIDEXAMPLE", EmailSESSecretAccessKey: "secret"}, want: &SESTransport{}},
+		{cfg: Config{EmailTransport: TransportPostmark, EmailAPIKey: "server-token"}, want: &PostmarkTransport{}},
+		{cfg: Config{EmailTransport: TransportSendmail, EmailSendmailPath: "/usr/sbin/sendmail"}, want: &SendmailTransport{}},
+		{cfg: Config{EmailTransport: TransportMaildir, DataDir: t.TempDir()}, want: &MaildirTransport{}},
+	} {
+		t.Run(string(tt.cfg.EmailTransport), func(t *testing.T) {
+			t.Parallel()
+			transport, err := NewTransport(tt.cfg)
+			require.NoError(t, err)
+			t.Cleanup(transport.Close)
+			assert.IsType(t, tt.want, transport)
+		})
+	}
+
+	t.Run("invalid api url", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewTransport(Config{EmailTransport: TransportSendGrid, EmailAPIKey: "SG.test", EmailAPIURL: "api.sendgrid.com"})
+		assert.ErrorContains(t, err, `sendgrid api: invalid url "api.sendgrid.com"`)
+	})
+}
+
+func TestEmailSender_Process(t *testing.T) {
+	newSender := func(t *testing.T, transport Transport) *EmailSender {
+		t.Helper()
+		s := &EmailSender{
+			transport:   transport,
+			maxAttempts: 5,
+			queue:       newQueue(t),
+			jobs:        make(chan *QueueItem, 1),
+			done:        make(chan struct{}),
+		}
+		t.Cleanup(func() {
+			close(s.done)
+			s.wg.Wait()
+		})
+		return s
+	}
+	push := func(t *testing.T, s *EmailSender, emailMsg *email.Email) *QueueItem {
+		t.Helper()
+		item := &QueueItem{BuildNumber: 1, Email: emailMsg}
+		require.NoError(t, s.queue.Push(item))
+		return item
+	}
+
+	t.Run("permanent rejection", func(t *testing.T) {
+		t.Parallel()
+		api := startPostmarkAPI(t)
+		s := newSender(t, newPostmarkTransport(t, api))
+		item := push(t, s, rejectedEmail())
+
+		s.process(item)
+
+		assert.Zero(t, s.queue.Len(), "the message is not retried")
+	})
+
+	t.Run("permanent smtp rejection", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withRejectMail(550))
+		s := newSender(t, newSMTPRelays(t, server.config(withTLSMode(SMTPTLSNone))))
+		item := push(t, s, testEmail())
+
+		s.process(item)
+
+		assert.Zero(t, s.queue.Len(), "the message is not retried")
+	})
+
+	t.Run("temporary smtp rejection", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t, withRejectMail(451))
+		s := newSender(t, newSMTPRelays(t, server.config(withTLSMode(SMTPTLSNone))))
+		item := push(t, s, testEmail())
+
+		s.process(item)
+
+		assert.Equal(t, 1, s.queue.Len(), "the message is retried")
+	})
+
+	t.Run("invalid envelope", func(t *testing.T) {
+		t.Parallel()
+		server := startSMTPServer(t)
+		s := newSender(t, newSMTPRelays(t, server.config(withTLSMode(SMTPTLSNone))))
+		emailMsg := testEmail()
+		emailMsg.To = []string{"not an address"}
+		item := push(t, s, emailMsg)
+
+		s.process(item)
+
+		assert.Zero(t, s.queue.Len(), "the message is not retried")
+		assert.Empty(t, server.Messages())
+	})
+
+	t.Run("temporary failure", func(t *testing.T) {
+		t.Parallel()
+		api := startAPIServer(t, func(w http.ResponseWriter, _ *http.Request, _ []byte) {
+			writeJSON(w, http.StatusServiceUnavailable, `{"ErrorCode":0,"Message":"planned downtime"}`)
+		})
+		s := newSender(t, newPostmarkTransport(t, api))
+		item := push(t, s, testEmail())
+
+		s.process(item)
+
+		items, err := s.queue.Pending()
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, 1, items[0].Attempts)
+		assert.Equal(t, "email sender failed to send message: postmark api: 503: Service Unavailable", items[0].LastError)
+		assert.WithinDuration(t, time.Now().Add(emailRetryBaseDelay), items[0].NextAttemptAt, emailRetryBaseDelay)
+	})
+}